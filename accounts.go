@@ -0,0 +1,495 @@
+package craft
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2_time     = 1
+	argon2_memory   = 64 * 1024
+	argon2_threads  = 4
+	argon2_key_len  = 32
+	argon2_salt_len = 16
+
+	min_password_length = 8
+
+	// max_concurrent_hashes bounds the memory used by argon2,
+	// every hash takes argon2_memory KiB
+	max_concurrent_hashes = 4
+
+	// max_login_attempts are the logins allowed from the same address
+	// in login_attempts_window, the successful ones reset the count
+	max_login_attempts    = 10
+	login_attempts_window = time.Minute
+)
+
+var (
+	errAccountNotFound    = errors.New("account not found")
+	errAccountExists      = errors.New("account already exists")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errSessionExpired     = errors.New("session expired")
+	errAlreadyLinked      = errors.New("minecraft account already linked to another user")
+	errTooManyLogins      = errors.New("too many login attempts")
+
+	// Usernames follow the Minecraft rules, as in IP routing
+	// the web account is the player name
+	usernameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]{3,16}$`)
+)
+
+// Account is a user of the web interface
+type Account struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	// SessionKey is stored in the login cookies and regenerated when
+	// the password changes, so that the old cookies are refused
+	SessionKey string `json:"session_key"`
+	// Role is the global role, ServerRoles replace it on single servers
+	Role        Role            `json:"role"`
+	ServerRoles map[string]Role `json:"server_roles,omitempty"`
+	// MinecraftUUID is the Minecraft account linked with a verification
+	// code, MinecraftName its player name at the time of the link
+	MinecraftUUID string    `json:"minecraft_uuid,omitempty"`
+	MinecraftName string    `json:"minecraft_name,omitempty"`
+	Created       time.Time `json:"created"`
+}
+
+// storedAccount is an Account as found in the accounts file, the
+// files written before the roles have only the admin flag
+type storedAccount struct {
+	Account
+	Admin bool `json:"admin,omitempty"`
+}
+
+// AccountStore holds the accounts, saved as JSON in a file
+type AccountStore struct {
+	path     string
+	accounts map[string]*Account
+	m        sync.RWMutex
+}
+
+// LoadAccounts reads the accounts file at path, a missing
+// file is an empty store
+func LoadAccounts(path string) (*AccountStore, error) {
+	as := &AccountStore{
+		path:     path,
+		accounts: make(map[string]*Account),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return as, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accounts: %w", err)
+	}
+
+	var accounts []storedAccount
+	err = json.Unmarshal(data, &accounts)
+	if err != nil {
+		return nil, fmt.Errorf("accounts: %s: %w", path, err)
+	}
+
+	for _, stored := range accounts {
+		account := stored.Account
+		if account.Role == "" {
+			account.Role = ROLE_PLAYER
+			if stored.Admin {
+				account.Role = ROLE_ADMIN
+			}
+		}
+		as.accounts[strings.ToLower(account.Username)] = &account
+	}
+	return as, nil
+}
+
+// saveNoLock writes the accounts file, through a
+// temporary file so that a crash can't corrupt it
+func (as *AccountStore) saveNoLock() error {
+	accounts := make([]*Account, 0, len(as.accounts))
+	for _, account := range as.accounts {
+		accounts = append(accounts, account)
+	}
+	slices.SortFunc(accounts, func(a, b *Account) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+
+	data, err := json.MarshalIndent(accounts, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(as.path, data)
+	if err != nil {
+		return fmt.Errorf("accounts: %w", err)
+	}
+	return nil
+}
+
+// Add creates a new account with the given global role
+func (as *AccountStore) Add(username string, password string, role Role) error {
+	if !usernameRegexp.MatchString(username) {
+		return fmt.Errorf("invalid username %q: use 3 to 16 letters, digits or underscores", username)
+	}
+
+	role, err := ParseRole(string(role))
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	key := strings.ToLower(username)
+	if _, ok := as.accounts[key]; ok {
+		return fmt.Errorf("%w: %s", errAccountExists, username)
+	}
+
+	as.accounts[key] = &Account{
+		Username:     username,
+		PasswordHash: hash,
+		SessionKey:   newSessionKey(),
+		Role:         role,
+		Created:      time.Now(),
+	}
+
+	err = as.saveNoLock()
+	if err != nil {
+		delete(as.accounts, key)
+	}
+	return err
+}
+
+// Delete removes an account, its cookies are refused from now on
+func (as *AccountStore) Delete(username string) error {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	key := strings.ToLower(username)
+	account, ok := as.accounts[key]
+	if !ok {
+		return fmt.Errorf("%w: %s", errAccountNotFound, username)
+	}
+
+	delete(as.accounts, key)
+
+	err := as.saveNoLock()
+	if err != nil {
+		as.accounts[key] = account
+	}
+	return err
+}
+
+// SetPassword changes the password of an account and invalidates its cookies
+func (as *AccountStore) SetPassword(username string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	account, ok := as.accounts[strings.ToLower(username)]
+	if !ok {
+		return fmt.Errorf("%w: %s", errAccountNotFound, username)
+	}
+
+	old := *account
+	account.PasswordHash = hash
+	account.SessionKey = newSessionKey()
+
+	err = as.saveNoLock()
+	if err != nil {
+		*account = old
+	}
+	return err
+}
+
+// SetRole assigns the role of an account on a server, or the global role
+// if server is empty. An empty role removes the role of the server
+func (as *AccountStore) SetRole(username string, server string, role Role) error {
+	if role != "" || server == "" {
+		var err error
+		role, err = ParseRole(string(role))
+		if err != nil {
+			return err
+		}
+	}
+	if server != "" && role == ROLE_ADMIN {
+		return errors.New("the admin role can only be global")
+	}
+
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	account, ok := as.accounts[strings.ToLower(username)]
+	if !ok {
+		return fmt.Errorf("%w: %s", errAccountNotFound, username)
+	}
+
+	old := *account
+	switch {
+	case server == "":
+		account.Role = role
+	case role == "":
+		account.ServerRoles = maps.Clone(account.ServerRoles)
+		delete(account.ServerRoles, server)
+	default:
+		account.ServerRoles = maps.Clone(account.ServerRoles)
+		if account.ServerRoles == nil {
+			account.ServerRoles = make(map[string]Role)
+		}
+		account.ServerRoles[server] = role
+	}
+
+	err := as.saveNoLock()
+	if err != nil {
+		*account = old
+	}
+	return err
+}
+
+// Link binds a Minecraft account to the account, a Minecraft
+// account can be linked to a single user
+func (as *AccountStore) Link(username string, uuid string, playerName string) error {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	account, ok := as.accounts[strings.ToLower(username)]
+	if !ok {
+		return fmt.Errorf("%w: %s", errAccountNotFound, username)
+	}
+
+	for _, other := range as.accounts {
+		if uuid != "" && other != account && other.MinecraftUUID == uuid {
+			return fmt.Errorf("%w: %s", errAlreadyLinked, other.Username)
+		}
+	}
+
+	old := *account
+	account.MinecraftUUID, account.MinecraftName = uuid, playerName
+
+	err := as.saveNoLock()
+	if err != nil {
+		*account = old
+	}
+	return err
+}
+
+// Unlink removes the Minecraft account linked to the account
+func (as *AccountStore) Unlink(username string) error {
+	return as.Link(username, "", "")
+}
+
+// ByMinecraftUUID returns the account linked to the Minecraft account
+func (as *AccountStore) ByMinecraftUUID(uuid string) (Account, bool) {
+	as.m.RLock()
+	defer as.m.RUnlock()
+
+	if uuid == "" {
+		return Account{}, false
+	}
+
+	for _, account := range as.accounts {
+		if account.MinecraftUUID == uuid {
+			return *account, true
+		}
+	}
+	return Account{}, false
+}
+
+// List returns the accounts sorted by username
+func (as *AccountStore) List() []Account {
+	as.m.RLock()
+	defer as.m.RUnlock()
+
+	accounts := make([]Account, 0, len(as.accounts))
+	for _, account := range as.accounts {
+		accounts = append(accounts, *account)
+	}
+	slices.SortFunc(accounts, func(a, b Account) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+
+	return accounts
+}
+
+// Get returns the account with the given username
+func (as *AccountStore) Get(username string) (Account, bool) {
+	as.m.RLock()
+	defer as.m.RUnlock()
+
+	account, ok := as.accounts[strings.ToLower(username)]
+	if !ok {
+		return Account{}, false
+	}
+	return *account, true
+}
+
+// Authenticate checks the password of an account. The error does not
+// tell whether the account exists
+func (as *AccountStore) Authenticate(username string, password string) (Account, error) {
+	account, ok := as.Get(username)
+	if !ok {
+		// Spend the same time as for an existing account
+		verifyPassword("", password)
+		return Account{}, errInvalidCredentials
+	}
+
+	if !verifyPassword(account.PasswordHash, password) {
+		return Account{}, errInvalidCredentials
+	}
+	return account, nil
+}
+
+// checkSession returns the account of a login cookie, if
+// the account still exists and the password did not change
+func (as *AccountStore) checkSession(username string, sessionKey string) (Account, error) {
+	account, ok := as.Get(username)
+	if !ok {
+		return Account{}, fmt.Errorf("%w: %s", errAccountNotFound, username)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(account.SessionKey), []byte(sessionKey)) != 1 {
+		return Account{}, errSessionExpired
+	}
+	return account, nil
+}
+
+func newSessionKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hashSlots limits the argon2 hashes computed at the same time
+var hashSlots = make(chan struct{}, max_concurrent_hashes)
+
+func argon2Key(password string, salt []byte, iterations uint32, memory uint32, threads uint8, keyLen uint32) []byte {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+
+	return argon2.IDKey([]byte(password), salt, iterations, memory, threads, keyLen)
+}
+
+// loginAttempts counts the logins from an address
+// since the start of its window
+type loginAttempts struct {
+	start time.Time
+	count int
+}
+
+// loginLimiter limits the login attempts by address,
+// as each one costs an argon2 hash
+type loginLimiter struct {
+	attempts map[string]loginAttempts
+	m        sync.Mutex
+}
+
+// allow records a login attempt from the address,
+// reporting whether it can go on
+func (ll *loginLimiter) allow(addr string, now time.Time) bool {
+	ll.m.Lock()
+	defer ll.m.Unlock()
+
+	if ll.attempts == nil {
+		ll.attempts = make(map[string]loginAttempts)
+	}
+
+	// Forget the windows expired, on the same pass
+	for key, attempts := range ll.attempts {
+		if now.Sub(attempts.start) >= login_attempts_window {
+			delete(ll.attempts, key)
+		}
+	}
+
+	attempts, ok := ll.attempts[addr]
+	if !ok {
+		attempts.start = now
+	}
+	if attempts.count >= max_login_attempts {
+		return false
+	}
+
+	attempts.count++
+	ll.attempts[addr] = attempts
+	return true
+}
+
+// reset forgets the attempts from the address after a successful login
+func (ll *loginLimiter) reset(addr string) {
+	ll.m.Lock()
+	delete(ll.attempts, addr)
+	ll.m.Unlock()
+}
+
+// hashPassword returns the argon2id hash of the password
+// in the PHC string format
+func hashPassword(password string) (string, error) {
+	if len(password) < min_password_length {
+		return "", fmt.Errorf("the password must be at least %d characters long", min_password_length)
+	}
+
+	salt := make([]byte, argon2_salt_len)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	hash := argon2Key(password, salt, argon2_time, argon2_memory, argon2_threads, argon2_key_len)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2_memory, argon2_time, argon2_threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// verifyPassword checks a password against a hash made by hashPassword,
+// the parameters are read from the hash
+func verifyPassword(encoded string, password string) bool {
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	var salt, hash []byte
+
+	parts := strings.Split(encoded, "$")
+	ok := len(parts) == 6 && parts[1] == "argon2id"
+	if ok {
+		_, err1 := fmt.Sscanf(parts[2], "v=%d", &version)
+		_, err2 := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+		var err3, err4 error
+		salt, err3 = base64.RawStdEncoding.DecodeString(parts[4])
+		hash, err4 = base64.RawStdEncoding.DecodeString(parts[5])
+		ok = errors.Join(err1, err2, err3, err4) == nil && version == argon2.Version
+	}
+
+	if !ok {
+		memory, iterations, threads = argon2_memory, argon2_time, argon2_threads
+		salt, hash = make([]byte, argon2_salt_len), make([]byte, argon2_key_len)
+	}
+
+	other := argon2Key(password, salt, iterations, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, other) == 1 && ok
+}
@@ -0,0 +1,153 @@
+package craft
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	_, err := hashPassword("short")
+	if err == nil {
+		t.Fatal("expected an error for a short password")
+	}
+
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoded  string
+		password string
+		ok       bool
+	}{
+		{"correct password", hash, "correct horse", true},
+		{"wrong password", hash, "battery staple", false},
+		{"malformed hash", "$argon2id$v=19$bad", "correct horse", false},
+		{"other algorithm", "$2a$10$abcdefghijklmnopqrstuv", "correct horse", false},
+		{"empty hash", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := verifyPassword(tt.encoded, tt.password); ok != tt.ok {
+				t.Fatalf("expected %v, got %v", tt.ok, ok)
+			}
+		})
+	}
+}
+
+func TestLoadAccountsMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	data := `[
+		{"username": "Alice", "password_hash": "", "session_key": "a", "admin": true},
+		{"username": "bob", "password_hash": "", "session_key": "b"},
+		{"username": "carol", "password_hash": "", "session_key": "c", "role": "operator", "admin": true}
+	]`
+	err := os.WriteFile(path, []byte(data), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := LoadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		role     Role
+	}{
+		{"alice", ROLE_ADMIN},
+		{"bob", ROLE_PLAYER},
+		{"carol", ROLE_OPERATOR},
+	}
+
+	for _, tt := range tests {
+		account, ok := as.Get(tt.username)
+		if !ok {
+			t.Fatalf("account %s not found", tt.username)
+		}
+		if account.Role != tt.role {
+			t.Fatalf("%s: expected role %s, got %s", tt.username, tt.role, account.Role)
+		}
+	}
+}
+
+func TestSessionInvalidation(t *testing.T) {
+	as, err := LoadAccounts(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = as.Add("Alice", "correct horse", ROLE_PLAYER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := as.Authenticate("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionKey := account.SessionKey
+
+	_, err = as.checkSession("ALICE", sessionKey)
+	if err != nil {
+		t.Fatalf("expected a valid session, got %v", err)
+	}
+
+	err = as.SetPassword("alice", "battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = as.checkSession("alice", sessionKey)
+	if !errors.Is(err, errSessionExpired) {
+		t.Fatalf("expected %v after the password change, got %v", errSessionExpired, err)
+	}
+
+	account, err = as.Authenticate("alice", "battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = as.Delete("ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = as.checkSession("alice", account.SessionKey)
+	if !errors.Is(err, errAccountNotFound) {
+		t.Fatalf("expected %v after the delete, got %v", errAccountNotFound, err)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	var ll loginLimiter
+	now := time.Now()
+
+	for i := range max_login_attempts {
+		if !ll.allow("10.0.0.1", now) {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	if ll.allow("10.0.0.1", now) {
+		t.Fatal("expected the attempt over the limit to be refused")
+	}
+	if !ll.allow("10.0.0.2", now) {
+		t.Fatal("expected another address to be allowed")
+	}
+	if !ll.allow("10.0.0.1", now.Add(login_attempts_window)) {
+		t.Fatal("expected the attempts to be allowed after the window")
+	}
+
+	for range max_login_attempts {
+		ll.allow("10.0.0.3", now)
+	}
+	ll.reset("10.0.0.3")
+	if !ll.allow("10.0.0.3", now) {
+		t.Fatal("expected the attempts to be allowed after a reset")
+	}
+}
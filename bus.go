@@ -0,0 +1,123 @@
+package craft
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of an Event or a GameEvent
+type EventType string
+
+const (
+	EVENT_SERVER_STARTING   EventType = "server_starting"
+	EVENT_SERVER_READY      EventType = "server_ready"
+	EVENT_SERVER_STOPPED    EventType = "server_stopped"
+	EVENT_SERVER_CRASHED    EventType = "server_crashed"
+	EVENT_SERVER_CRASH_LOOP EventType = "server_crash_loop"
+	EVENT_PLAYER_JOINED     EventType = "player_joined"
+	EVENT_PLAYER_LEFT       EventType = "player_left"
+	EVENT_CHAT              EventType = "chat"
+	EVENT_USER_LOGGED_IN    EventType = "user_logged_in"
+	EVENT_COMMAND           EventType = "command"
+	EVENT_ACCOUNT_LINKED    EventType = "account_linked"
+
+	event_subscription_buffer = 64
+)
+
+// Event is published on the McServerManager event bus, see Subscribe
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Server is empty for the events not related to a server,
+	// like EVENT_USER_LOGGED_IN
+	Server string `json:"server,omitempty"`
+	// Actor is the player or web user that caused the event,
+	// empty if it was caused by the server or by Nixcraft itself
+	Actor string `json:"actor,omitempty"`
+	// Message is the chat message, the command or the crash error,
+	// depending on the event type
+	Message string `json:"message,omitempty"`
+}
+
+// EventFilter selects the events delivered to a subscriber,
+// a nil filter selects every event
+type EventFilter func(ev Event) bool
+
+// EventTypes returns a filter selecting only the given event types
+func EventTypes(types ...EventType) EventFilter {
+	return func(ev Event) bool {
+		return slices.Contains(types, ev.Type)
+	}
+}
+
+// ServerEvents returns a filter selecting only the events of a server
+func ServerEvents(name string) EventFilter {
+	return func(ev Event) bool {
+		return ev.Server == name
+	}
+}
+
+type eventBus struct {
+	subs map[*subscription]struct{}
+	m    sync.RWMutex
+}
+
+type subscription struct {
+	ch     chan Event
+	filter EventFilter
+}
+
+// Subscribe returns a channel receiving the events selected by the filter,
+// which is closed when ctx is done. Events are dropped for subscribers
+// that do not keep up, so that they can't block the servers
+func (msm *McServerManager) Subscribe(ctx context.Context, filter EventFilter) <-chan Event {
+	sub := &subscription{
+		ch:     make(chan Event, event_subscription_buffer),
+		filter: filter,
+	}
+
+	msm.bus.m.Lock()
+	if msm.bus.subs == nil {
+		msm.bus.subs = make(map[*subscription]struct{})
+	}
+	msm.bus.subs[sub] = struct{}{}
+	msm.bus.m.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		msm.bus.m.Lock()
+		delete(msm.bus.subs, sub)
+		close(sub.ch)
+		msm.bus.m.Unlock()
+	}()
+
+	return sub.ch
+}
+
+// publish sends an event to the matching subscribers
+func (msm *McServerManager) publish(typ EventType, server string, actor string, message string) {
+	ev := Event{
+		Type:    typ,
+		Time:    time.Now(),
+		Server:  server,
+		Actor:   actor,
+		Message: message,
+	}
+
+	msm.bus.m.RLock()
+	defer msm.bus.m.RUnlock()
+
+	for sub := range msm.bus.subs {
+		if sub.filter != nil && !sub.filter(ev) {
+			continue
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
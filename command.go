@@ -1,13 +1,21 @@
 package craft
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nixpare/server/v3/commands"
 )
 
-func mcCommand(msm *McServerManager) commands.ServerCommandHandler {
+func (nc *Nixcraft) mcCommand() commands.ServerCommandHandler {
+	msm := nc.Manager
+
 	return func(sc *commands.ServerConn, args ...string) (exitCode int, err error) {
 		if len(args) == 0 {
 			err = sc.WriteOutput(help(""))
@@ -31,19 +39,25 @@ func mcCommand(msm *McServerManager) commands.ServerCommandHandler {
 			}
 		case "stop":
 			name := args[1]
-			err = msm.Stop(name)
+			err = msm.Stop(name, strings.Join(args[2:], " "))
 			if err == nil {
 				err = sc.WriteOutput("Server stopped!")
 			}
-		case "kill":
+		case "cancel-stop":
 			name := args[1]
-			srv, ok := msm.Servers[name]
-			if !ok {
-				err = fmt.Errorf("server %s not found", name)
-				break
+			err = msm.CancelStop(name)
+			if err == nil {
+				err = sc.WriteOutput("Stop cancelled!")
 			}
-
-			err = srv.process.Kill()
+		case "restart":
+			name := args[1]
+			err = msm.Restart(name)
+			if err == nil {
+				err = sc.WriteOutput("Server " + name + " restarted!")
+			}
+		case "kill":
+			name := args[1]
+			err = msm.Kill(name)
 			if err == nil {
 				err = sc.WriteOutput("Server killed!")
 			}
@@ -55,10 +69,31 @@ func mcCommand(msm *McServerManager) commands.ServerCommandHandler {
 				break
 			}
 
-			err = srv.SendInput(strings.Join(args[2:], " "))
-			if err == nil {
-				err = sc.WriteOutput("Sent!")
+			cmd := strings.Join(args[2:], " ")
+			msm.publish(EVENT_COMMAND, name, "", cmd)
+
+			ctx, cancel := context.WithTimeout(context.Background(), exec_timeout)
+			var output []LogLine
+			output, err = srv.Exec(ctx, cmd)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = nil
+				output = append(output, LogLine{Message: "(output truncated, the server is still writing)"})
+			}
+			if err != nil {
+				break
+			}
+
+			if len(output) == 0 {
+				err = sc.WriteOutput("Sent! (no output)")
+				break
+			}
+
+			messages := make([]string, 0, len(output))
+			for _, line := range output {
+				messages = append(messages, line.Message)
 			}
+			err = sc.WriteOutput(strings.Join(messages, "\n"))
 		case "connect":
 			name := args[1]
 			srv, ok := msm.Servers[name]
@@ -68,13 +103,19 @@ func mcCommand(msm *McServerManager) commands.ServerCommandHandler {
 			}
 
 			err = srv.Connect(sc)
+		case "logs":
+			err = mcLogs(msm, sc, args[1:]...)
 		case "status":
 			err = mcStatus(msm, sc)
+		case "user":
+			err = nc.mcUserCommand(sc, args[1:]...)
 		case "react":
-			forwardToReact = true
+			nc.forwardToReact.Store(true)
+			msm.setSetting(setting_forward_to_react, "true")
 			err = sc.WriteOutput("Now redirecting to react")
 		case "static":
-			forwardToReact = false
+			nc.forwardToReact.Store(false)
+			msm.setSetting(setting_forward_to_react, "false")
 			err = sc.WriteOutput("Now serving static content")
 		case "help":
 			err = sc.WriteOutput(help(""))
@@ -90,6 +131,185 @@ func mcCommand(msm *McServerManager) commands.ServerCommandHandler {
 	}
 }
 
+func (nc *Nixcraft) mcUserCommand(sc *commands.ServerConn, args ...string) error {
+	if len(args) == 0 {
+		return errors.New("missing user command: add, del, passwd, role, unlink or list")
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) < 3 {
+			return errors.New("usage: mc user add <username> <password> [role]")
+		}
+
+		role := ROLE_PLAYER
+		if len(args) > 3 {
+			role = Role(args[3])
+		}
+
+		err := nc.Accounts.Add(args[1], args[2], role)
+		if err != nil {
+			return err
+		}
+		return sc.WriteOutput("User " + args[1] + " created!")
+	case "del":
+		if len(args) < 2 {
+			return errors.New("usage: mc user del <username>")
+		}
+
+		err := nc.Accounts.Delete(args[1])
+		if err != nil {
+			return err
+		}
+
+		nc.Manager.forgetUser(args[1])
+
+		return sc.WriteOutput("User " + args[1] + " deleted!")
+	case "passwd":
+		if len(args) < 3 {
+			return errors.New("usage: mc user passwd <username> <password>")
+		}
+
+		err := nc.Accounts.SetPassword(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		return sc.WriteOutput("Password of " + args[1] + " changed!")
+	case "role":
+		if len(args) < 3 {
+			return errors.New("usage: mc user role <username> <role|none> [server_name]")
+		}
+
+		role := Role(args[2])
+		if role == "none" {
+			role = ""
+		}
+
+		var srvName string
+		if len(args) > 3 {
+			srvName = args[3]
+		}
+
+		err := nc.Accounts.SetRole(args[1], srvName, role)
+		if err != nil {
+			return err
+		}
+		nc.Manager.SignalStateUpdate()
+
+		return sc.WriteOutput("Role of " + args[1] + " changed!")
+	case "unlink":
+		if len(args) < 2 {
+			return errors.New("usage: mc user unlink <username>")
+		}
+
+		err := nc.Accounts.Unlink(args[1])
+		if err != nil {
+			return err
+		}
+		return sc.WriteOutput("Minecraft account of " + args[1] + " unlinked!")
+	case "list":
+		sb := strings.Builder{}
+		sb.WriteString("\nNixcraft users: [ ")
+		accounts := nc.Accounts.List()
+		for _, account := range accounts {
+			sb.WriteString("\n        ")
+			sb.WriteString(account.Username)
+			sb.WriteString(" (" + string(account.Role))
+			for _, srvName := range slices.Sorted(maps.Keys(account.ServerRoles)) {
+				sb.WriteString(", " + srvName + ": " + string(account.ServerRoles[srvName]))
+			}
+			sb.WriteString(")")
+			if account.MinecraftUUID != "" {
+				sb.WriteString(" linked to " + account.MinecraftName + " " + account.MinecraftUUID)
+			}
+		}
+		if len(accounts) != 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("]\n")
+
+		return sc.WriteOutput(sb.String())
+	default:
+		return fmt.Errorf("unknown user command: %s", args[0])
+	}
+}
+
+// mcLogs prints the archived console lines of a server matching the flags,
+// the same search of the logs API
+func mcLogs(msm *McServerManager, sc *commands.ServerConn, args ...string) error {
+	if len(args) == 0 {
+		return errors.New("missing server name")
+	}
+
+	name := args[0]
+	srv, ok := msm.Servers[name]
+	if !ok {
+		return fmt.Errorf("server %s not found", name)
+	}
+
+	var q LogQuery
+	for i := 1; i < len(args); i++ {
+		flag := args[i]
+		if i+1 >= len(args) {
+			return fmt.Errorf("missing value of %s", flag)
+		}
+		i++
+		value := args[i]
+
+		var err error
+		switch flag {
+		case "--grep":
+			q.Text = value
+		case "--since":
+			q.From, err = parseLogTime(value)
+		case "--until":
+			q.To, err = parseLogTime(value)
+		case "--level":
+			q.Levels = append(q.Levels, strings.Split(value, ",")...)
+		case "--tag":
+			q.Tags = append(q.Tags, strings.Split(value, ",")...)
+		case "--limit":
+			q.Limit, err = strconv.Atoi(value)
+			if err == nil && q.Limit <= 0 {
+				err = fmt.Errorf("invalid limit %d", q.Limit)
+			}
+		default:
+			err = fmt.Errorf("unknown flag %s", flag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	page, err := srv.archive.search(q)
+	if err != nil {
+		return err
+	}
+
+	sb := strings.Builder{}
+	if page.Next != "" {
+		sb.WriteString("(older lines omitted, use --limit or --since to see them)\n")
+	}
+	for _, line := range page.Lines {
+		sb.WriteString(line.Time().Local().Format(time.DateTime))
+		if line.Level != "" {
+			sb.WriteString(" [" + strings.ToUpper(line.Level) + "]")
+		}
+		if len(line.Tags) != 0 {
+			sb.WriteString(" [" + strings.Join(line.Tags, ",") + "]")
+		}
+		sb.WriteString(" " + line.Message + "\n")
+		if line.Extra != "" {
+			sb.WriteString("    " + strings.ReplaceAll(line.Extra, "\n", "\n    ") + "\n")
+		}
+	}
+	if len(page.Lines) == 0 {
+		sb.WriteString("No logs found")
+	}
+
+	return sc.WriteOutput(strings.TrimSuffix(sb.String(), "\n"))
+}
+
 func mcStatus(msm *McServerManager, sc *commands.ServerConn) error {
 	sb := strings.Builder{}
 	sb.WriteString("\nNixcraft Server Status:\n")
@@ -108,11 +328,34 @@ func mcStatus(msm *McServerManager, sc *commands.ServerConn) error {
 		sb.WriteString("\n  - ")
 		sb.WriteString(srvName)
 
+		state, progress := srv.State()
+		switch state {
+		case SERVER_STARTING:
+			sb.WriteString(fmt.Sprintf("        Starting (%d%%)\n", progress))
+		case SERVER_RUNNING:
+			sb.WriteString("        Online\n")
+		case SERVER_CRASH_LOOP:
+			sb.WriteString("        Crash loop\n")
+		default:
+			sb.WriteString("        " + strings.ToUpper(string(state[:1])) + string(state[1:]) + "\n")
+		}
+
+		if crashes := srv.Crashes(); len(crashes) != 0 {
+			last := crashes[len(crashes)-1]
+			sb.WriteString(fmt.Sprintf(
+				"\nCrashes: %d, last at %s with code %d\n",
+				len(crashes), last.Time.Format(time.DateTime), last.ExitCode,
+			))
+			for _, line := range last.Stderr {
+				sb.WriteString("            ")
+				sb.WriteString(line)
+				sb.WriteString("\n")
+			}
+		}
+
 		if !srv.IsRunning() {
-			sb.WriteString("        Offline\n")
 			continue
 		}
-		sb.WriteString("        Online\n")
 
 		srv.m.RLock()
 
@@ -141,12 +384,31 @@ func help(errMessage string) string {
 
 Usage: mc [ option [ args ... ] ]
     Options:
-        - start   <server_name> : starts the named server
-        - stop    <server_name> : stop the running server
-        - kill    <server_name> : kills the running server
+        - start       <server_name>          : starts the named server
+        - stop        <server_name> [reason] : stop the running server, showing the reason to the players
+        - cancel-stop <server_name>          : cancels a stop still in its countdown
+        - restart     <server_name>          : stops and starts again the running server
+        - kill        <server_name>          : kills the running server
 
         - connect <server_name>         : attaches the terminal to the server process, end with CTRL-C
-        - send    <server_name> <input> : sends the provided input to the running server
+        - send    <server_name> <input> : sends the provided input to the running server, printing its output
+
+        - logs <server_name> [flags] : searches the console of the current and past sessions, flags:
+            --grep <text>          : lines containing the text, ignoring the case
+            --since/--until <time> : a date, a date and time or a duration ago (e.g. 2h, 7d)
+            --level <level>        : lines with the level, e.g. info, warning, error
+            --tag <tag>            : lines with the tag: stdout, stderr, user, chat or server
+            --limit <n>            : prints the last n lines, 100 by default
+
+        - user add    <username> <password> [role]            : creates a web account, player by default
+        - user del    <username>                              : deletes a web account, logging it out
+        - user passwd <username> <password>                   : changes the password, logging the user out
+        - user role   <username> <role|none> [server_name]    : sets the global role or the one on a server,
+                                                                none removes the role on the server
+        - user unlink <username>                              : removes the link to the Minecraft account
+        - user list                                           : lists the web accounts and their roles
+
+        Roles: viewer, player, operator, admin
 
         - reload : reloads the servers list from the install directory
         - status : prints the servers status
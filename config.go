@@ -0,0 +1,303 @@
+package craft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds every setting needed to run Nixcraft. It is usually loaded
+// from a JSON file with LoadConfig, and every key can be overridden with an
+// environment variable named NIXCRAFT_<KEY> (e.g. NIXCRAFT_PUBLIC_PORT)
+type Config struct {
+	// PublicPort is the port the Minecraft proxy listens on; the backend
+	// servers are assigned the ports right after it
+	PublicPort int `json:"public_port"`
+	// ServersPath is the directory containing one directory per server
+	ServersPath string `json:"servers_path"`
+
+	// AccountsPath is the JSON file with the web interface accounts,
+	// managed with the mc user command
+	AccountsPath string `json:"accounts_path"`
+	// StatePath is the JSON file where the users, their routing, the
+	// player sessions and the events are kept across restarts
+	StatePath      string `json:"state_path"`
+	CookieName     string `json:"cookie_name"`
+	CookieHashKey  string `json:"cookie_hash_key"`
+	CookieBlockKey string `json:"cookie_block_key"`
+
+	// BaseDir is the directory containing the built web app (dist folder)
+	BaseDir string `json:"base_dir"`
+	// ReactAddr is the address of the vite dev server used when
+	// ForwardToReact is enabled
+	ReactAddr      string `json:"react_addr"`
+	ForwardToReact bool   `json:"forward_to_react"`
+
+	// ProxyRouting selects how the proxy chooses the backend server for
+	// a player: PROXY_ROUTING_IP, the default, uses the server selected in
+	// the web interface from the same IP, PROXY_ROUTING_HOSTNAME uses the
+	// address typed in the client and the hostnames declared in each server
+	// manifest. Hostname routing requires no web login: the players are
+	// admitted by the Minecraft servers, so they should run in online mode
+	// with a whitelist
+	ProxyRouting string `json:"proxy_routing"`
+	// DefaultServer is the server used in hostname routing when no
+	// manifest hostname matches, leave empty to reject those players
+	DefaultServer string `json:"default_server"`
+
+	// MotdOffline and MotdStarting are shown in the multiplayer list when
+	// the server is not running or still starting. The {server} and
+	// {progress} placeholders are replaced with the server display name
+	// and the boot progress
+	MotdOffline  string `json:"motd_offline"`
+	MotdStarting string `json:"motd_starting"`
+
+	// PublicURL is the address of the web interface, used
+	// for the {url} placeholder in the messages
+	PublicURL string `json:"public_url"`
+
+	// The Message* keys are the disconnect messages shown to the players
+	// rejected by the proxy. Other than the MOTD placeholders, {player} and
+	// {url} are replaced with the player name and the public URL
+	MessageStarting         string `json:"message_starting"`
+	MessageUnknownUser      string `json:"message_unknown_user"`
+	MessageIPMismatch       string `json:"message_ip_mismatch"`
+	MessageAlreadyConnected string `json:"message_already_connected"`
+	MessageNoServerSelected string `json:"message_no_server_selected"`
+	MessageUnknownHost      string `json:"message_unknown_host"`
+	MessageServerOffline    string `json:"message_server_offline"`
+	MessageReady            string `json:"message_ready"`
+	// MessageLinkCode is shown to the players not linked to a web user,
+	// {code} is replaced with the code to enter in the web interface
+	MessageLinkCode     string `json:"message_link_code"`
+	MessageUUIDMismatch string `json:"message_uuid_mismatch"`
+
+	// The console of each server is archived in its directory, the file is
+	// rotated and compressed after LogMaxSizeMB megabytes and the archives
+	// are deleted after LogMaxAgeDays days or above LogMaxFiles files.
+	// Zero disables the limit
+	LogMaxSizeMB  int `json:"log_max_size_mb"`
+	LogMaxAgeDays int `json:"log_max_age_days"`
+	LogMaxFiles   int `json:"log_max_files"`
+
+	// Limbo keeps the players joining a starting server in an empty world
+	// until it is ready, instead of disconnecting them. LimboTitle is the
+	// boss bar text
+	Limbo      bool   `json:"limbo"`
+	LimboTitle string `json:"limbo_title"`
+	// StartOnJoinCooldown is the minimum number of seconds between two
+	// servers started on join from the same IP address, and
+	// StartOnJoinServerCooldown between two starts on join of the
+	// same server from any address
+	StartOnJoinCooldown       int `json:"start_on_join_cooldown"`
+	StartOnJoinServerCooldown int `json:"start_on_join_server_cooldown"`
+}
+
+const (
+	PROXY_ROUTING_HOSTNAME = "hostname"
+	PROXY_ROUTING_IP       = "ip"
+)
+
+const config_env_prefix = "NIXCRAFT_"
+
+// DefaultConfig returns a Config with all the optional keys filled
+func DefaultConfig() Config {
+	return Config{
+		PublicPort:   25565,
+		CookieName:   "nixcraft",
+		AccountsPath: "accounts.json",
+		StatePath:    "state.json",
+		BaseDir:      ".",
+		ReactAddr:    "http://localhost:5173",
+
+		ProxyRouting: PROXY_ROUTING_IP,
+
+		MotdOffline:  "{server} is sleeping - join to wake it up",
+		MotdStarting: "{server} is starting... {progress}%",
+
+		MessageStarting:         "{server} is starting, rejoin in ~30s",
+		MessageUnknownUser:      "{player} is not logged in: log in at {url} and press Connect first",
+		MessageIPMismatch:       "Your IP address does not match your web login: log in at {url} from this network and press Connect",
+		MessageAlreadyConnected: "{player} is already connected",
+		MessageNoServerSelected: "No server selected: open {url} and press Connect first",
+		MessageUnknownHost:      "There is no server at this address",
+		MessageServerOffline:    "{server} is offline: start it from {url}",
+		MessageReady:            "{server} is ready, rejoin to play",
+		MessageLinkCode:         "To play as {player}, log in at {url} and link your Minecraft account with the code {code}",
+		MessageUUIDMismatch:     "{player} is linked to another Minecraft account",
+
+		LogMaxSizeMB:  10,
+		LogMaxAgeDays: 30,
+		LogMaxFiles:   20,
+
+		Limbo:      true,
+		LimboTitle: "{server} is starting... {progress}%",
+
+		StartOnJoinCooldown:       300,
+		StartOnJoinServerCooldown: 60,
+	}
+}
+
+// LoadConfig reads the config file at path (if not empty) on top of the
+// default values, then applies the environment overrides and validates
+// the result
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("config: %w", err)
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("config: %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+type configField struct {
+	key      string
+	value    any
+	optional bool
+}
+
+func (cfg *Config) fields() []configField {
+	return []configField{
+		{"public_port", &cfg.PublicPort, false},
+		{"servers_path", &cfg.ServersPath, false},
+		{"accounts_path", &cfg.AccountsPath, true},
+		{"state_path", &cfg.StatePath, true},
+		{"cookie_name", &cfg.CookieName, false},
+		{"cookie_hash_key", &cfg.CookieHashKey, false},
+		{"cookie_block_key", &cfg.CookieBlockKey, false},
+		{"base_dir", &cfg.BaseDir, false},
+		{"react_addr", &cfg.ReactAddr, false},
+		{"forward_to_react", &cfg.ForwardToReact, true},
+		{"proxy_routing", &cfg.ProxyRouting, false},
+		{"default_server", &cfg.DefaultServer, true},
+		{"motd_offline", &cfg.MotdOffline, true},
+		{"motd_starting", &cfg.MotdStarting, true},
+		{"public_url", &cfg.PublicURL, true},
+		{"message_starting", &cfg.MessageStarting, true},
+		{"message_unknown_user", &cfg.MessageUnknownUser, true},
+		{"message_ip_mismatch", &cfg.MessageIPMismatch, true},
+		{"message_already_connected", &cfg.MessageAlreadyConnected, true},
+		{"message_no_server_selected", &cfg.MessageNoServerSelected, true},
+		{"message_unknown_host", &cfg.MessageUnknownHost, true},
+		{"message_server_offline", &cfg.MessageServerOffline, true},
+		{"message_ready", &cfg.MessageReady, true},
+		{"message_link_code", &cfg.MessageLinkCode, true},
+		{"message_uuid_mismatch", &cfg.MessageUUIDMismatch, true},
+		{"log_max_size_mb", &cfg.LogMaxSizeMB, true},
+		{"log_max_age_days", &cfg.LogMaxAgeDays, true},
+		{"log_max_files", &cfg.LogMaxFiles, true},
+		{"limbo", &cfg.Limbo, true},
+		{"limbo_title", &cfg.LimboTitle, true},
+		{"start_on_join_cooldown", &cfg.StartOnJoinCooldown, true},
+		{"start_on_join_server_cooldown", &cfg.StartOnJoinServerCooldown, true},
+	}
+}
+
+func (cfg *Config) applyEnv() error {
+	for _, f := range cfg.fields() {
+		env := config_env_prefix + strings.ToUpper(f.key)
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		switch v := f.value.(type) {
+		case *string:
+			*v = s
+		case *int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("config: invalid %s from %s: %w", f.key, env, err)
+			}
+			*v = n
+		case *bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("config: invalid %s from %s: %w", f.key, env, err)
+			}
+			*v = b
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that all the required keys are set and that
+// every value is usable
+func (cfg Config) Validate() error {
+	var errs []error
+
+	for _, f := range cfg.fields() {
+		if s, ok := f.value.(*string); ok && *s == "" && !f.optional {
+			errs = append(errs, fmt.Errorf("config: missing %s", f.key))
+		}
+	}
+
+	if cfg.PublicPort <= 0 || cfg.PublicPort > 65535 {
+		errs = append(errs, fmt.Errorf("config: invalid public_port: %d is not a valid port", cfg.PublicPort))
+	}
+
+	if cfg.ServersPath != "" {
+		if info, err := os.Stat(cfg.ServersPath); err != nil {
+			errs = append(errs, fmt.Errorf("config: invalid servers_path: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("config: invalid servers_path: %s is not a directory", cfg.ServersPath))
+		}
+	}
+
+	for _, f := range []struct {
+		key   string
+		value int
+	}{
+		{"log_max_size_mb", cfg.LogMaxSizeMB},
+		{"log_max_age_days", cfg.LogMaxAgeDays},
+		{"log_max_files", cfg.LogMaxFiles},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("config: invalid %s: %d is negative", f.key, f.value))
+		}
+	}
+
+	if cfg.StartOnJoinCooldown < 0 {
+		errs = append(errs, fmt.Errorf("config: invalid start_on_join_cooldown: %d is negative", cfg.StartOnJoinCooldown))
+	}
+	if cfg.StartOnJoinServerCooldown < 0 {
+		errs = append(errs, fmt.Errorf("config: invalid start_on_join_server_cooldown: %d is negative", cfg.StartOnJoinServerCooldown))
+	}
+
+	switch cfg.ProxyRouting {
+	case PROXY_ROUTING_HOSTNAME, PROXY_ROUTING_IP:
+	default:
+		errs = append(errs, fmt.Errorf("config: invalid proxy_routing: must be %q or %q, found %q", PROXY_ROUTING_HOSTNAME, PROXY_ROUTING_IP, cfg.ProxyRouting))
+	}
+
+	if n := len(cfg.CookieHashKey); n != 0 && n != 32 && n != 64 {
+		errs = append(errs, fmt.Errorf("config: invalid cookie_hash_key: must be 32 or 64 bytes long, found %d", n))
+	}
+
+	switch n := len(cfg.CookieBlockKey); n {
+	case 0, 16, 24, 32:
+	default:
+		errs = append(errs, fmt.Errorf("config: invalid cookie_block_key: must be 16, 24 or 32 bytes long, found %d", n))
+	}
+
+	return errors.Join(errs...)
+}
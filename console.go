@@ -0,0 +1,306 @@
+package craft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/nixpare/logger/v3"
+	"github.com/nixpare/nix"
+)
+
+const (
+	// console_protocol_v2 is the WebSocket subprotocol of the console with
+	// JSON frames, the clients not asking for it get the raw logs and send
+	// the commands as text
+	console_protocol_v2       = "nixcraft.console.v2"
+	console_subscribe_timeout = time.Second * 10
+)
+
+// ConsoleFrameType is the kind of a frame of the console protocol
+type ConsoleFrameType string
+
+const (
+	// CONSOLE_SUBSCRIBE is the first frame sent by the client
+	CONSOLE_SUBSCRIBE ConsoleFrameType = "subscribe"
+	CONSOLE_COMMAND   ConsoleFrameType = "command"
+
+	// CONSOLE_SUBSCRIBED answers the subscription, before the missing logs
+	CONSOLE_SUBSCRIBED ConsoleFrameType = "subscribed"
+	CONSOLE_LOG        ConsoleFrameType = "log"
+	// CONSOLE_RESULT answers a command, with the error if it failed
+	CONSOLE_RESULT ConsoleFrameType = "result"
+	CONSOLE_ERROR  ConsoleFrameType = "error"
+)
+
+// consoleFrame is a frame of the console protocol in both directions,
+// only the fields of its type are set
+type consoleFrame struct {
+	Type ConsoleFrameType `json:"type"`
+
+	// After is the id of the last log received by the client, which gets
+	// only the following ones. Levels and Tags filter the logs, Backlog
+	// is the maximum number of missing logs to send
+	After   string   `json:"after,omitempty"`
+	Levels  []string `json:"levels,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Backlog *int     `json:"backlog,omitempty"`
+
+	// Session is the start time of the server process. Reset tells the
+	// client that the logs sent don't continue from the last one it has,
+	// so it must discard them
+	Version int   `json:"version,omitempty"`
+	Session int64 `json:"session,omitempty"`
+	Reset   bool  `json:"reset,omitempty"`
+
+	Log *LogLine `json:"log,omitempty"`
+
+	// ID is chosen by the client to match the result with the command,
+	// Output are the lines written by the server after the command
+	ID      string    `json:"id,omitempty"`
+	Command string    `json:"command,omitempty"`
+	Output  []LogLine `json:"output,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// serverConsole are the loggers of a server session used by a console connection
+type serverConsole struct {
+	srv       *McServer
+	log       *logger.Logger
+	serverLog *logger.Logger
+	userLog   *logger.Logger
+	session   int64
+}
+
+func writeConsoleFrame(ctx context.Context, conn *websocket.Conn, frame consoleFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, websocket.MessageText, data)
+}
+
+// consoleCommand runs a command from the web console with run. The role is
+// checked on every command, as it can change while the user is connected
+func (nc *Nixcraft) consoleCommand(c serverConsole, username string, cmd string, run func(cmd string) error) error {
+	account, _ := nc.Accounts.Get(username)
+	if !account.Can(c.srv.Name, PERM_CONSOLE) {
+		c.serverLog.Printf(logger.LOG_LEVEL_WARNING, "User %s tried to send command <%s> without the console permission", username, cmd)
+		return fmt.Errorf("no %s permission on server %s", PERM_CONSOLE, c.srv.Name)
+	}
+
+	c.userLog.Printf(logger.LOG_LEVEL_WARNING, "User %s sent command: <%s>", username, cmd)
+	nc.Manager.publish(EVENT_COMMAND, c.srv.Name, username, cmd)
+	err := run(cmd)
+	if err != nil {
+		c.serverLog.Printf(logger.LOG_LEVEL_ERROR, "User %s sent command <%s> but an error occurred: %v", username, cmd, err)
+	}
+	return err
+}
+
+// consoleBacklog returns the last n lines matching the filter after the
+// one with the given id, from the current lines of the console and then
+// from the archive. reset tells that the lines don't continue from the
+// given one, because it was not found or more than n lines are missing
+func (srv *McServer) consoleBacklog(current []LogLine, afterID string, filter LogQuery, n int) (lines []LogLine, reset bool) {
+	// The line can't be older than its session
+	var afterSession int64
+	if session, _, ok := strings.Cut(afterID, "-"); ok {
+		afterSession, _ = strconv.ParseInt(session, 10, 64)
+	}
+
+	found, passed := false, false
+	visit := func(line LogLine) bool {
+		if afterID != "" && line.ID == afterID {
+			found = true
+			return false
+		}
+		if line.Session < afterSession {
+			passed = true
+			return false
+		}
+
+		if !filter.match(line) {
+			return true
+		}
+		if len(lines) == n {
+			return false
+		}
+
+		lines = append(lines, line)
+		return true
+	}
+
+	inCurrent := make(map[string]bool, len(current))
+	for _, line := range current {
+		inCurrent[line.ID] = true
+	}
+
+	done := false
+	for i := len(current) - 1; i >= 0 && !done; i-- {
+		done = !visit(current[i])
+	}
+	if !done {
+		// The archive has also the current lines, unless they are
+		// still being written, and the previous sessions
+		srv.archive.scanBackward(func(line LogLine) bool {
+			return inCurrent[line.ID] || visit(line)
+		})
+	}
+
+	// Unknown line, e.g. deleted from the archive: the last n lines
+	if passed {
+		return srv.consoleBacklog(current, "", filter, n)
+	}
+
+	slices.Reverse(lines)
+	return lines, !found
+}
+
+// wsServerConsoleV2 serves the console protocol with JSON frames: the
+// client subscribes with the last log it has and gets only the missing
+// ones, then the new logs matching its filter
+func (nc *Nixcraft) wsServerConsoleV2(ctx *nix.Context, conn *websocket.Conn, c serverConsole, user mcUser) {
+	reqCtx := ctx.R().Context()
+
+	var sub consoleFrame
+	subCtx, cancel := context.WithTimeout(reqCtx, console_subscribe_timeout)
+	_, data, err := conn.Read(subCtx)
+	cancel()
+	if err == nil {
+		err = json.Unmarshal(data, &sub)
+	}
+	if err != nil || sub.Type != CONSOLE_SUBSCRIBE {
+		conn.Close(websocket.StatusPolicyViolation, "expected a subscribe frame")
+		return
+	}
+
+	backlog := console_history_lines
+	if sub.Backlog != nil {
+		backlog = min(max(*sub.Backlog, 0), max_console_history_lines)
+	}
+	filter := LogQuery{Levels: sub.Levels, Tags: sub.Tags}
+
+	sendBacklog := func(current []LogLine) error {
+		lines, reset := c.srv.consoleBacklog(current, sub.After, filter, backlog)
+
+		err := writeConsoleFrame(reqCtx, conn, consoleFrame{
+			Type: CONSOLE_SUBSCRIBED, Version: 2,
+			Session: c.session, Reset: reset,
+		})
+		for i := 0; err == nil && i < len(lines); i++ {
+			err = writeConsoleFrame(reqCtx, conn, consoleFrame{Type: CONSOLE_LOG, Log: &lines[i]})
+		}
+		return err
+	}
+
+	// Never started since the restart of Nixcraft, only the archive
+	if c.log == nil {
+		err = sendBacklog(nil)
+		if err != nil {
+			ctx.AddInteralMessage(fmt.Sprintf("websocket: write error: %v", err))
+			return
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+		return
+	}
+
+	prevLogsN, ch := c.log.ListenForLogs(log_listener_buffer)
+	defer ch.Unregister()
+
+	var current []LogLine
+	for _, log := range c.log.GetLogs(0, prevLogsN) {
+		if line, err := newLogLine(log, c.session); err == nil {
+			current = append(current, line)
+		}
+	}
+
+	err = sendBacklog(current)
+	if err != nil {
+		ctx.AddInteralMessage(fmt.Sprintf("websocket: write error: %v", err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// Buffered, the logs loop may have already ended with the session
+	exitC := make(chan struct{}, 1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			_, data, err := conn.Read(reqCtx)
+			if err != nil {
+				exitC <- struct{}{}
+				return
+			}
+
+			var frame consoleFrame
+			err = json.Unmarshal(data, &frame)
+
+			switch {
+			case err != nil:
+				err = writeConsoleFrame(reqCtx, conn, consoleFrame{Type: CONSOLE_ERROR, Error: "invalid frame: " + err.Error()})
+			case frame.Type == CONSOLE_COMMAND:
+				// The output is awaited without blocking the other frames
+				go func() {
+					result := consoleFrame{Type: CONSOLE_RESULT, ID: frame.ID}
+					err := nc.consoleCommand(c, user.Username, frame.Command, func(cmd string) (err error) {
+						result.Output, err = c.srv.Exec(reqCtx, cmd)
+						return
+					})
+					if err != nil {
+						result.Error = err.Error()
+					}
+					writeConsoleFrame(reqCtx, conn, result)
+				}()
+			default:
+				err = writeConsoleFrame(reqCtx, conn, consoleFrame{Type: CONSOLE_ERROR, Error: fmt.Sprintf("unexpected frame type %q", frame.Type)})
+			}
+			if err != nil {
+				exitC <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		logCh := ch.Ch()
+		for {
+			select {
+			case log, ok := <-logCh:
+				if !ok {
+					// The session ended, the client resumes from the next one
+					conn.Close(websocket.StatusNormalClosure, "")
+					return
+				}
+
+				line, err := newLogLine(log, c.session)
+				if err != nil || !filter.match(line) {
+					continue
+				}
+
+				err = writeConsoleFrame(reqCtx, conn, consoleFrame{Type: CONSOLE_LOG, Log: &line})
+				if err != nil {
+					conn.CloseNow()
+					ctx.AddInteralMessage(fmt.Sprintf("websocket: write error: %v", err))
+					return
+				}
+			case <-exitC:
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	conn.Close(websocket.StatusNormalClosure, "")
+}
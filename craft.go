@@ -1,17 +1,21 @@
 package craft
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
-	"github.com/nixpare/broadcaster"
 	"github.com/nixpare/logger/v3"
 	"github.com/nixpare/nix"
 	"github.com/nixpare/nix/middleware"
@@ -19,108 +23,259 @@ import (
 	"github.com/nixpare/server/v3/commands"
 )
 
+// mcUser is the content of the login cookie
 type mcUser struct {
+	Username   string `json:"username"`
+	SessionKey string `json:"session_key"`
+	user       *McUser
+	account    Account
+}
+
+type loginRequest struct {
 	Username string `json:"username"`
-	Passcode string `json:"passcode"`
-	user     *McUser
+	Password string `json:"password"`
 }
 
 var (
-	MC = &McServerManager{
-		Logger:  logger.DefaultLogger,
-		Servers: make(map[string]*McServer),
-		users:   make(map[string]*McUser),
+	// MC is the manager of the instance created by CraftInit
+	MC *McServerManager
+	// defaultNixcraft is the instance created by CraftInit
+	defaultNixcraft *Nixcraft
+)
+
+// Nixcraft is an instance of the web panel and of the Minecraft proxy,
+// with its own manager, cookie manager and HTTP handler. It is created
+// with New and serves the web panel as an http.Handler
+type Nixcraft struct {
+	Manager  *McServerManager `json:"-"`
+	Accounts *AccountStore    `json:"-"`
+
+	config         Config
+	logger         *logger.Logger
+	router         *server.Router
+	commandServers []*commands.CommandServer
+	runner         ProcessRunner
+	store          Store
+	cookieManager  *middleware.CookieManager
+	logins         loginLimiter
+	forwardToReact atomic.Bool
+	handler        http.Handler
+
+	// ctx is cancelled by Close, stopping the background goroutines.
+	// eventsDone is closed when the last events are saved
+	ctx        context.Context
+	cancel     context.CancelFunc
+	eventsDone chan struct{}
+}
+
+// Option configures a Nixcraft instance created with New
+type Option func(nc *Nixcraft)
 
-		UpdateBroadcaster: broadcaster.NewBroadcaster[[]byte](),
+// ConfigOption sets the configuration, which is validated by New
+func ConfigOption(cfg Config) Option {
+	return func(nc *Nixcraft) {
+		nc.config = cfg
 	}
+}
 
-	cookieManager *middleware.CookieManager
-)
+// LoggerOption sets the logger, by default the one of the router
+// or the logger.DefaultLogger
+func LoggerOption(l *logger.Logger) Option {
+	return func(nc *Nixcraft) {
+		nc.logger = l
+	}
+}
 
-func CraftInit(router *server.Router, commandServers []*commands.CommandServer) error {
-	var err error
-	cookieManager, err = middleware.NewCookieManager([]byte(cookie_hashkey), []byte(cookie_blockkey), nil)
+// RouterOption makes New start the proxy and the inactivity shutdown
+// task on the router and load the servers. Without a router only the
+// HTTP handler is usable
+func RouterOption(router *server.Router) Option {
+	return func(nc *Nixcraft) {
+		nc.router = router
+	}
+}
+
+// CommandServersOption registers the mc command on the command servers
+func CommandServersOption(commandServers ...*commands.CommandServer) Option {
+	return func(nc *Nixcraft) {
+		nc.commandServers = append(nc.commandServers, commandServers...)
+	}
+}
+
+// StoreOption sets where the state is kept across restarts,
+// by default a FileStore at the state_path of the config
+func StoreOption(store Store) Option {
+	return func(nc *Nixcraft) {
+		nc.store = store
+	}
+}
+
+// ProcessRunnerOption sets the runner of the server processes,
+// for example a FakeRunner
+func ProcessRunnerOption(runner ProcessRunner) Option {
+	return func(nc *Nixcraft) {
+		nc.runner = runner
+	}
+}
+
+// New creates a Nixcraft instance
+func New(opts ...Option) (*Nixcraft, error) {
+	nc := &Nixcraft{config: DefaultConfig()}
+	for _, opt := range opts {
+		opt(nc)
+	}
+
+	err := nc.config.Validate()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	MC.Logger = router.Logger.Clone(nil, true, "nixcraft-manager")
+	if nc.logger == nil {
+		nc.logger = logger.DefaultLogger
+		if nc.router != nil {
+			nc.logger = nc.router.Logger
+		}
+	}
+
+	nc.forwardToReact.Store(nc.config.ForwardToReact)
 
-	err = startProxy(router, MC)
+	nc.cookieManager, err = middleware.NewCookieManager([]byte(nc.config.CookieHashKey), []byte(nc.config.CookieBlockKey), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = router.TaskManager.NewTask("NixCraft", func() (startupF server.TaskFunc, execF server.TaskFunc, cleanupF server.TaskFunc) {
-		execF = func(t *server.Task) error {
-			MC.mutex.RLock()
-			defer MC.mutex.RUnlock()
-
-			now := time.Now()
-			for _, srv := range MC.Servers {
-				srv.m.RLock()
-				isRunning := srv.IsRunning()
-				players := len(srv.Players)
-				srv.m.RUnlock()
-
-				if !isRunning || players != 0 {
-					continue
-				}
+	nc.Accounts, err = LoadAccounts(nc.config.AccountsPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(nc.Accounts.List()) == 0 {
+		nc.logger.Printf(logger.LOG_LEVEL_WARNING, "No Nixcraft accounts yet: create one with \"mc user add <username> <password> admin\"")
+	}
 
-				if now.After(srv.lastDisconnect.Add(time.Minute * 10)) {
-					srv.serverLog.Printf(logger.LOG_LEVEL_INFO, "Shutting down server for inactivity")
-					
-					err := srv.Stop()
-					if err != nil {
-						t.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error shutting down Minecraft Server %s: %v", srv.Name, err)
-					}
-				}
-			}
+	nc.Manager = newMcServerManager(nc.config, nc.logger.Clone(nil, true, "nixcraft-manager"))
+	nc.Manager.accounts = nc.Accounts
+	if nc.store == nil {
+		nc.store = NewFileStore(nc.config.StatePath)
+	}
+	nc.Manager.store = nc.store
+	if nc.runner != nil {
+		nc.Manager.runner = nc.runner
+	}
+	nc.handler = nc.newHandler()
 
-			return nil
-		}
-		
-		cleanupF = func(_ *server.Task) error {
-			return MC.StopAll()
+	if nc.router != nil {
+		err = nc.Manager.loadServers()
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		return
-	}, server.TASK_TIMER_10_MINUTES)
+	// The state is restored after the servers are loaded, as the users
+	// and the routing refer to them, and before the proxy is started
+	state, err := nc.Manager.restoreState()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if value, ok := state.Settings[setting_forward_to_react]; ok {
+		nc.forwardToReact.Store(value == "true")
+	}
+
+	if nc.router != nil {
+		err = nc.start()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = MC.loadServers()
+	nc.ctx, nc.cancel = context.WithCancel(context.Background())
+	nc.eventsDone = make(chan struct{})
+	go nc.Manager.recordEvents(nc.ctx, nc.eventsDone)
+
+	for _, srv := range nc.commandServers {
+		srv.Commands["mc"] = nc.mcCommand()
+	}
+
+	return nc, nil
+}
+
+// CraftInit creates the instance used by MC and Handler
+//
+// Deprecated: use New
+func CraftInit(router *server.Router, commandServers []*commands.CommandServer, cfg Config) error {
+	nc, err := New(
+		ConfigOption(cfg),
+		RouterOption(router),
+		CommandServersOption(commandServers...),
+	)
 	if err != nil {
 		return err
 	}
 
-	for _, srv := range commandServers {
-		srv.Commands["mc"] = mcCommand(MC)
-	}
+	defaultNixcraft, MC = nc, nc.Manager
+	return nil
+}
+
+// Handler returns the HTTP handler of the instance created by CraftInit
+//
+// Deprecated: use New
+func Handler() http.Handler {
+	return defaultNixcraft
+}
+
+func (nc *Nixcraft) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nc.handler.ServeHTTP(w, r)
+}
 
+// Close stops the background goroutines of the instance, saving the
+// last events. The proxy, the task and the servers are stopped with
+// the router
+func (nc *Nixcraft) Close() error {
+	if nc.cancel != nil {
+		nc.cancel()
+		<-nc.eventsDone
+	}
 	return nil
 }
 
-func Nixcraft() http.Handler {
-	var err error
-	cookieManager, err = middleware.NewCookieManager([]byte(cookie_hashkey), []byte(cookie_blockkey), nil)
+// start starts the proxy and the inactivity shutdown task on the router
+func (nc *Nixcraft) start() error {
+	msm := nc.Manager
+
+	err := startProxy(nc.router, msm)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	// One task per instance, they can't share the public port
+	taskName := fmt.Sprintf("NixCraft:%d", nc.config.PublicPort)
+	err = nc.router.TaskManager.NewTask(taskName, func() (startupF server.TaskFunc, execF server.TaskFunc, cleanupF server.TaskFunc) {
+		execF = func(t *server.Task) error {
+			msm.stopIdleServers(time.Now(), t.Logger)
+			return nil
+		}
+		
+		cleanupF = func(_ *server.Task) error {
+			return msm.StopAll()
+		}
+
+		return
+	}, server.TASK_TIMER_10_MINUTES)
+	return err
+}
+
+func (nc *Nixcraft) newHandler() http.Handler {
 	mux := http.NewServeMux()
 	n := nix.New(
-		nix.CookieManagerOption(cookieManager),
+		nix.CookieManagerOption(nc.cookieManager),
 		nix.EnableLoggingOption(),
-		nix.LoggerOption(logger.DefaultLogger),
+		nix.LoggerOption(nc.logger),
 		nix.EnableErrorCaptureOption(),
 		nix.EnableRecoveryOption(),
 		nix.ConnectToMainOption(),
 	)
 
 	mux.HandleFunc("GET /", n.Handle(func(ctx *nix.Context) {
-		_, err := trustUser(ctx)
+		_, err := nc.trustUser(ctx)
 		reqPath := ctx.RequestPath()
 
 		switch reqPath {
@@ -136,9 +291,9 @@ func Nixcraft() http.Handler {
 			}
 		}
 
-		if forwardToReact {
+		if nc.forwardToReact.Load() {
 			ctx.DisableErrorCapture()
-			ctx.ReverseProxy(reactAddr)
+			ctx.ReverseProxy(nc.config.ReactAddr)
 			return
 		} else {
 			path := ctx.RequestPath()
@@ -146,45 +301,64 @@ func Nixcraft() http.Handler {
 				path += ".html"
 			}
 
-			ctx.ServeFile(basedir + "/dist" + path)
+			ctx.ServeFile(nc.config.BaseDir + "/dist" + path)
 		}
 	}))
 
 	// GET
-	mux.HandleFunc("GET /logout", n.Handle(getLogout))
-	mux.HandleFunc("GET /profile/{username}", n.Handle(getProfilePicture))
+	mux.HandleFunc("GET /logout", n.Handle(nc.getLogout))
+	mux.HandleFunc("GET /profile/{username}", n.Handle(nc.getProfilePicture))
+	// Not /{server}/logs, which would conflict with /profile/{username}
+	mux.HandleFunc("GET /logs/{server}", n.Handle(nc.getServerLogs))
 
 	// POST
 	mux.HandleFunc("POST /", n.Handle(func(ctx *nix.Context) {
 		ctx.Error(http.StatusBadRequest, "invalid POST request")
 	}))
-	mux.HandleFunc("POST /login", n.Handle(postLogin))
-	mux.HandleFunc("POST /{server}/start", n.Handle(postStart))
-	mux.HandleFunc("POST /{server}/stop", n.Handle(postStop))
-	mux.HandleFunc("POST /{server}/connect", n.Handle(postConnect))
-
-	mux.HandleFunc("POST /{server}/message", n.Handle(postMessage))
-	mux.HandleFunc("POST /{server}/broadcast", n.Handle(postBroadcast))
+	mux.HandleFunc("POST /login", n.Handle(nc.postLogin))
+	mux.HandleFunc("POST /{server}/start", n.Handle(nc.postStart))
+	mux.HandleFunc("POST /{server}/stop", n.Handle(nc.postStop))
+	mux.HandleFunc("POST /{server}/stop/cancel", n.Handle(nc.postCancelStop))
+	mux.HandleFunc("POST /{server}/restart", n.Handle(nc.postRestart))
+	mux.HandleFunc("POST /{server}/connect", n.Handle(nc.postConnect))
+
+	mux.HandleFunc("POST /{server}/message", n.Handle(nc.postMessage))
+	mux.HandleFunc("POST /{server}/broadcast", n.Handle(nc.postBroadcast))
+	mux.HandleFunc("POST /{server}/exec", n.Handle(nc.postExec))
+
+	// Accounts
+	mux.HandleFunc("GET /users", n.Handle(nc.getUsers))
+	mux.HandleFunc("POST /users", n.Handle(nc.postUser))
+	mux.HandleFunc("DELETE /users/{username}", n.Handle(nc.deleteUser))
+	mux.HandleFunc("POST /users/{username}/password", n.Handle(nc.postUserPassword))
+	mux.HandleFunc("POST /users/{username}/role", n.Handle(nc.postUserRole))
+
+	// Minecraft account link
+	mux.HandleFunc("POST /link", n.Handle(nc.postLink))
+	mux.HandleFunc("POST /link/code", n.Handle(nc.postLinkCode))
+	mux.HandleFunc("DELETE /link", n.Handle(nc.deleteLink))
 
 	// WebSocket
-	mux.HandleFunc("GET /ws/servers", n.Handle(wsServersInfo))
-	mux.HandleFunc("GET /ws/user", n.Handle(wsUserInfo))
-	mux.HandleFunc("GET /ws/{server}/console", n.Handle(wsServerConsole))
+	mux.HandleFunc("GET /ws/servers", n.Handle(nc.wsServersInfo))
+	mux.HandleFunc("GET /ws/user", n.Handle(nc.wsUserInfo))
+	mux.HandleFunc("GET /ws/{server}/console", n.Handle(nc.wsServerConsole))
+	mux.HandleFunc("GET /ws/{server}/events", n.Handle(nc.wsServerEvents))
 
 	return mux
 }
 
-func trustUser(ctx *nix.Context) (mcUser, error) {
+func (nc *Nixcraft) trustUser(ctx *nix.Context) (mcUser, error) {
 	var user mcUser
-	err := ctx.GetCookiePerm(nixcraft_cookie_name, &user)
+	err := ctx.GetCookiePerm(nc.config.CookieName, &user)
 	if err != nil {
-		ctx.DeleteCookie(nixcraft_cookie_name)
+		ctx.DeleteCookie(nc.config.CookieName)
 		return user, err
 	}
 
-	if user.Passcode != nixcraft_passcode {
-		ctx.DeleteCookie(nixcraft_cookie_name)
-		return user, errors.New("invalid passcode")
+	user.account, err = nc.Accounts.checkSession(user.Username, user.SessionKey)
+	if err != nil {
+		ctx.DeleteCookie(nc.config.CookieName)
+		return user, err
 	}
 
 	ip := server.SplitAddrPort(ctx.R().RemoteAddr)
@@ -192,16 +366,19 @@ func trustUser(ctx *nix.Context) (mcUser, error) {
 		ip = "127.0.0.1"
 	}
 
-	MC.mutex.Lock()
-	value, ok := MC.users[user.Username]
+	nc.Manager.mutex.Lock()
+	value, ok := nc.Manager.users[user.Username]
 	if !ok {
-		value = newMcUser(user.Username)
-		MC.users[user.Username] = value
+		value = newMcUser(nc.Manager, user.Username)
+		nc.Manager.users[user.Username] = value
 	}
-	MC.mutex.Unlock()
+	nc.Manager.mutex.Unlock()
 
 	user.user = value
-	value.IP = ip
+	if value.IP != ip || !ok {
+		value.IP = ip
+		nc.Manager.saveUser(value)
+	}
 
 	return user, nil
 }
@@ -210,14 +387,39 @@ func handleTrustUserResult(ctx *nix.Context, err error) {
 	ctx.Error(http.StatusUnauthorized, "Unauthorized request", err)
 }
 
+// trustPermission is trustUser checking also that the user has the
+// permission on the server, an empty server checks the global role
+func (nc *Nixcraft) trustPermission(ctx *nix.Context, srvName string, perm Permission) (mcUser, bool) {
+	user, err := nc.trustUser(ctx)
+	if err != nil {
+		handleTrustUserResult(ctx, err)
+		return user, false
+	}
+
+	if !user.account.Can(srvName, perm) {
+		handleForbidden(ctx, user, srvName, perm)
+		return user, false
+	}
+
+	return user, true
+}
+
+func handleForbidden(ctx *nix.Context, user mcUser, srvName string, perm Permission) {
+	if srvName == "" {
+		ctx.Error(http.StatusForbidden, "Forbidden", fmt.Sprintf("user %s has no %s permission", user.Username, perm))
+	} else {
+		ctx.Error(http.StatusForbidden, "Forbidden", fmt.Sprintf("user %s has no %s permission on server %s", user.Username, perm, srvName))
+	}
+}
+
 //
 // GET
 //
 
-func getLogout(ctx *nix.Context) {
+func (nc *Nixcraft) getLogout(ctx *nix.Context) {
 	ctx.DisableLogging()
 	ctx.DisableErrorCapture()
-	ctx.DeleteCookie(nixcraft_cookie_name)
+	ctx.DeleteCookie(nc.config.CookieName)
 }
 
 type ImageType string
@@ -230,7 +432,7 @@ func (i ImageType) ToURL() string {
 	return strings.ReplaceAll(string(i), "_", "/")
 }
 
-func getProfilePicture(ctx *nix.Context) {
+func (nc *Nixcraft) getProfilePicture(ctx *nix.Context) {
 	username := ctx.R().PathValue("username")
 	if username == "" {
 		ctx.Error(http.StatusBadRequest, "Invalid request", "missing username")
@@ -264,42 +466,93 @@ func getProfilePicture(ctx *nix.Context) {
 	}
 }
 
+func (nc *Nixcraft) getServerLogs(ctx *nix.Context) {
+	srvName := ctx.R().PathValue("server")
+
+	if _, ok := nc.trustPermission(ctx, srvName, PERM_VIEW); !ok {
+		return
+	}
+
+	nc.Manager.mutex.RLock()
+	srv, ok := nc.Manager.Servers[srvName]
+	nc.Manager.mutex.RUnlock()
+
+	if !ok {
+		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s not found", srvName))
+		return
+	}
+
+	query, err := parseLogQuery(ctx.R().URL.Query())
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := srv.archive.search(query)
+	if errors.Is(err, errInvalidCursor) {
+		ctx.Error(http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		ctx.Error(http.StatusInternalServerError, "Unable to search the logs", err)
+		return
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		ctx.Error(http.StatusInternalServerError, "Unable to search the logs", err)
+		return
+	}
+
+	ctx.Header().Set("Content-Type", "application/json")
+	ctx.Write(data)
+}
+
 //
 // POST
 //
 
-func postLogin(ctx *nix.Context) {
-	var user mcUser
-	err := ctx.ReadJSON(&user)
+func (nc *Nixcraft) postLogin(ctx *nix.Context) {
+	var req loginRequest
+	err := ctx.ReadJSON(&req)
 	if err != nil {
 		ctx.Error(http.StatusBadRequest, "Invalid post request", err)
 		return
 	}
 
-	if user.Passcode != nixcraft_passcode {
-		ctx.Error(http.StatusBadRequest, "Invalid credentials", "invalid passcode")
+	ip := server.SplitAddrPort(ctx.R().RemoteAddr)
+	if !nc.logins.allow(ip, time.Now()) {
+		ctx.Error(http.StatusTooManyRequests, "Too many login attempts, retry later", errTooManyLogins)
+		return
+	}
+
+	account, err := nc.Accounts.Authenticate(req.Username, req.Password)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, "Invalid credentials", err)
 		return
 	}
+	nc.logins.reset(ip)
 
-	err = ctx.SetCookiePerm(nixcraft_cookie_name, user, 3600*24*30)
+	err = nc.setLoginCookie(ctx, account)
 	if err != nil {
 		ctx.Error(http.StatusInternalServerError, "Unable to complete login", err)
 		return
 	}
 
+	nc.Manager.publish(EVENT_USER_LOGGED_IN, "", account.Username, "")
+
 	ctx.WriteHeader(http.StatusOK)
 }
 
-func postStart(ctx *nix.Context) {
+func (nc *Nixcraft) postStart(ctx *nix.Context) {
 	srvName := ctx.R().PathValue("server")
 
-	user, err := trustUser(ctx)
-	if err != nil {
-		handleTrustUserResult(ctx, err)
+	user, ok := nc.trustPermission(ctx, srvName, PERM_START)
+	if !ok {
 		return
 	}
 
-	if err := MC.Start(srvName); err != nil {
+	if err := nc.Manager.Start(srvName); err != nil {
 		ctx.Error(http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -308,16 +561,21 @@ func postStart(ctx *nix.Context) {
 	ctx.String("Done!")
 }
 
-func postStop(ctx *nix.Context) {
+func (nc *Nixcraft) postStop(ctx *nix.Context) {
 	srvName := ctx.R().PathValue("server")
 
-	user, err := trustUser(ctx)
+	user, ok := nc.trustPermission(ctx, srvName, PERM_STOP)
+	if !ok {
+		return
+	}
+
+	reason, err := ctx.BodyString()
 	if err != nil {
-		handleTrustUserResult(ctx, err)
+		ctx.Error(http.StatusBadRequest, "Invalid request", err)
 		return
 	}
 
-	if err := MC.Stop(srvName); err != nil {
+	if err := nc.Manager.Stop(srvName, reason); err != nil {
 		ctx.Error(http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -326,16 +584,49 @@ func postStop(ctx *nix.Context) {
 	ctx.String("Done!")
 }
 
-func postConnect(ctx *nix.Context) {
+func (nc *Nixcraft) postCancelStop(ctx *nix.Context) {
 	srvName := ctx.R().PathValue("server")
 
-	user, err := trustUser(ctx)
-	if err != nil {
-		handleTrustUserResult(ctx, err)
+	user, ok := nc.trustPermission(ctx, srvName, PERM_STOP)
+	if !ok {
 		return
 	}
 
-	err = user.user.ConnectToServer(srvName)
+	if err := nc.Manager.CancelStop(srvName); err != nil {
+		ctx.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx.AddInteralMessage(user.Username, "cancelled the server stop")
+	ctx.String("Done!")
+}
+
+func (nc *Nixcraft) postRestart(ctx *nix.Context) {
+	srvName := ctx.R().PathValue("server")
+
+	user, ok := nc.trustPermission(ctx, srvName, PERM_STOP)
+	if !ok {
+		return
+	}
+
+	if err := nc.Manager.Restart(srvName); err != nil {
+		ctx.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.AddInteralMessage(user.Username, "restarted the server")
+	ctx.String("Done!")
+}
+
+func (nc *Nixcraft) postConnect(ctx *nix.Context) {
+	srvName := ctx.R().PathValue("server")
+
+	user, ok := nc.trustPermission(ctx, srvName, PERM_CONNECT)
+	if !ok {
+		return
+	}
+
+	err := user.user.ConnectToServer(srvName)
 	if err != nil {
 		ctx.Error(http.StatusBadGateway, fmt.Sprintf("Server %s not found", srvName), err)
 		return
@@ -344,32 +635,31 @@ func postConnect(ctx *nix.Context) {
 	ctx.String("Done!")
 }
 
-func postGeneralMessage(ctx *nix.Context, buildCmd func(user *McUser, message string) string) (user *McUser, srv *McServer, message string, ok bool) {
+func (nc *Nixcraft) postGeneralMessage(ctx *nix.Context, perm Permission, buildCmd func(user *McUser, message string) string) (user *McUser, srv *McServer, message string, ok bool) {
 	srvName := ctx.R().PathValue("server")
 
-	u, err := trustUser(ctx)
-	if err != nil {
-		handleTrustUserResult(ctx, err)
+	u, trusted := nc.trustPermission(ctx, srvName, perm)
+	if !trusted {
 		return
 	}
 
 	user = u.user
 
-	MC.mutex.RLock()
+	nc.Manager.mutex.RLock()
 	var found bool
-	srv, found = MC.Servers[srvName]
-	MC.mutex.RUnlock()
+	srv, found = nc.Manager.Servers[srvName]
+	nc.Manager.mutex.RUnlock()
 	if !found {
 		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s not found", srvName))
 		return
 	}
 
-	if !srv.IsRunning() {
+	if !srv.AcceptsCommands() {
 		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s is not running", srvName))
 		return
 	}
 
-	message, err = ctx.BodyString()
+	message, err := ctx.BodyString()
 	if err != nil {
 		ctx.Error(http.StatusInternalServerError, err.Error())
 		return
@@ -386,14 +676,15 @@ func postGeneralMessage(ctx *nix.Context, buildCmd func(user *McUser, message st
 	return
 }
 
-func postMessage(ctx *nix.Context) {
-	user, srv, message, ok := postGeneralMessage(ctx, func(user *McUser, message string) string {
+func (nc *Nixcraft) postMessage(ctx *nix.Context) {
+	user, srv, message, ok := nc.postGeneralMessage(ctx, PERM_CHAT, func(user *McUser, message string) string {
 		return fmt.Sprintf(`/tellraw @p "<%s (Web)> %s"`, user.Name, message)
 	})
 	if !ok {
 		return
 	}
 
+	nc.Manager.publish(EVENT_CHAT, srv.Name, user.Name, message)
 	srv.chatLog.AddLog(
 		logger.LOG_LEVEL_INFO,
 		fmt.Sprintf("User %s sent message: <%s>", user.Name, message),
@@ -402,8 +693,8 @@ func postMessage(ctx *nix.Context) {
 	)
 }
 
-func postBroadcast(ctx *nix.Context) {
-	user, srv, message, ok := postGeneralMessage(ctx, func(user *McUser, message string) string {
+func (nc *Nixcraft) postBroadcast(ctx *nix.Context) {
+	user, srv, message, ok := nc.postGeneralMessage(ctx, PERM_BROADCAST, func(user *McUser, message string) string {
 		return fmt.Sprintf(`/title @a title {"text": "<%s (Web)> %s"}`, user.Name, message)
 	})
 	if !ok {
@@ -418,14 +709,382 @@ func postBroadcast(ctx *nix.Context) {
 	)
 }
 
+type execRequest struct {
+	Command string `json:"command"`
+	// TimeoutMs limits the wait for the output, 10 seconds by default
+	TimeoutMs int `json:"timeout_ms"`
+}
+
+type execResponse struct {
+	Command string    `json:"command"`
+	Output  []LogLine `json:"output"`
+	// TimedOut tells that the server was still writing when the timeout
+	// expired, so the output may be incomplete
+	TimedOut bool `json:"timed_out"`
+}
+
+// postExec runs a console command and returns its output
+func (nc *Nixcraft) postExec(ctx *nix.Context) {
+	srvName := ctx.R().PathValue("server")
+
+	user, ok := nc.trustPermission(ctx, srvName, PERM_CONSOLE)
+	if !ok {
+		return
+	}
+
+	nc.Manager.mutex.RLock()
+	srv, found := nc.Manager.Servers[srvName]
+	nc.Manager.mutex.RUnlock()
+	if !found {
+		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s not found", srvName))
+		return
+	}
+
+	if !srv.AcceptsCommands() {
+		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s is not running", srvName))
+		return
+	}
+
+	var req execRequest
+	err := ctx.ReadJSON(&req)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, "Invalid post request", err)
+		return
+	}
+	if strings.TrimSpace(req.Command) == "" {
+		ctx.Error(http.StatusBadRequest, "Missing command")
+		return
+	}
+
+	timeout := exec_timeout
+	if req.TimeoutMs > 0 {
+		timeout = min(time.Duration(req.TimeoutMs)*time.Millisecond, max_exec_timeout)
+	}
+	execCtx, cancel := context.WithTimeout(ctx.R().Context(), timeout)
+	defer cancel()
+
+	srv.m.RLock()
+	userLog := srv.userLog
+	srv.m.RUnlock()
+
+	if userLog != nil {
+		userLog.Printf(logger.LOG_LEVEL_WARNING, "User %s executed command: <%s>", user.Username, req.Command)
+	}
+	nc.Manager.publish(EVENT_COMMAND, srv.Name, user.Username, req.Command)
+
+	output, err := srv.Exec(execCtx, req.Command)
+	resp := execResponse{Command: req.Command, Output: output}
+	if errors.Is(err, context.DeadlineExceeded) {
+		resp.TimedOut = true
+	} else if err != nil {
+		ctx.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if resp.Output == nil {
+		resp.Output = []LogLine{}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		ctx.Error(http.StatusInternalServerError, "Unable to send the output", err)
+		return
+	}
+
+	ctx.Header().Set("Content-Type", "application/json")
+	ctx.Write(data)
+}
+
+//
+// Accounts
+//
+
+type accountInfo struct {
+	Username    string          `json:"username"`
+	Role        Role            `json:"role"`
+	ServerRoles map[string]Role `json:"server_roles"`
+	Created     time.Time       `json:"created"`
+}
+
+type newAccountRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Role defaults to player
+	Role Role `json:"role"`
+}
+
+type roleRequest struct {
+	// Server is empty for the global role
+	Server string `json:"server"`
+	// Role is empty to remove the role of the server
+	Role Role `json:"role"`
+}
+
+func (nc *Nixcraft) setLoginCookie(ctx *nix.Context, account Account) error {
+	return ctx.SetCookiePerm(nc.config.CookieName, mcUser{
+		Username:   account.Username,
+		SessionKey: account.SessionKey,
+	}, 3600*24*30)
+}
+
+func (nc *Nixcraft) getUsers(ctx *nix.Context) {
+	if _, ok := nc.trustPermission(ctx, "", PERM_MANAGE_USERS); !ok {
+		return
+	}
+
+	accounts := nc.Accounts.List()
+	infos := make([]accountInfo, 0, len(accounts))
+	for _, account := range accounts {
+		infos = append(infos, accountInfo{
+			Username:    account.Username,
+			Role:        account.Role,
+			ServerRoles: account.ServerRoles,
+			Created:     account.Created,
+		})
+	}
+
+	data, err := json.Marshal(infos)
+	if err != nil {
+		ctx.Error(http.StatusInternalServerError, "Unable to list the users", err)
+		return
+	}
+
+	ctx.Header().Set("Content-Type", "application/json")
+	ctx.Write(data)
+}
+
+func (nc *Nixcraft) postUser(ctx *nix.Context) {
+	user, ok := nc.trustPermission(ctx, "", PERM_MANAGE_USERS)
+	if !ok {
+		return
+	}
+
+	var req newAccountRequest
+	err := ctx.ReadJSON(&req)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, "Invalid post request", err)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = ROLE_PLAYER
+	}
+
+	err = nc.Accounts.Add(req.Username, req.Password, req.Role)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	ctx.AddInteralMessage(user.Username, "created the account", req.Username)
+	ctx.String("Done!")
+}
+
+func (nc *Nixcraft) deleteUser(ctx *nix.Context) {
+	user, ok := nc.trustPermission(ctx, "", PERM_MANAGE_USERS)
+	if !ok {
+		return
+	}
+
+	username := ctx.R().PathValue("username")
+	if strings.EqualFold(username, user.Username) {
+		ctx.Error(http.StatusBadRequest, "You can't delete your own account")
+		return
+	}
+
+	err := nc.Accounts.Delete(username)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	nc.Manager.forgetUser(username)
+
+	ctx.AddInteralMessage(user.Username, "deleted the account", username)
+	ctx.String("Done!")
+}
+
+// postUserPassword changes the password of an account, the users
+// can change their own password, the admins any password
+func (nc *Nixcraft) postUserPassword(ctx *nix.Context) {
+	user, err := nc.trustUser(ctx)
+	if err != nil {
+		handleTrustUserResult(ctx, err)
+		return
+	}
+
+	username := ctx.R().PathValue("username")
+	self := strings.EqualFold(username, user.Username)
+	if !self && !user.account.Can("", PERM_MANAGE_USERS) {
+		handleForbidden(ctx, user, "", PERM_MANAGE_USERS)
+		return
+	}
+
+	var req loginRequest
+	err = ctx.ReadJSON(&req)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, "Invalid post request", err)
+		return
+	}
+
+	err = nc.Accounts.SetPassword(username, req.Password)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	// The old cookie is no longer valid
+	if self {
+		account, _ := nc.Accounts.Get(username)
+		nc.setLoginCookie(ctx, account)
+	}
+
+	ctx.AddInteralMessage(user.Username, "changed the password of", username)
+	ctx.String("Done!")
+}
+
+// postUserRole assigns the global role of an account or its role on a server
+func (nc *Nixcraft) postUserRole(ctx *nix.Context) {
+	user, ok := nc.trustPermission(ctx, "", PERM_MANAGE_USERS)
+	if !ok {
+		return
+	}
+
+	username := ctx.R().PathValue("username")
+
+	var req roleRequest
+	err := ctx.ReadJSON(&req)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, "Invalid post request", err)
+		return
+	}
+
+	// An admin can't lock themself out of the user management
+	if strings.EqualFold(username, user.Username) && req.Server == "" && req.Role != ROLE_ADMIN {
+		ctx.Error(http.StatusBadRequest, "You can't remove your own admin role")
+		return
+	}
+
+	err = nc.Accounts.SetRole(username, req.Server, req.Role)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	// The permissions are part of the servers state
+	nc.Manager.SignalStateUpdate()
+
+	if req.Server == "" {
+		ctx.AddInteralMessage(user.Username, "set the global role of", username, "to", req.Role)
+	} else {
+		ctx.AddInteralMessage(user.Username, "set the role of", username, "on server", req.Server, "to", req.Role)
+	}
+	ctx.String("Done!")
+}
+
+//
+// Minecraft account link
+//
+
+type linkRequest struct {
+	Code string `json:"code"`
+}
+
+// postLinkCode returns a code that the user types in the game chat
+// to link the Minecraft account they are playing with
+func (nc *Nixcraft) postLinkCode(ctx *nix.Context) {
+	user, err := nc.trustUser(ctx)
+	if err != nil {
+		handleTrustUserResult(ctx, err)
+		return
+	}
+
+	data, err := json.Marshal(nc.Manager.webLinkCode(user.account.Username))
+	if err != nil {
+		ctx.Error(http.StatusInternalServerError, "Unable to create the link code", err)
+		return
+	}
+
+	ctx.Header().Set("Content-Type", "application/json")
+	ctx.Write(data)
+}
+
+// postLink links the Minecraft account which was shown the code
+// when rejected by the proxy, once it joins a server
+func (nc *Nixcraft) postLink(ctx *nix.Context) {
+	user, err := nc.trustUser(ctx)
+	if err != nil {
+		handleTrustUserResult(ctx, err)
+		return
+	}
+
+	var req linkRequest
+	err = ctx.ReadJSON(&req)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, "Invalid post request", err)
+		return
+	}
+
+	code, err := nc.Manager.redeemPlayerLinkCode(user.account.Username, req.Code)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	ctx.AddInteralMessage(user.Username, "redeemed the link code of the Minecraft account", code.player, code.uuid)
+	ctx.String("Join a server with the Minecraft account to complete the link")
+}
+
+func (nc *Nixcraft) deleteLink(ctx *nix.Context) {
+	user, err := nc.trustUser(ctx)
+	if err != nil {
+		handleTrustUserResult(ctx, err)
+		return
+	}
+
+	err = nc.Accounts.Unlink(user.account.Username)
+	if err != nil {
+		ctx.Error(http.StatusInternalServerError, "Unable to unlink the account", err)
+		return
+	}
+	user.user.SignalStateUpdate()
+
+	ctx.AddInteralMessage(user.Username, "unlinked the Minecraft account")
+	ctx.String("Done!")
+}
+
 //
 // WebSocket
 //
 
-func wsServersInfo(ctx *nix.Context) {
+// serversStateFor adds to the servers state the effective permissions
+// of the user, read again each time as they can change at any moment
+func (nc *Nixcraft) serversStateFor(username string, state []byte) []byte {
+	var info map[string]json.RawMessage
+	err := json.Unmarshal(state, &info)
+	if err != nil {
+		return state
+	}
+
+	var servers map[string]json.RawMessage
+	json.Unmarshal(info["servers"], &servers)
+
+	account, _ := nc.Accounts.Get(username)
+	info["permissions"], err = json.Marshal(account.permissionsInfo(slices.Collect(maps.Keys(servers))))
+	if err != nil {
+		return state
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return state
+	}
+	return data
+}
+
+func (nc *Nixcraft) wsServersInfo(ctx *nix.Context) {
 	ctx.DisableErrorCapture()
 
-	_, err := trustUser(ctx)
+	user, err := nc.trustUser(ctx)
 	if err != nil {
 		handleTrustUserResult(ctx, err)
 		return
@@ -438,33 +1097,35 @@ func wsServersInfo(ctx *nix.Context) {
 	conn, err := websocket.Accept(ctx, ctx.R(), nil)
 	if err != nil {
 		ctx.Error(http.StatusBadRequest, "Invalid Request", err)
+		return
 	}
 	defer conn.CloseNow()
 
-	err = conn.Write(ctx.R().Context(), websocket.MessageText, MC.generateState())
+	err = conn.Write(ctx.R().Context(), websocket.MessageText, nc.serversStateFor(user.Username, nc.Manager.generateState()))
 	if err != nil {
 		ctx.AddInteralMessage(err)
 		return
 	}
 
-	updates := MC.UpdateBroadcaster.Register(10)
+	updates := nc.Manager.UpdateBroadcaster.Register(10)
 	defer updates.Unregister()
 
 	go func() {
 		for data := range updates.Ch() {
-			conn.Write(ctx.R().Context(), websocket.MessageText, data)
+			conn.Write(ctx.R().Context(), websocket.MessageText, nc.serversStateFor(user.Username, data))
 		}
 	}()
 
 	conn.Read(ctx.R().Context())
 }
 
-func wsUserInfo(ctx *nix.Context) {
+func (nc *Nixcraft) wsUserInfo(ctx *nix.Context) {
 	ctx.DisableErrorCapture()
 
-	user, err := trustUser(ctx)
+	user, err := nc.trustUser(ctx)
 	if err != nil {
 		handleTrustUserResult(ctx, err)
+		return
 	}
 
 	if !ctx.IsWebSocketRequest() {
@@ -474,6 +1135,7 @@ func wsUserInfo(ctx *nix.Context) {
 	conn, err := websocket.Accept(ctx, ctx.R(), nil)
 	if err != nil {
 		ctx.Error(http.StatusBadRequest, "Invalid Request", err)
+		return
 	}
 	defer conn.CloseNow()
 
@@ -505,32 +1167,43 @@ func wsUserInfo(ctx *nix.Context) {
 	conn.Read(ctx.R().Context())
 }
 
-func wsServerConsole(ctx *nix.Context) {
+func (nc *Nixcraft) wsServerConsole(ctx *nix.Context) {
 	ctx.DisableErrorCapture()
 
-	user, err := trustUser(ctx)
-	if err != nil {
-		handleTrustUserResult(ctx, err)
-	}
-
 	srvName := ctx.R().PathValue("server")
 
-	MC.mutex.RLock()
-	srv, ok := MC.Servers[srvName]
-	MC.mutex.RUnlock()
+	user, trusted := nc.trustPermission(ctx, srvName, PERM_VIEW)
+	if !trusted {
+		return
+	}
+
+	nc.Manager.mutex.RLock()
+	srv, ok := nc.Manager.Servers[srvName]
+	nc.Manager.mutex.RUnlock()
 
 	if !ok {
 		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s not found", srvName))
 		return
 	}
 
+	historyN := console_history_lines
+	if value := ctx.R().URL.Query().Get("history"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			ctx.Error(http.StatusBadRequest, fmt.Sprintf("Invalid history length %q", value))
+			return
+		}
+		historyN = min(n, max_console_history_lines)
+	}
+
 	srv.m.RLock()
 	log := srv.log
 	serverLog := srv.serverLog
 	userLog := srv.userLog
+	session := srv.session
 	srv.m.RUnlock()
 
-	if log == nil {
+	if log == nil && srv.archive.empty() {
 		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s was never started", srvName))
 		return
 	}
@@ -542,12 +1215,44 @@ func wsServerConsole(ctx *nix.Context) {
 		return
 	}
 
-	conn, err := websocket.Accept(ctx, ctx.R(), nil)
+	conn, err := websocket.Accept(ctx, ctx.R(), &websocket.AcceptOptions{
+		Subprotocols: []string{console_protocol_v2},
+	})
 	if err != nil {
 		ctx.Error(http.StatusBadRequest, "Invalid Request", err)
+		return
 	}
 	defer conn.CloseNow()
 
+	c := serverConsole{srv: srv, log: log, serverLog: serverLog, userLog: userLog, session: session}
+	if conn.Subprotocol() == console_protocol_v2 {
+		nc.wsServerConsoleV2(ctx, conn, c, user)
+		return
+	}
+
+	// The previous sessions, also the ones before a restart of Nixcraft
+	var history []LogLine
+	if historyN > 0 {
+		history, err = srv.archive.history(session, historyN)
+		if err != nil {
+			ctx.AddInteralMessage(fmt.Sprintf("console history: %v", err))
+		}
+	}
+
+	for _, line := range history {
+		data, _ := json.Marshal(line)
+		err := conn.Write(ctx.R().Context(), websocket.MessageText, data)
+		if err != nil {
+			ctx.AddInteralMessage(fmt.Sprintf("websocket: write error: %v", err))
+			return
+		}
+	}
+
+	if log == nil {
+		conn.Close(websocket.StatusNormalClosure, "")
+		return
+	}
+
 	prevLogsN, ch := log.ListenForLogs(20)
 	defer ch.Unregister()
 	prevLogs := log.GetLogs(0, prevLogsN)
@@ -576,13 +1281,7 @@ func wsServerConsole(ctx *nix.Context) {
 				return
 			}
 
-			cmd := string(b)
-
-			userLog.Printf(logger.LOG_LEVEL_WARNING, "User %s sent command: <%s>", user.Username, cmd)
-			err = srv.SendInput(cmd)
-			if err != nil {
-				serverLog.Printf(logger.LOG_LEVEL_ERROR, "User %s sent command <%s> but an error occurred: %v", user.user.Name, cmd, err)
-			}
+			nc.consoleCommand(c, user.Username, string(b), srv.SendInput)
 		}
 	}()
 
@@ -613,3 +1312,53 @@ func wsServerConsole(ctx *nix.Context) {
 	wg.Wait()
 	conn.Close(websocket.StatusNormalClosure, "")
 }
+
+func (nc *Nixcraft) wsServerEvents(ctx *nix.Context) {
+	ctx.DisableErrorCapture()
+
+	srvName := ctx.R().PathValue("server")
+
+	if _, ok := nc.trustPermission(ctx, srvName, PERM_VIEW); !ok {
+		return
+	}
+
+	nc.Manager.mutex.RLock()
+	srv, ok := nc.Manager.Servers[srvName]
+	nc.Manager.mutex.RUnlock()
+
+	if !ok {
+		ctx.Error(http.StatusBadRequest, fmt.Sprintf("Server %s not found", srvName))
+		return
+	}
+
+	if !ctx.IsWebSocketRequest() {
+		return
+	}
+
+	conn, err := websocket.Accept(ctx, ctx.R(), nil)
+	if err != nil {
+		ctx.Error(http.StatusBadRequest, "Invalid Request", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	events := srv.Events.Register(20)
+	defer events.Unregister()
+
+	go func() {
+		for ev := range events.Ch() {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+
+			err = conn.Write(ctx.R().Context(), websocket.MessageText, data)
+			if err != nil {
+				conn.CloseNow()
+				return
+			}
+		}
+	}()
+
+	conn.Read(ctx.R().Context())
+}
@@ -0,0 +1,257 @@
+package craft
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_DEATH       EventType = "death"
+	EVENT_ADVANCEMENT EventType = "advancement"
+	EVENT_LAG         EventType = "lag"
+	EVENT_SAVING      EventType = "saving"
+	EVENT_SAVED       EventType = "saved"
+	EVENT_DONE        EventType = "done"
+)
+
+// GameEvent is something that happened in the game, parsed from
+// a line of the server stdout
+type GameEvent struct {
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+
+	Player string `json:"player,omitempty"`
+	UUID   string `json:"uuid,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	// Message is the chat message, the death message, the advancement
+	// name or the command, depending on the event type
+	Message string `json:"message,omitempty"`
+
+	// LagMillis and LagTicks are set for EVENT_LAG
+	LagMillis int `json:"lag_millis,omitempty"`
+	LagTicks  int `json:"lag_ticks,omitempty"`
+	// BootSeconds is set for EVENT_DONE
+	BootSeconds float64 `json:"boot_seconds,omitempty"`
+}
+
+var (
+	// logPrefixRegexp matches the prefix of the vanilla and Forge
+	// ("[12:00:00] [Server thread/INFO]: " and "... [minecraft/DedicatedServer]: "),
+	// Paper ("[12:00:00 INFO]: ") and Fabric ("[12:00:00] [Server thread/INFO] (Minecraft) ")
+	// log formats
+	logPrefixRegexp = regexp.MustCompile(`^\[[^\]]*\](?: \[[^\]]*\])?(?: \[[^\]]*\]| \([^)]*\))?:? `)
+
+	uuidLineRegexp     = regexp.MustCompile(`^UUID of player (\w{1,16}) is ([0-9a-fA-F-]{36})$`)
+	loginLineRegexp    = regexp.MustCompile(`^(\w{1,16})\[/([^\]]+)\] logged in with entity id`)
+	joinedLineRegexp   = regexp.MustCompile(`^(\w{1,16}) joined the game$`)
+	leftLineRegexp     = regexp.MustCompile(`^(\w{1,16}) left the game$`)
+	chatLineRegexp     = regexp.MustCompile(`^(?:\[Not Secure\] )?<(\w{1,16})> (.*)$`)
+	advancementRegexp  = regexp.MustCompile(`^(\w{1,16}) has (?:made the advancement|completed the challenge|reached the goal) \[(.+)\]$`)
+	commandLineRegexp  = regexp.MustCompile(`^(\w{1,16}) issued server command: (.+)$`)
+	vanillaCommandLine = regexp.MustCompile(`^\[(\w{1,16}): (.+)\]$`)
+	lagLineRegexp      = regexp.MustCompile(`^Can't keep up! Is the server overloaded\? Running (\d+)ms or (\d+) ticks behind`)
+	doneEventRegexp    = regexp.MustCompile(`^Done \((\d+[.,]\d+)s\)! For help`)
+	deathLineRegexp    = regexp.MustCompile(`^(\w{1,16}) (.+)$`)
+)
+
+// deathPhrases are the beginnings of the vanilla death messages, right after
+// the player name. They are only checked for online players
+var deathPhrases = []string{
+	"was slain by", "was shot by", "was pummeled by", "was fireballed by",
+	"was killed", "was blown up by", "blew up", "was squashed by",
+	"was squished", "was pricked to death", "was poked to death",
+	"was stung to death", "was impaled", "was skewered", "was obliterated",
+	"was struck by lightning", "was burned to a crisp", "was frozen to death",
+	"was roasted in dragon's breath", "was doomed to fall", "was speared by",
+	"walked into", "went up in flames", "went off with a bang", "burned to death",
+	"tried to swim in lava", "discovered the floor was lava", "drowned",
+	"died", "starved to death", "suffocated in a wall", "fell ", "hit the ground too hard",
+	"experienced kinetic energy", "withered away", "froze to death",
+	"left the confines of this world", "didn't want to live in the same world as",
+}
+
+// parseGameEvent parses a line of the server stdout, ok is false if the
+// line does not describe a game event
+func (srv *McServer) parseGameEvent(line string) (ev GameEvent, ok bool) {
+	msg := logPrefixRegexp.ReplaceAllString(strings.TrimSpace(line), "")
+
+	ev = GameEvent{Time: time.Now(), Server: srv.Name}
+
+	if m := uuidLineRegexp.FindStringSubmatch(msg); m != nil {
+		srv.pendingPlayerInfo(m[1]).UUID = m[2]
+		return ev, false
+	}
+
+	if m := loginLineRegexp.FindStringSubmatch(msg); m != nil {
+		ip := m[2]
+		if i := strings.LastIndex(ip, ":"); i != -1 {
+			ip = ip[:i]
+		}
+		srv.pendingPlayerInfo(m[1]).IP = ip
+		return ev, false
+	}
+
+	switch {
+	case joinedLineRegexp.MatchString(msg):
+		ev.Type, ev.Player = EVENT_PLAYER_JOINED, joinedLineRegexp.FindStringSubmatch(msg)[1]
+
+		srv.eventsM.Lock()
+		info := srv.pendingPlayers[ev.Player]
+		delete(srv.pendingPlayers, ev.Player)
+		srv.eventsM.Unlock()
+
+		if info != nil {
+			ev.UUID, ev.IP = info.UUID, info.IP
+		}
+	case leftLineRegexp.MatchString(msg):
+		ev.Type, ev.Player = EVENT_PLAYER_LEFT, leftLineRegexp.FindStringSubmatch(msg)[1]
+	case chatLineRegexp.MatchString(msg):
+		m := chatLineRegexp.FindStringSubmatch(msg)
+		ev.Type, ev.Player, ev.Message = EVENT_CHAT, m[1], m[2]
+	case advancementRegexp.MatchString(msg):
+		m := advancementRegexp.FindStringSubmatch(msg)
+		ev.Type, ev.Player, ev.Message = EVENT_ADVANCEMENT, m[1], m[2]
+	case commandLineRegexp.MatchString(msg):
+		m := commandLineRegexp.FindStringSubmatch(msg)
+		ev.Type, ev.Player, ev.Message = EVENT_COMMAND, m[1], m[2]
+	case vanillaCommandLine.MatchString(msg):
+		m := vanillaCommandLine.FindStringSubmatch(msg)
+		ev.Type, ev.Player, ev.Message = EVENT_COMMAND, m[1], m[2]
+	case lagLineRegexp.MatchString(msg):
+		m := lagLineRegexp.FindStringSubmatch(msg)
+		ev.Type = EVENT_LAG
+		ev.LagMillis, _ = strconv.Atoi(m[1])
+		ev.LagTicks, _ = strconv.Atoi(m[2])
+	case strings.HasPrefix(msg, "Saving the game"):
+		ev.Type = EVENT_SAVING
+	case strings.HasPrefix(msg, "Saved the game"):
+		ev.Type = EVENT_SAVED
+	case doneEventRegexp.MatchString(msg):
+		m := doneEventRegexp.FindStringSubmatch(msg)
+		ev.Type = EVENT_DONE
+		ev.BootSeconds, _ = strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+	default:
+		m := deathLineRegexp.FindStringSubmatch(msg)
+		if m == nil || !srv.isOnline(m[1]) || !isDeathMessage(m[2]) {
+			return ev, false
+		}
+		ev.Type, ev.Player, ev.Message = EVENT_DEATH, m[1], msg
+	}
+
+	return ev, true
+}
+
+func isDeathMessage(s string) bool {
+	for _, phrase := range deathPhrases {
+		if strings.HasPrefix(s, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+type playerInfo struct {
+	UUID string
+	IP   string
+}
+
+// pendingPlayerInfo returns the information collected for a player
+// during the login, before the join message
+func (srv *McServer) pendingPlayerInfo(name string) *playerInfo {
+	srv.eventsM.Lock()
+	defer srv.eventsM.Unlock()
+
+	info, ok := srv.pendingPlayers[name]
+	if !ok {
+		info = new(playerInfo)
+		srv.pendingPlayers[name] = info
+	}
+	return info
+}
+
+// isOnline tells whether the player is online, name is either the
+// Minecraft name or the name of the web user
+func (srv *McServer) isOnline(name string) bool {
+	srv.m.RLock()
+	defer srv.m.RUnlock()
+
+	if _, ok := srv.Players[name]; ok {
+		return true
+	}
+	for _, user := range srv.Players {
+		if user.player == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGameEventLine parses a line of the server stdout and, if it is a
+// game event, updates the online players and broadcasts it
+func (srv *McServer) handleGameEventLine(line string) {
+	ev, ok := srv.parseGameEvent(line)
+	if !ok {
+		return
+	}
+
+	switch ev.Type {
+	case EVENT_CHAT, EVENT_COMMAND:
+		// The link codes are not shown in the web chat
+		if srv.handleLinkCode(ev) {
+			return
+		}
+		srv.msm.publish(ev.Type, srv.Name, ev.Player, ev.Message)
+	case EVENT_PLAYER_JOINED:
+		srv.eventsM.Lock()
+		srv.playerUUIDs[ev.Player] = ev.UUID
+		srv.eventsM.Unlock()
+		srv.confirmPlayer(ev.Player, ev.UUID)
+
+		if !srv.isOnline(ev.Player) {
+			srv.playerConnected(srv.msm.userForPlayer(ev.Player, ev.UUID))
+		}
+	case EVENT_PLAYER_LEFT:
+		srv.eventsM.Lock()
+		uuid := srv.playerUUIDs[ev.Player]
+		delete(srv.playerUUIDs, ev.Player)
+		srv.eventsM.Unlock()
+
+		if srv.isOnline(ev.Player) {
+			srv.playerDisconnected(srv.msm.userForPlayer(ev.Player, uuid))
+		}
+	}
+
+	srv.Events.Send(ev)
+}
+
+// userForPlayer returns the registered user who joined as the player, the
+// one linked to the player UUID or the one with the same name. For players
+// not known to the proxy, a new unregistered one is returned
+func (msm *McServerManager) userForPlayer(name string, uuid string) *McUser {
+	var linked string
+	if account, ok := msm.accounts.ByMinecraftUUID(uuid); ok {
+		linked = account.Username
+	}
+
+	msm.mutex.RLock()
+	defer msm.mutex.RUnlock()
+
+	for _, user := range msm.users {
+		if user.player == name {
+			return user
+		}
+	}
+
+	if user, ok := msm.users[linked]; ok && linked != "" {
+		return user
+	}
+
+	user, ok := msm.users[name]
+	if !ok {
+		user = newMcUser(msm, name)
+	}
+	return user
+}
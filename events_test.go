@@ -0,0 +1,247 @@
+package craft
+
+import (
+	"testing"
+)
+
+func TestParseGameEvent(t *testing.T) {
+	const uuid = "8667ba71-b85a-4004-af54-457a9734eed7"
+
+	tests := []struct {
+		name string
+		// before are parsed first, for the information collected
+		// during the login
+		before []string
+		line   string
+		want   GameEvent
+		ok     bool
+	}{
+		// Vanilla
+		{
+			name: "vanilla join",
+			before: []string{
+				"[12:00:00] [User Authenticator #1/INFO]: UUID of player Steve is " + uuid,
+				"[12:00:00] [Server thread/INFO]: Steve[/127.0.0.1:54321] logged in with entity id 123 at (0.5, 64.0, 0.5)",
+			},
+			line: "[12:00:00] [Server thread/INFO]: Steve joined the game",
+			want: GameEvent{Type: EVENT_PLAYER_JOINED, Player: "Steve", UUID: uuid, IP: "127.0.0.1"},
+			ok:   true,
+		},
+		{
+			name: "vanilla left",
+			line: "[12:00:00] [Server thread/INFO]: Steve left the game",
+			want: GameEvent{Type: EVENT_PLAYER_LEFT, Player: "Steve"},
+			ok:   true,
+		},
+		{
+			name: "vanilla chat",
+			line: "[12:00:01] [Server thread/INFO]: <Steve> hello there",
+			want: GameEvent{Type: EVENT_CHAT, Player: "Steve", Message: "hello there"},
+			ok:   true,
+		},
+		{
+			name: "vanilla unsigned chat",
+			line: "[12:00:01] [Server thread/INFO]: [Not Secure] <Steve> hello",
+			want: GameEvent{Type: EVENT_CHAT, Player: "Steve", Message: "hello"},
+			ok:   true,
+		},
+		{
+			name: "vanilla death",
+			line: "[12:00:02] [Server thread/INFO]: Steve was slain by Zombie",
+			want: GameEvent{Type: EVENT_DEATH, Player: "Steve", Message: "Steve was slain by Zombie"},
+			ok:   true,
+		},
+		{
+			name: "vanilla death of an offline player",
+			line: "[12:00:02] [Server thread/INFO]: Alex was slain by Zombie",
+		},
+		{
+			name: "vanilla advancement",
+			line: "[12:00:03] [Server thread/INFO]: Steve has made the advancement [Stone Age]",
+			want: GameEvent{Type: EVENT_ADVANCEMENT, Player: "Steve", Message: "Stone Age"},
+			ok:   true,
+		},
+		{
+			name: "vanilla command",
+			line: "[12:00:04] [Server thread/INFO]: [Steve: Set the time to 1000]",
+			want: GameEvent{Type: EVENT_COMMAND, Player: "Steve", Message: "Set the time to 1000"},
+			ok:   true,
+		},
+		{
+			name: "vanilla lag",
+			line: "[12:00:05] [Server thread/WARN]: Can't keep up! Is the server overloaded? Running 2500ms or 50 ticks behind",
+			want: GameEvent{Type: EVENT_LAG, LagMillis: 2500, LagTicks: 50},
+			ok:   true,
+		},
+		{
+			name: "vanilla saving",
+			line: "[12:00:06] [Server thread/INFO]: Saving the game (this may take a moment!)",
+			want: GameEvent{Type: EVENT_SAVING},
+			ok:   true,
+		},
+		{
+			name: "vanilla saved",
+			line: "[12:00:06] [Server thread/INFO]: Saved the game",
+			want: GameEvent{Type: EVENT_SAVED},
+			ok:   true,
+		},
+		{
+			name: "vanilla done",
+			line: `[12:00:07] [Server thread/INFO]: Done (3.456s)! For help, type "help"`,
+			want: GameEvent{Type: EVENT_DONE, BootSeconds: 3.456},
+			ok:   true,
+		},
+		{
+			name: "vanilla say",
+			line: "[12:00:08] [Server thread/INFO]: [Server] Steve joined the game",
+		},
+
+		// Paper
+		{
+			name: "paper join",
+			before: []string{
+				"[12:00:00 INFO]: UUID of player Steve is " + uuid,
+				"[12:00:00 INFO]: Steve[/192.168.1.10:54321] logged in with entity id 123 at ([world]0.5, 64.0, 0.5)",
+			},
+			line: "[12:00:00 INFO]: Steve joined the game",
+			want: GameEvent{Type: EVENT_PLAYER_JOINED, Player: "Steve", UUID: uuid, IP: "192.168.1.10"},
+			ok:   true,
+		},
+		{
+			name: "paper chat",
+			line: "[12:00:01 INFO]: <Steve> hello",
+			want: GameEvent{Type: EVENT_CHAT, Player: "Steve", Message: "hello"},
+			ok:   true,
+		},
+		{
+			name: "paper command",
+			line: "[12:00:01 INFO]: Steve issued server command: /spawn",
+			want: GameEvent{Type: EVENT_COMMAND, Player: "Steve", Message: "/spawn"},
+			ok:   true,
+		},
+		{
+			name: "paper lag",
+			line: "[12:00:05 WARN]: Can't keep up! Is the server overloaded? Running 5000ms or 100 ticks behind",
+			want: GameEvent{Type: EVENT_LAG, LagMillis: 5000, LagTicks: 100},
+			ok:   true,
+		},
+		{
+			name: "paper done with decimal comma",
+			line: `[12:00:07 INFO]: Done (12,345s)! For help, type "help"`,
+			want: GameEvent{Type: EVENT_DONE, BootSeconds: 12.345},
+			ok:   true,
+		},
+
+		// Fabric and Forge
+		{
+			name: "fabric join",
+			line: "[12:00:00] [Server thread/INFO] (Minecraft) Steve joined the game",
+			want: GameEvent{Type: EVENT_PLAYER_JOINED, Player: "Steve"},
+			ok:   true,
+		},
+		{
+			name: "fabric chat",
+			line: "[12:00:01] [Server thread/INFO] (Minecraft) <Steve> hello",
+			want: GameEvent{Type: EVENT_CHAT, Player: "Steve", Message: "hello"},
+			ok:   true,
+		},
+		{
+			name: "fabric advancement",
+			line: "[12:00:03] [Server thread/INFO] (Minecraft) Steve has completed the challenge [How Did We Get Here?]",
+			want: GameEvent{Type: EVENT_ADVANCEMENT, Player: "Steve", Message: "How Did We Get Here?"},
+			ok:   true,
+		},
+		{
+			name: "forge left",
+			line: "[12:00:08] [Server thread/INFO] [minecraft/DedicatedServer]: Steve left the game",
+			want: GameEvent{Type: EVENT_PLAYER_LEFT, Player: "Steve"},
+			ok:   true,
+		},
+
+		// Chat messages looking like other lines
+		{
+			name: "vanilla chat like a join",
+			line: "[12:00:01] [Server thread/INFO]: <Mallory> Steve joined the game",
+			want: GameEvent{Type: EVENT_CHAT, Player: "Mallory", Message: "Steve joined the game"},
+			ok:   true,
+		},
+		{
+			name: "paper chat like a left",
+			line: "[12:00:01 INFO]: <Mallory> Steve left the game",
+			want: GameEvent{Type: EVENT_CHAT, Player: "Mallory", Message: "Steve left the game"},
+			ok:   true,
+		},
+		{
+			name: "fabric chat like a death",
+			line: "[12:00:01] [Server thread/INFO] (Minecraft) <Mallory> Steve was slain by Zombie",
+			want: GameEvent{Type: EVENT_CHAT, Player: "Mallory", Message: "Steve was slain by Zombie"},
+			ok:   true,
+		},
+		{
+			name: "chat like a uuid before a join",
+			before: []string{
+				"[12:00:00] [Server thread/INFO]: <Mallory> UUID of player Steve is 00000000-0000-0000-0000-000000000000",
+			},
+			line: "[12:00:00] [Server thread/INFO]: Steve joined the game",
+			want: GameEvent{Type: EVENT_PLAYER_JOINED, Player: "Steve"},
+			ok:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &McServer{
+				Name:           "test",
+				Players:        map[string]*McUser{"Steve": {Name: "Steve"}},
+				pendingPlayers: make(map[string]*playerInfo),
+			}
+
+			for _, line := range tt.before {
+				srv.parseGameEvent(line)
+			}
+
+			ev, ok := srv.parseGameEvent(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("got ok %v for %q", ok, tt.line)
+			}
+			if !ok {
+				return
+			}
+
+			tt.want.Time, tt.want.Server = ev.Time, "test"
+			if ev != tt.want {
+				t.Fatalf("got %+v, want %+v", ev, tt.want)
+			}
+		})
+	}
+}
+
+func TestGameEventsPlayers(t *testing.T) {
+	srv, _ := newFakeServer(t, `{"launcher": "fake", "disable_rcon": true}`)
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	steps := []struct {
+		line   string
+		online bool
+	}{
+		{"[12:00:00] [Server thread/INFO]: <Mallory> Steve joined the game", false},
+		{"[12:00:00 INFO]: <Mallory> Steve joined the game", false},
+		{"[12:00:00] [Server thread/INFO]: [Server] Steve joined the game", false},
+		{"[12:00:01] [Server thread/INFO]: Steve joined the game", true},
+		{"[12:00:02] [Server thread/INFO]: <Mallory> Steve left the game", true},
+		{"[12:00:02] [Server thread/INFO] (Minecraft) <Mallory> Steve left the game", true},
+		{"[12:00:03] [Server thread/INFO]: Steve left the game", false},
+	}
+
+	for _, step := range steps {
+		srv.handleGameEventLine(step.line)
+		if online := srv.isOnline("Steve"); online != step.online {
+			t.Fatalf("after %q: online %v, want %v", step.line, online, step.online)
+		}
+	}
+}
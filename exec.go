@@ -0,0 +1,106 @@
+package craft
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// exec_output_timeout is how long Exec waits for the first line of the
+	// output, exec_quiet_period how long after the last one
+	exec_output_timeout = time.Second * 2
+	exec_quiet_period   = time.Millisecond * 250
+	// exec_timeout limits the whole command, unless the caller asks otherwise
+	exec_timeout     = time.Second * 10
+	max_exec_timeout = time.Second * 30
+)
+
+// OutputMatcher tells whether a line is the last one of the output of a command
+type OutputMatcher func(line LogLine) bool
+
+// Exec sends a command to the server and returns its output. Through the
+// RCON the output is the response of the command, otherwise the lines
+// written on stdout until the output goes quiet or ctx is done, with the
+// lines collected so far. The server writes also the other logs on
+// stdout, so in that case the output may contain lines not caused by
+// the command
+func (srv *McServer) Exec(ctx context.Context, cmd string) ([]LogLine, error) {
+	return srv.ExecUntil(ctx, cmd, nil)
+}
+
+// ExecUntil is Exec ending the output also at the first line
+// matched by done, which is included
+func (srv *McServer) ExecUntil(ctx context.Context, cmd string, done OutputMatcher) ([]LogLine, error) {
+	// One command at a time, otherwise the outputs would be mixed
+	srv.execM.Lock()
+	defer srv.execM.Unlock()
+
+	srv.m.RLock()
+	log := srv.log
+	session := srv.session
+	srv.m.RUnlock()
+
+	output, sent, err := srv.rconExec(ctx, cmd)
+	if sent {
+		var lines []LogLine
+		for _, message := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+			if message == "" {
+				continue
+			}
+
+			line := LogLine{
+				Level: "info", Date: time.Now().Format(time.RFC3339Nano),
+				Message: message, Tags: []string{"rcon"}, Session: session,
+			}
+			lines = append(lines, line)
+			if done != nil && done(line) {
+				break
+			}
+		}
+		return lines, err
+	}
+
+	if log == nil || !srv.IsRunning() {
+		return nil, errors.New("minecraft server not running")
+	}
+
+	_, ch := log.ListenForLogs(log_listener_buffer)
+	defer ch.Unregister()
+
+	err = srv.process.SendText(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(exec_output_timeout)
+	defer timer.Stop()
+
+	var lines []LogLine
+	logCh := ch.Ch()
+	for {
+		select {
+		case l, ok := <-logCh:
+			if !ok {
+				return lines, errors.New("minecraft server stopped")
+			}
+
+			line, err := newLogLine(l, session)
+			if err != nil || !slices.Contains(line.Tags, "stdout") {
+				continue
+			}
+
+			lines = append(lines, line)
+			if done != nil && done(line) {
+				return lines, nil
+			}
+			timer.Reset(exec_quiet_period)
+		case <-timer.C:
+			return lines, nil
+		case <-ctx.Done():
+			return lines, ctx.Err()
+		}
+	}
+}
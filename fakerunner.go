@@ -0,0 +1,378 @@
+package craft
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixpare/process"
+)
+
+// FakeRunner is a ProcessRunner simulating a vanilla Minecraft server, so that
+// the lifecycle, the idle shutdown and the console can be exercised without
+// Java. The fake servers print realistic log lines while booting, handle
+// the stop, save-all, list and say commands, and can be driven with the
+// Join, Leave, Chat and Crash methods of FakeProcess
+type FakeRunner struct {
+	// BootTime is how long a fake server takes to print the Done line
+	BootTime time.Duration
+	// IgnoreStop makes the fake servers ignore the stop command and Stop,
+	// so that only Kill terminates them
+	IgnoreStop bool
+	// IgnoreKill makes Kill fail, as with a process that can't be signalled
+	IgnoreKill bool
+
+	processes map[string]*FakeProcess
+	m         sync.Mutex
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		BootTime:  time.Millisecond * 100,
+		processes: make(map[string]*FakeProcess),
+	}
+}
+
+func (r *FakeRunner) NewProcess(wd string, execName string, env []string, args ...string) (ServerProcess, error) {
+	p := &FakeProcess{
+		Wd:       wd,
+		ExecName: execName,
+		Env:      env,
+		Args:     args,
+		runner:   r,
+		exited:   make(chan struct{}),
+	}
+
+	r.m.Lock()
+	r.processes[wd] = p
+	r.m.Unlock()
+
+	return p, nil
+}
+
+// Process returns the last process created for the server directory wd
+func (r *FakeRunner) Process(wd string) (*FakeProcess, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	p, ok := r.processes[wd]
+	return p, ok
+}
+
+// FakeProcess is a fake Minecraft server created by FakeRunner
+type FakeProcess struct {
+	Wd       string
+	ExecName string
+	Env      []string
+	Args     []string
+
+	runner   *FakeRunner
+	players  []string
+	entityID int
+	started  bool
+	running  bool
+	stopping bool
+	exit     process.ExitStatus
+	exited   chan struct{}
+	m        sync.Mutex
+
+	stdout fakeOutput
+	stderr fakeOutput
+}
+
+func (p *FakeProcess) Start() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.started {
+		return errors.New("process already started")
+	}
+	p.started, p.running = true, true
+
+	go p.boot()
+	return nil
+}
+
+func (p *FakeProcess) boot() {
+	p.log("Starting minecraft server version 1.21")
+	p.log(`Preparing level "world"`)
+
+	for progress := 0; progress < 100; progress += 25 {
+		select {
+		case <-time.After(p.runner.BootTime / 5):
+		case <-p.exited:
+			return
+		}
+		p.log(fmt.Sprintf("Preparing spawn area: %d%%", progress))
+	}
+
+	select {
+	case <-time.After(p.runner.BootTime / 5):
+	case <-p.exited:
+		return
+	}
+	p.log(fmt.Sprintf(`Done (%.3fs)! For help, type "help"`, p.runner.BootTime.Seconds()))
+}
+
+func (p *FakeProcess) Wait() process.ExitStatus {
+	p.m.Lock()
+	started := p.started
+	p.m.Unlock()
+
+	if !started {
+		return process.ExitStatus{ExitCode: -1, ExitError: errors.New("process not started")}
+	}
+
+	<-p.exited
+	return p.exit
+}
+
+func (p *FakeProcess) IsRunning() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.running
+}
+
+func (p *FakeProcess) SendText(text string) error {
+	if !p.IsRunning() {
+		return errors.New("process not running")
+	}
+
+	cmd, args, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(text), "/"), " ")
+	switch cmd {
+	case "stop":
+		p.Stop()
+	case "save-all":
+		p.log("Saving the game (this may take a moment!)")
+		p.log("Saved the game")
+	case "list":
+		p.m.Lock()
+		players := append([]string(nil), p.players...)
+		p.m.Unlock()
+
+		p.log(fmt.Sprintf(
+			"There are %d of a max of 20 players online: %s",
+			len(players), strings.Join(players, ", "),
+		))
+	case "say":
+		p.log("[Server] " + args)
+	case "title", "tellraw":
+	default:
+		p.log("Unknown or incomplete command, see below for error")
+	}
+
+	return nil
+}
+
+// Stop makes the server save and exit, unless the runner ignores the stops
+func (p *FakeProcess) Stop() error {
+	if !p.IsRunning() {
+		return errors.New("process not running")
+	}
+	if p.runner.IgnoreStop {
+		return nil
+	}
+
+	p.m.Lock()
+	stopping := p.stopping
+	p.stopping = true
+	p.m.Unlock()
+
+	if stopping {
+		return nil
+	}
+
+	go func() {
+		p.log("Stopping the server")
+		p.log("Stopping server")
+		p.log("Saving players")
+		p.log("Saving worlds")
+		p.setExit(process.ExitStatus{})
+	}()
+	return nil
+}
+
+func (p *FakeProcess) Kill() error {
+	if !p.IsRunning() {
+		return errors.New("process not running")
+	}
+	if p.runner.IgnoreKill {
+		return errors.New("operation not permitted")
+	}
+
+	p.setExit(process.ExitStatus{ExitCode: -1, ExitError: errors.New("signal: killed")})
+	return nil
+}
+
+// Join prints the lines of a player joining the server
+func (p *FakeProcess) Join(name string) {
+	p.m.Lock()
+	p.players = append(p.players, name)
+	p.entityID++
+	entityID := p.entityID
+	p.m.Unlock()
+
+	p.logThread("User Authenticator #1", fmt.Sprintf("UUID of player %s is %s", name, offlineUUID(name)))
+	p.log(fmt.Sprintf("%s[/127.0.0.1:%d] logged in with entity id %d at (0.5, 64.0, 0.5)", name, 50000+entityID, entityID))
+	p.log(name + " joined the game")
+}
+
+// Leave prints the lines of a player leaving the server
+func (p *FakeProcess) Leave(name string) {
+	p.m.Lock()
+	for i, player := range p.players {
+		if player == name {
+			p.players = append(p.players[:i], p.players[i+1:]...)
+			break
+		}
+	}
+	p.m.Unlock()
+
+	p.log(name + " lost connection: Disconnected")
+	p.log(name + " left the game")
+}
+
+// Chat prints a chat message of a player
+func (p *FakeProcess) Chat(name string, message string) {
+	p.log(fmt.Sprintf("<%s> %s", name, message))
+}
+
+// Crash prints a stack trace on stderr and exits with the given code
+func (p *FakeProcess) Crash(exitCode int) {
+	p.stderr.write(`Exception in thread "Server thread" java.lang.IllegalStateException: Fake crash`)
+	p.stderr.write("\tat net.minecraft.server.MinecraftServer.runServer(MinecraftServer.java:700)")
+	p.stderr.write("\tat java.base/java.lang.Thread.run(Thread.java:1583)")
+
+	p.setExit(process.ExitStatus{
+		ExitCode:  exitCode,
+		ExitError: fmt.Errorf("exit status %d", exitCode),
+	})
+}
+
+func (p *FakeProcess) setExit(exit process.ExitStatus) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if !p.running {
+		return
+	}
+	p.running = false
+	p.exit = exit
+
+	p.stdout.close()
+	p.stderr.close()
+	close(p.exited)
+}
+
+func (p *FakeProcess) log(message string) {
+	p.logThread("Server thread", message)
+}
+
+func (p *FakeProcess) logThread(thread string, message string) {
+	p.stdout.write(fmt.Sprintf("[%s] [%s/INFO]: %s", time.Now().Format(time.TimeOnly), thread, message))
+}
+
+func (p *FakeProcess) StdoutListener(bufSize int) <-chan []byte {
+	return p.stdout.listen(bufSize)
+}
+
+func (p *FakeProcess) StderrListener(bufSize int) <-chan []byte {
+	return p.stderr.listen(bufSize)
+}
+
+func (p *FakeProcess) ConnectStdout(bufSize int) ([][]byte, <-chan []byte) {
+	return p.stdout.connect(bufSize)
+}
+
+func (p *FakeProcess) ConnectStderr(bufSize int) ([][]byte, <-chan []byte) {
+	return p.stderr.connect(bufSize)
+}
+
+// Unlisten closes a listener returned by StdoutListener, StderrListener,
+// ConnectStdout or ConnectStderr, which stops receiving the output
+func (p *FakeProcess) Unlisten(ch <-chan []byte) {
+	if !p.stdout.unlisten(ch) {
+		p.stderr.unlisten(ch)
+	}
+}
+
+// fakeOutput is an output stream of a FakeProcess, keeping all the lines
+// for ConnectStdout and ConnectStderr
+type fakeOutput struct {
+	lines     [][]byte
+	listeners []chan []byte
+	closed    bool
+	m         sync.Mutex
+}
+
+func (o *fakeOutput) listen(bufSize int) <-chan []byte {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return o.listenNoLock(bufSize)
+}
+
+func (o *fakeOutput) listenNoLock(bufSize int) chan []byte {
+	ch := make(chan []byte, bufSize)
+	if o.closed {
+		close(ch)
+	} else {
+		o.listeners = append(o.listeners, ch)
+	}
+	return ch
+}
+
+func (o *fakeOutput) connect(bufSize int) ([][]byte, <-chan []byte) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return append([][]byte(nil), o.lines...), o.listenNoLock(bufSize)
+}
+
+// write sends the line to the listeners. It is dropped for the
+// listeners that do not keep up, so that they can't block the process
+func (o *fakeOutput) write(line string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if o.closed {
+		return
+	}
+
+	o.lines = append(o.lines, []byte(line))
+	for _, ch := range o.listeners {
+		select {
+		case ch <- []byte(line):
+		default:
+		}
+	}
+}
+
+func (o *fakeOutput) unlisten(ch <-chan []byte) bool {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for i, listener := range o.listeners {
+		if listener == ch {
+			o.listeners = slices.Delete(o.listeners, i, i+1)
+			close(listener)
+			return true
+		}
+	}
+	return false
+}
+
+func (o *fakeOutput) close() {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.closed = true
+	for _, ch := range o.listeners {
+		close(ch)
+	}
+	o.listeners = nil
+}
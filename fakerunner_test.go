@@ -0,0 +1,344 @@
+package craft
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+// newFakeServer loads a server with the given manifest, run by a FakeRunner
+func newFakeServer(t *testing.T, manifest string) (*McServer, *FakeRunner) {
+	t.Helper()
+
+	// Not t.TempDir, the archive may still be writing the last lines
+	serversPath, err := os.MkdirTemp("", "nixcraft-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(serversPath) })
+
+	cfg := DefaultConfig()
+	cfg.ServersPath = serversPath
+	cfg.LogMaxSizeMB = 0
+
+	dir := filepath.Join(cfg.ServersPath, "test")
+	os.Mkdir(dir, 0o755)
+	err = os.WriteFile(filepath.Join(dir, server_manifest_name), []byte(manifest), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := NewFakeRunner()
+	runner.BootTime = time.Millisecond * 50
+
+	msm := newMcServerManager(cfg, logger.NewLogger(nil))
+	msm.runner = runner
+	msm.accounts, err = LoadAccounts(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msm.loadServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, ok := msm.Servers["test"]
+	if !ok {
+		t.Fatal("server not loaded")
+	}
+	t.Cleanup(func() {
+		srv.cancelRestart()
+		if srv.IsRunning() {
+			srv.process.Kill()
+			<-srv.exited
+		}
+		if srv.log != nil {
+			srv.log.Close()
+		}
+		srv.archive.Close()
+	})
+
+	return srv, runner
+}
+
+func waitState(t *testing.T, srv *McServer, want ServerState) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if state, _ := srv.State(); state == want {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	state, _ := srv.State()
+	t.Fatalf("state is %s, want %s", state, want)
+}
+
+func TestFakeServerStart(t *testing.T) {
+	srv, _ := newFakeServer(t, `{"launcher": "fake", "disable_rcon": true}`)
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	if !srv.IsReady() {
+		t.Fatal("running server not ready")
+	}
+	if err = srv.Start(); err == nil {
+		t.Fatal("started twice")
+	}
+
+	err = srv.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := srv.State(); state != SERVER_STOPPED || srv.IsRunning() {
+		t.Fatalf("state is %s after the stop", state)
+	}
+}
+
+func TestFakeServerIdleStop(t *testing.T) {
+	srv, _ := newFakeServer(t, `{"launcher": "fake", "disable_rcon": true}`)
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	// Just started, not idle
+	srv.msm.stopIdleServers(time.Now(), srv.msm.Logger)
+	if !srv.IsRunning() {
+		t.Fatal("stopped a server not idle")
+	}
+
+	srv.msm.stopIdleServers(time.Now().Add(idle_shutdown_after*2), srv.msm.Logger)
+	if state, _ := srv.State(); state != SERVER_STOPPED || srv.IsRunning() {
+		t.Fatalf("idle server not stopped: %s", state)
+	}
+}
+
+func TestFakeServerCrashRestart(t *testing.T) {
+	srv, runner := newFakeServer(t, `{
+		"launcher": "fake", "disable_rcon": true,
+		"restart_policy": "on-failure", "restart_delay": 1, "restart_max_retries": 1
+	}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := srv.msm.Subscribe(ctx, EventTypes(EVENT_SERVER_CRASHED, EVENT_SERVER_CRASH_LOOP))
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	first, _ := runner.Process(srv.wd)
+	first.Crash(1)
+	waitState(t, srv, SERVER_CRASHED)
+
+	// Restarted after the delay
+	waitState(t, srv, SERVER_RUNNING)
+	second, _ := runner.Process(srv.wd)
+	if second == first {
+		t.Fatal("process not restarted")
+	}
+
+	crashes := srv.Crashes()
+	if len(crashes) != 1 || crashes[0].ExitCode != 1 || len(crashes[0].Stderr) == 0 {
+		t.Fatalf("unexpected crash reports: %+v", crashes)
+	}
+
+	// No retries left
+	second.Crash(1)
+	waitState(t, srv, SERVER_CRASH_LOOP)
+
+	for _, want := range []EventType{EVENT_SERVER_CRASHED, EVENT_SERVER_CRASHED, EVENT_SERVER_CRASH_LOOP} {
+		select {
+		case ev := <-events:
+			if ev.Type != want {
+				t.Fatalf("got event %s, want %s", ev.Type, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestFakeServerStopFailed(t *testing.T) {
+	srv, runner := newFakeServer(t, `{
+		"launcher": "fake", "disable_rcon": true,
+		"stop_timeout": 1, "kill_timeout": 1
+	}`)
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	runner.IgnoreStop, runner.IgnoreKill = true, true
+	if err = srv.Stop(); err == nil {
+		t.Fatal("stop of an unkillable server succeeded")
+	}
+	if state, _ := srv.State(); state != SERVER_RUNNING {
+		t.Fatalf("state is %s after the failed stop", state)
+	}
+
+	// The next stop is not refused as already stopping
+	runner.IgnoreStop, runner.IgnoreKill = false, false
+	if err = srv.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := srv.State(); state != SERVER_STOPPED {
+		t.Fatalf("state is %s after the stop", state)
+	}
+}
+
+func TestFakeServerKill(t *testing.T) {
+	srv, runner := newFakeServer(t, `{
+		"launcher": "fake", "disable_rcon": true,
+		"restart_policy": "always", "restart_delay": 0
+	}`)
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+	proc, _ := runner.Process(srv.wd)
+
+	err = srv.Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_STOPPED)
+
+	// Not restarted, not a crash
+	time.Sleep(time.Millisecond * 100)
+	if next, _ := runner.Process(srv.wd); next != proc || srv.IsRunning() {
+		t.Fatal("killed server restarted")
+	}
+	if crashes := srv.Crashes(); len(crashes) != 0 {
+		t.Fatalf("kill recorded as a crash: %+v", crashes)
+	}
+
+	if err = srv.Kill(); err == nil {
+		t.Fatal("killed a stopped server")
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	tests := []struct {
+		base     int
+		restarts int
+		want     time.Duration
+	}{
+		{5, 0, time.Second * 5},
+		{5, 3, time.Second * 40},
+		{5, 10, max_restart_delay},
+		{1, 64, max_restart_delay},
+		{1, 1000, max_restart_delay},
+		{0, 100, 0},
+		{1 << 62, 1, max_restart_delay},
+	}
+
+	for _, tt := range tests {
+		if got := restartDelay(tt.base, tt.restarts); got != tt.want {
+			t.Fatalf("restartDelay(%d, %d) = %v, want %v", tt.base, tt.restarts, got, tt.want)
+		}
+	}
+}
+
+func TestFakeServerConsoleInput(t *testing.T) {
+	srv, runner := newFakeServer(t, `{"launcher": "fake", "disable_rcon": true}`)
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	proc, _ := runner.Process(srv.wd)
+	proc.Join("Steve")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	output, err := srv.ExecUntil(ctx, "list", func(line LogLine) bool {
+		return strings.Contains(line.Message, "players online")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output) == 0 || !strings.HasSuffix(output[len(output)-1].Message, "There are 1 of a max of 20 players online: Steve") {
+		t.Fatalf("unexpected output: %+v", output)
+	}
+
+	_, ch := proc.ConnectStdout(10)
+	defer proc.Unlisten(ch)
+
+	err = srv.SendInput("say hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-ch:
+		if !strings.HasSuffix(string(line), "[Server] hello") {
+			t.Fatalf("unexpected line %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no output for the command")
+	}
+}
+
+func TestFakeOutputSlowListener(t *testing.T) {
+	var o fakeOutput
+
+	stuck := o.listen(1)
+	live := o.listen(10)
+
+	done := make(chan struct{})
+	go func() {
+		for i := range 5 {
+			o.write(strings.Repeat("x", i))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked by a listener not reading")
+	}
+
+	if n := len(live); n != 5 {
+		t.Fatalf("live listener got %d lines, want 5", n)
+	}
+	if n := len(stuck); n != 1 {
+		t.Fatalf("stuck listener got %d lines, want 1", n)
+	}
+
+	if !o.unlisten(stuck) || o.unlisten(stuck) {
+		t.Fatal("listener not removed once")
+	}
+	<-stuck
+	if _, ok := <-stuck; ok {
+		t.Fatal("listener not closed")
+	}
+
+	o.write("after")
+	if n := len(live); n != 6 {
+		t.Fatalf("live listener got %d lines, want 6", n)
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/nixpare/nix v0.1.0
 	github.com/nixpare/process v1.7.0
 	github.com/nixpare/server/v3 v3.0.0-beta.6
+	golang.org/x/crypto v0.29.0
 )
 
 require (
@@ -23,7 +24,6 @@ require (
 	github.com/quic-go/quic-go v0.48.1 // indirect
 	github.com/yookoala/gofast v0.8.0 // indirect
 	go.uber.org/mock v0.5.0 // indirect
-	golang.org/x/crypto v0.29.0 // indirect
 	golang.org/x/exp v0.0.0-20241108190413-2d47ceb2692f // indirect
 	golang.org/x/mod v0.22.0 // indirect
 	golang.org/x/net v0.31.0 // indirect
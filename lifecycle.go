@@ -0,0 +1,87 @@
+package craft
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// ServerState is the lifecycle state of a McServer
+type ServerState string
+
+const (
+	SERVER_STOPPED  ServerState = "stopped"
+	SERVER_STARTING ServerState = "starting"
+	SERVER_RUNNING  ServerState = "running"
+	SERVER_STOPPING ServerState = "stopping"
+	SERVER_CRASHED  ServerState = "crashed"
+)
+
+// stateEvents are the events published when entering a state. Crashes
+// are published by handleExit, together with the exit error
+var stateEvents = map[ServerState]EventType{
+	SERVER_STARTING:   EVENT_SERVER_STARTING,
+	SERVER_RUNNING:    EVENT_SERVER_READY,
+	SERVER_STOPPED:    EVENT_SERVER_STOPPED,
+	SERVER_CRASH_LOOP: EVENT_SERVER_CRASH_LOOP,
+}
+
+var (
+	// Printed by vanilla, Paper, Fabric and Forge servers when
+	// they are ready to accept players
+	doneLineRegexp     = regexp.MustCompile(`Done \(\d+[.,]\d+s\)! For help`)
+	progressLineRegexp = regexp.MustCompile(`Preparing spawn area: (\d+)%`)
+)
+
+// State returns the lifecycle state of the server and, while starting,
+// the spawn area preparation progress in percent
+func (srv *McServer) State() (ServerState, int) {
+	srv.stateM.RLock()
+	defer srv.stateM.RUnlock()
+
+	if srv.state == "" {
+		return SERVER_STOPPED, 0
+	}
+	return srv.state, srv.progress
+}
+
+// setState updates the lifecycle state and signals the change
+func (srv *McServer) setState(state ServerState, progress int) {
+	srv.stateM.Lock()
+	stateChanged := srv.state != state
+	changed := stateChanged || srv.progress != progress
+	srv.state, srv.progress = state, progress
+	srv.stateM.Unlock()
+
+	if typ, ok := stateEvents[state]; ok && stateChanged {
+		srv.msm.publish(typ, srv.Name, "", "")
+	}
+
+	if changed {
+		go srv.msm.SignalStateUpdate()
+	}
+}
+
+// IsReady reports whether the server has finished
+// booting and accepts players
+func (srv *McServer) IsReady() bool {
+	state, _ := srv.State()
+	return state == SERVER_RUNNING && srv.IsRunning()
+}
+
+// handleLifecycleLine updates the state from a line of the server stdout
+func (srv *McServer) handleLifecycleLine(line string) {
+	state, _ := srv.State()
+	if state != SERVER_STARTING {
+		return
+	}
+
+	if doneLineRegexp.MatchString(line) {
+		srv.setState(SERVER_RUNNING, 100)
+		return
+	}
+
+	if match := progressLineRegexp.FindStringSubmatch(line); match != nil {
+		progress, _ := strconv.Atoi(match[1])
+		srv.setState(SERVER_STARTING, min(progress, 99))
+	}
+}
@@ -0,0 +1,468 @@
+package craft
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+	"github.com/nixpare/server/v3"
+)
+
+// The limbo implements the login, configuration and play states of the
+// Minecraft 1.21 protocol (767), enough to keep a player in an empty world
+// while the server boots. Clients of other versions are held in the login
+// state and disconnected once the server is ready
+const (
+	limbo_protocol_version = 767
+
+	limbo_timeout          = time.Minute * 5
+	limbo_login_timeout    = time.Second * 25
+	limbo_keep_alive_every = time.Second * 10
+	limbo_update_every     = time.Second
+)
+
+const (
+	// Login
+	login_success_packet_id      = 0x02
+	login_acknowledged_packet_id = 0x03
+
+	// Configuration
+	config_finish_packet_id        = 0x03
+	config_keep_alive_packet_id    = 0x04
+	config_registry_data_packet_id = 0x07
+	config_transfer_packet_id      = 0x0B
+	config_known_packs_packet_id   = 0x0E
+
+	config_client_known_packs_packet_id = 0x07
+	config_ack_finish_packet_id         = 0x03
+
+	// Play
+	play_boss_bar_packet_id        = 0x0A
+	play_disconnect_packet_id      = 0x1D
+	play_game_event_packet_id      = 0x22
+	play_keep_alive_packet_id      = 0x26
+	play_login_packet_id           = 0x2B
+	play_player_position_packet_id = 0x40
+	play_transfer_packet_id        = 0x73
+)
+
+var limboKnownPackVersions = []string{"1.21", "1.21.1"}
+
+// limboRegistries are the registry entries sent to the client. Their data
+// is taken from the vanilla core pack of the client, so only the names
+// are needed. The first dimension type is the one used by the limbo world
+var limboRegistries = []struct {
+	id      string
+	entries []string
+}{
+	{"minecraft:dimension_type", []string{"overworld"}},
+	{"minecraft:worldgen/biome", []string{"plains"}},
+	{"minecraft:chat_type", []string{"chat"}},
+	{"minecraft:painting_variant", []string{"kebab"}},
+	{"minecraft:wolf_variant", []string{"pale"}},
+	{"minecraft:banner_pattern", []string{"base"}},
+	{"minecraft:damage_type", []string{
+		"arrow", "bad_respawn_point", "cactus", "cramming", "dragon_breath",
+		"drown", "dry_out", "explosion", "fall", "falling_anvil", "falling_block",
+		"falling_stalactite", "fireball", "fireworks", "fly_into_wall", "freeze",
+		"generic", "generic_kill", "hot_floor", "in_fire", "in_wall",
+		"indirect_magic", "lava", "lightning_bolt", "mace_smash", "magic",
+		"mob_attack", "mob_attack_no_aggro", "mob_projectile", "on_fire",
+		"out_of_world", "outside_border", "player_attack", "player_explosion",
+		"sonic_boom", "spit", "stalagmite", "starve", "sting", "sweet_berry_bush",
+		"thorns", "thrown", "trident", "unattributed_fireball", "wind_charge",
+		"wither", "wither_skull",
+	}},
+}
+
+type limboConn struct {
+	srv      *server.TCPServer
+	conn     net.Conn
+	hs       handshake
+	login    loginStart
+	mcServer *McServer
+
+	packets <-chan packet
+	bossBar mcUUID
+}
+
+// holdInLimbo keeps the player connected while mcServer boots, then moves
+// the player to the server with a Transfer packet or, for clients not
+// supporting the limbo world, with a disconnect message asking to rejoin
+func holdInLimbo(srv *server.TCPServer, conn net.Conn, rd *bufio.Reader, hs handshake, login loginStart, mcServer *McServer) {
+	srv.Logger.Printf(logger.LOG_LEVEL_INFO, "Player %s is waiting in limbo for server %s", login.Name, mcServer.Name)
+
+	if hs.ProtocolVersion != limbo_protocol_version {
+		holdInLogin(srv, conn, login, mcServer)
+		return
+	}
+
+	packets := make(chan packet, 10)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(packets)
+		for {
+			p, err := readPacket(rd)
+			if err != nil {
+				return
+			}
+
+			select {
+			case packets <- p:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	l := &limboConn{
+		srv: srv, conn: conn,
+		hs: hs, login: login,
+		mcServer: mcServer,
+		packets:  packets,
+	}
+	l.bossBar = md5.Sum([]byte("nixcraft-limbo:" + mcServer.Name))
+
+	err := l.run()
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Player %s left limbo for server %s: %v", login.Name, mcServer.Name, err)
+	}
+}
+
+// holdInLogin keeps the client in the login state without answering, which
+// the client tolerates for about 30 seconds
+func holdInLogin(srv *server.TCPServer, conn net.Conn, login loginStart, mcServer *McServer) {
+	deadline := time.Now().Add(limbo_login_timeout)
+	ready := false
+
+	for !ready && time.Now().Before(deadline) {
+		time.Sleep(limbo_update_every)
+		_, ready = mcServer.bootProgress()
+	}
+
+	message, color := mcServer.msm.config.MessageStarting, "yellow"
+	if ready {
+		message, color = mcServer.msm.config.MessageReady, "green"
+	}
+
+	err := disconnectLogin(conn, chatComponent{
+		Text:  mcServer.msm.formatMessage(message, mcServer, login.Name),
+		Color: color,
+	})
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error sending disconnect to player %s: %v", login.Name, err)
+	}
+}
+
+func (l *limboConn) run() error {
+	uuid := l.login.UUID
+	if !l.login.HasUUID {
+		uuid = offlineUUID(l.login.Name)
+	}
+
+	// Login Success: uuid, name, no properties, no strict error handling
+	data := append(uuid[:], appendString(nil, l.login.Name)...)
+	data = appendVarInt(data, 0)
+	data = append(data, 0)
+
+	err := writePacket(l.conn, login_success_packet_id, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.waitPacket(login_acknowledged_packet_id)
+	if err != nil {
+		return err
+	}
+
+	knownCore, err := l.exchangeKnownPacks()
+	if err != nil {
+		return err
+	}
+
+	// Without the vanilla data pack the registries can't be sent by name,
+	// so the player is kept in the configuration state
+	if !knownCore {
+		return l.loop(config_keep_alive_packet_id, config_transfer_packet_id, false)
+	}
+
+	err = l.sendRegistries()
+	if err != nil {
+		return err
+	}
+
+	err = writePacket(l.conn, config_finish_packet_id, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.waitPacket(config_ack_finish_packet_id)
+	if err != nil {
+		return err
+	}
+
+	err = l.joinWorld()
+	if err != nil {
+		return err
+	}
+
+	return l.loop(play_keep_alive_packet_id, play_transfer_packet_id, true)
+}
+
+// waitPacket discards the client packets until one with the given id arrives
+func (l *limboConn) waitPacket(id int32) (packet, error) {
+	timeout := time.After(limbo_login_timeout)
+
+	for {
+		select {
+		case p, ok := <-l.packets:
+			if !ok {
+				return p, fmt.Errorf("connection closed")
+			}
+			if p.id == id {
+				return p, nil
+			}
+		case <-timeout:
+			return packet{}, fmt.Errorf("timeout waiting for packet 0x%02X", id)
+		}
+	}
+}
+
+// exchangeKnownPacks offers the vanilla core pack and reports whether the
+// client has it
+func (l *limboConn) exchangeKnownPacks() (bool, error) {
+	data := appendVarInt(nil, int32(len(limboKnownPackVersions)))
+	for _, version := range limboKnownPackVersions {
+		data = appendString(data, "minecraft")
+		data = appendString(data, "core")
+		data = appendString(data, version)
+	}
+
+	err := writePacket(l.conn, config_known_packs_packet_id, data)
+	if err != nil {
+		return false, err
+	}
+
+	p, err := l.waitPacket(config_client_known_packs_packet_id)
+	if err != nil {
+		return false, err
+	}
+
+	rd := bytes.NewReader(p.data)
+	n, err := readVarInt(rd)
+	if err != nil {
+		return false, err
+	}
+
+	for range n {
+		var fields [3]string
+		for i := range fields {
+			fields[i], err = readString(rd)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if fields[0] == "minecraft" && fields[1] == "core" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (l *limboConn) sendRegistries() error {
+	for _, registry := range limboRegistries {
+		data := appendString(nil, registry.id)
+		data = appendVarInt(data, int32(len(registry.entries)))
+		for _, entry := range registry.entries {
+			data = appendString(data, "minecraft:"+entry)
+			// no data, taken from the known pack
+			data = append(data, 0)
+		}
+
+		err := writePacket(l.conn, config_registry_data_packet_id, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// joinWorld spawns the player as a spectator in the void, so that the client
+// does not need any chunk to leave the loading screen
+func (l *limboConn) joinWorld() error {
+	const dimension = "minecraft:overworld"
+
+	data := binary.BigEndian.AppendUint32(nil, 1) // entity id
+	data = append(data, 0)                        // hardcore
+	data = appendVarInt(data, 1)
+	data = appendString(data, dimension)
+	data = appendVarInt(data, 1) // max players
+	data = appendVarInt(data, 2) // view distance
+	data = appendVarInt(data, 2) // simulation distance
+	data = append(data, 0, 1, 0) // reduced debug info, respawn screen, limited crafting
+	data = appendVarInt(data, 0) // dimension type, first of the registry
+	data = appendString(data, dimension)
+	data = binary.BigEndian.AppendUint64(data, 0) // hashed seed
+	data = append(data, 3, 0xFF)                  // spectator, no previous game mode
+	data = append(data, 0, 1, 0)                  // debug, flat, no death location
+	data = appendVarInt(data, 0)                  // portal cooldown
+	data = append(data, 0)                        // enforces secure chat
+
+	err := writePacket(l.conn, play_login_packet_id, data)
+	if err != nil {
+		return err
+	}
+
+	// Start waiting for level chunks
+	data = append([]byte{13}, binary.BigEndian.AppendUint32(nil, 0)...)
+	err = writePacket(l.conn, play_game_event_packet_id, data)
+	if err != nil {
+		return err
+	}
+
+	data = binary.BigEndian.AppendUint64(nil, math.Float64bits(0))
+	data = binary.BigEndian.AppendUint64(data, math.Float64bits(128))
+	data = binary.BigEndian.AppendUint64(data, math.Float64bits(0))
+	data = binary.BigEndian.AppendUint32(data, 0) // yaw
+	data = binary.BigEndian.AppendUint32(data, 0) // pitch
+	data = append(data, 0)                        // absolute position
+	data = appendVarInt(data, 1)                  // teleport id
+
+	err = writePacket(l.conn, play_player_position_packet_id, data)
+	if err != nil {
+		return err
+	}
+
+	// Boss bar add: title, health, yellow, no division, no flags
+	progress, _ := l.mcServer.bootProgress()
+	data = append(l.bossBar[:], appendVarInt(nil, 0)...)
+	data = append(data, l.bossBarTitle()...)
+	data = binary.BigEndian.AppendUint32(data, math.Float32bits(progress))
+	data = appendVarInt(data, 4)
+	data = appendVarInt(data, 0)
+	data = append(data, 0)
+
+	return writePacket(l.conn, play_boss_bar_packet_id, data)
+}
+
+// bossBarTitle is the LimboTitle config, the {progress} placeholder is
+// filled by formatMessage with the same progress of the health
+func (l *limboConn) bossBarTitle() []byte {
+	msm := l.mcServer.msm
+	return appendNBTText(nil, msm.formatMessage(msm.config.LimboTitle, l.mcServer, l.login.Name), "yellow")
+}
+
+// loop keeps the connection alive until the server is ready, then sends the
+// client back to the proxy with a Transfer packet
+func (l *limboConn) loop(keepAliveID int32, transferID int32, inWorld bool) error {
+	timeout := time.After(limbo_timeout)
+	keepAlive := time.NewTicker(limbo_keep_alive_every)
+	defer keepAlive.Stop()
+	update := time.NewTicker(limbo_update_every)
+	defer update.Stop()
+
+	for {
+		select {
+		case _, ok := <-l.packets:
+			if !ok {
+				return fmt.Errorf("connection closed")
+			}
+		case t := <-keepAlive.C:
+			err := writePacket(l.conn, keepAliveID, binary.BigEndian.AppendUint64(nil, uint64(t.UnixMilli())))
+			if err != nil {
+				return err
+			}
+		case <-update.C:
+			progress, ready := l.mcServer.bootProgress()
+			if ready {
+				l.srv.Logger.Printf(logger.LOG_LEVEL_INFO, "Transferring player %s to server %s", l.login.Name, l.mcServer.Name)
+
+				data := appendString(nil, strings.SplitN(l.hs.ServerAddress, "\x00", 2)[0])
+				data = appendVarInt(data, int32(l.hs.ServerPort))
+				return writePacket(l.conn, transferID, data)
+			}
+
+			if !inWorld {
+				continue
+			}
+
+			// Boss bar update health and title
+			data := append(l.bossBar[:], appendVarInt(nil, 2)...)
+			data = binary.BigEndian.AppendUint32(data, math.Float32bits(progress))
+			err := writePacket(l.conn, play_boss_bar_packet_id, data)
+			if err != nil {
+				return err
+			}
+
+			data = append(l.bossBar[:], appendVarInt(nil, 3)...)
+			data = append(data, l.bossBarTitle()...)
+			err = writePacket(l.conn, play_boss_bar_packet_id, data)
+			if err != nil {
+				return err
+			}
+		case <-timeout:
+			if inWorld {
+				msm := l.mcServer.msm
+				text := msm.formatMessage(msm.config.MessageStarting, l.mcServer, l.login.Name)
+				writePacket(l.conn, play_disconnect_packet_id, appendNBTText(nil, text, "yellow"))
+			}
+			return fmt.Errorf("server not ready after %v", limbo_timeout)
+		}
+	}
+}
+
+// bootProgress returns the boot progress of the server, from 0 to 1,
+// and reports whether it is ready to accept players
+func (srv *McServer) bootProgress() (float32, bool) {
+	if srv.IsReady() {
+		return 1, true
+	}
+
+	_, progress := srv.State()
+	return float32(progress) / 100, false
+}
+
+// offlineUUID returns the UUID that offline mode servers
+// assign to the player
+func offlineUUID(name string) mcUUID {
+	uuid := mcUUID(md5.Sum([]byte("OfflinePlayer:" + name)))
+	uuid[6] = uuid[6]&0x0F | 0x30
+	uuid[8] = uuid[8]&0x3F | 0x80
+	return uuid
+}
+
+// appendNBTText appends a text component in the network NBT format used
+// since 1.20.3: a nameless compound with the text and color strings
+func appendNBTText(b []byte, text string, color string) []byte {
+	appendNBTString := func(b []byte, s string) []byte {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+		return append(b, s...)
+	}
+
+	const (
+		tag_end      = 0x00
+		tag_string   = 0x08
+		tag_compound = 0x0A
+	)
+
+	b = append(b, tag_compound)
+	b = append(b, tag_string)
+	b = appendNBTString(b, "text")
+	b = appendNBTString(b, text)
+	b = append(b, tag_string)
+	b = appendNBTString(b, "color")
+	b = appendNBTString(b, color)
+	return append(b, tag_end)
+}
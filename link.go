@@ -0,0 +1,344 @@
+package craft
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+const (
+	link_code_length   = 6
+	link_code_alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	link_code_ttl      = time.Minute * 10
+)
+
+var (
+	errUUIDMismatch    = errors.New("minecraft account does not match the linked one")
+	errInvalidLinkCode = errors.New("invalid or expired link code")
+)
+
+// linkCode is a one-time code proving that a web user and a Minecraft
+// player are the same person. The codes shown in the web interface are
+// typed in the game chat, the ones shown to the players rejected by
+// the proxy are entered in the web interface
+type linkCode struct {
+	Code    string    `json:"code"`
+	Expires time.Time `json:"expires"`
+
+	// username is set for the codes created in the web interface,
+	// uuid and player for the ones created by the proxy
+	username string
+	uuid     string
+	player   string
+}
+
+type linkCodes struct {
+	codes map[string]linkCode
+	// pending are the redeemed codes shown by the proxy, by UUID,
+	// linked when a server authenticates the player
+	pending map[string]linkCode
+	m       sync.Mutex
+}
+
+// add stores a new code, replacing the previous one of the same user or player
+func (lc *linkCodes) add(code linkCode) linkCode {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+
+	if lc.codes == nil {
+		lc.codes = make(map[string]linkCode)
+	}
+
+	for key, other := range lc.codes {
+		expired := time.Now().After(other.Expires)
+		sameUser := code.username != "" && other.username == code.username
+		samePlayer := code.uuid != "" && other.uuid == code.uuid
+		if expired || sameUser || samePlayer {
+			delete(lc.codes, key)
+		}
+	}
+
+	for {
+		code.Code = newLinkCode()
+		if _, ok := lc.codes[code.Code]; !ok {
+			break
+		}
+	}
+	code.Expires = time.Now().Add(link_code_ttl)
+
+	lc.codes[code.Code] = code
+	return code
+}
+
+// take removes and returns the code, the codes can be used only once
+func (lc *linkCodes) take(code string) (linkCode, bool) {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	c, ok := lc.codes[code]
+	if !ok {
+		return c, false
+	}
+
+	delete(lc.codes, code)
+	return c, time.Now().Before(c.Expires)
+}
+
+// addPending keeps a redeemed code until the player joins a server
+func (lc *linkCodes) addPending(code linkCode) {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+
+	if lc.pending == nil {
+		lc.pending = make(map[string]linkCode)
+	}
+	code.Expires = time.Now().Add(link_code_ttl)
+	lc.pending[code.uuid] = code
+}
+
+// pendingFor returns the redeemed code waiting for the player with the UUID
+func (lc *linkCodes) pendingFor(uuid string) (linkCode, bool) {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+
+	c, ok := lc.pending[uuid]
+	return c, ok && time.Now().Before(c.Expires)
+}
+
+// takePending removes and returns the redeemed code of the UUID
+func (lc *linkCodes) takePending(uuid string) (linkCode, bool) {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+
+	c, ok := lc.pending[uuid]
+	if !ok {
+		return c, false
+	}
+
+	delete(lc.pending, uuid)
+	return c, time.Now().Before(c.Expires)
+}
+
+func newLinkCode() string {
+	b := make([]byte, link_code_length)
+	rand.Read(b)
+
+	for i := range b {
+		b[i] = link_code_alphabet[int(b[i])%len(link_code_alphabet)]
+	}
+	return string(b)
+}
+
+// isLinkCode tells whether a chat message looks like a link code,
+// the players can type it alone or after "link"
+func isLinkCode(message string) (string, bool) {
+	message = strings.TrimSpace(message)
+	message = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(message, "/"), "link "))
+	if len(message) != link_code_length {
+		return "", false
+	}
+
+	for _, r := range strings.ToUpper(message) {
+		if !strings.ContainsRune(link_code_alphabet, r) {
+			return "", false
+		}
+	}
+	return message, true
+}
+
+// verifyPlayer returns the web user of a joining player. A player whose
+// UUID is linked, or waiting for a link, is that user whatever name the
+// client sends, while the name of a linked user is refused with any other
+// UUID. The client chooses the UUID of the Login Start: the proxy records
+// it as a claim, which the server confirms when it authenticates the
+// player, see confirmPlayer
+func (msm *McServerManager) verifyPlayer(login loginStart) (string, error) {
+	if userName, claimed := msm.claimedUser(login); claimed {
+		return userName, nil
+	}
+
+	if account, ok := msm.accounts.Get(login.Name); ok && account.MinecraftUUID != "" {
+		return "", errUUIDMismatch
+	}
+
+	return login.Name, nil
+}
+
+// claimedUser returns the web user linked, or waiting for a link, to the
+// UUID sent by the client. claimed is false if the user doesn't depend
+// on the UUID
+func (msm *McServerManager) claimedUser(login loginStart) (userName string, claimed bool) {
+	if !login.HasUUID {
+		return "", false
+	}
+
+	uuid := login.UUID.String()
+	if account, ok := msm.accounts.ByMinecraftUUID(uuid); ok {
+		return account.Username, true
+	}
+	if c, ok := msm.links.pendingFor(uuid); ok {
+		return c.username, true
+	}
+	return "", false
+}
+
+// playerLinkCode returns a code for the web interface if the joining
+// player can be linked, that is if the client sent its UUID and the
+// UUID is not linked yet
+func (msm *McServerManager) playerLinkCode(login loginStart) (linkCode, bool) {
+	if !login.HasUUID {
+		return linkCode{}, false
+	}
+
+	uuid := login.UUID.String()
+	if _, linked := msm.accounts.ByMinecraftUUID(uuid); linked {
+		return linkCode{}, false
+	}
+
+	return msm.links.add(linkCode{uuid: uuid, player: login.Name}), true
+}
+
+// webLinkCode returns a code to be typed in the game chat by the user
+func (msm *McServerManager) webLinkCode(username string) linkCode {
+	return msm.links.add(linkCode{username: username})
+}
+
+// redeemPlayerLinkCode binds the user to the player who was shown the code.
+// The UUID was sent by the client, so the accounts are linked only when
+// the player joins a server which authenticates the same UUID
+func (msm *McServerManager) redeemPlayerLinkCode(username string, code string) (linkCode, error) {
+	c, ok := msm.links.take(code)
+	if !ok || c.uuid == "" {
+		return c, errInvalidLinkCode
+	}
+
+	c.username = username
+	msm.links.addPending(c)
+	return c, nil
+}
+
+func (msm *McServerManager) linkAccount(username string, uuid string, player string) error {
+	err := msm.accounts.Link(username, uuid, player)
+	if err != nil {
+		return err
+	}
+
+	msm.publish(EVENT_ACCOUNT_LINKED, "", username, player)
+
+	msm.mutex.RLock()
+	user, ok := msm.users[username]
+	msm.mutex.RUnlock()
+	if ok {
+		user.SignalStateUpdate()
+	}
+
+	return nil
+}
+
+// handleLinkCode links the player who typed in the chat a code shown
+// in the web interface. It reports whether the message was a code
+func (srv *McServer) handleLinkCode(ev GameEvent) bool {
+	code, ok := isLinkCode(ev.Message)
+	if !ok {
+		return false
+	}
+
+	c, ok := srv.msm.links.take(code)
+	if !ok || c.username == "" {
+		return false
+	}
+
+	srv.eventsM.Lock()
+	uuid := srv.playerUUIDs[ev.Player]
+	srv.eventsM.Unlock()
+
+	if uuid == "" {
+		srv.tellPlayer(ev.Player, "Unable to link your account: your UUID is unknown, rejoin and retry", "red")
+		return true
+	}
+
+	err := srv.msm.linkAccount(c.username, uuid, ev.Player)
+	if err != nil {
+		srv.msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error linking player %s to user %s: %v", ev.Player, c.username, err)
+		srv.tellPlayer(ev.Player, "Unable to link your account: "+err.Error(), "red")
+		return true
+	}
+
+	srv.msm.Logger.Printf(logger.LOG_LEVEL_INFO, "Player %s (%s) linked to user %s", ev.Player, uuid, c.username)
+	srv.tellPlayer(ev.Player, fmt.Sprintf("Your Minecraft account is now linked to the Nixcraft user %s", c.username), "green")
+	return true
+}
+
+// playerClaim is the UUID sent by a proxied player whose web user
+// depends on it, waiting for the server to authenticate the player
+type playerClaim struct {
+	uuid string
+	conn net.Conn
+}
+
+// expectPlayer records the UUID claimed by a player joining through the proxy
+func (srv *McServer) expectPlayer(player string, uuid string, conn net.Conn) {
+	srv.eventsM.Lock()
+	defer srv.eventsM.Unlock()
+
+	if srv.claims == nil {
+		srv.claims = make(map[string]playerClaim)
+	}
+	srv.claims[player] = playerClaim{uuid: uuid, conn: conn}
+}
+
+// takeClaim removes and returns the claim of a player
+func (srv *McServer) takeClaim(player string) (playerClaim, bool) {
+	srv.eventsM.Lock()
+	defer srv.eventsM.Unlock()
+
+	claim, ok := srv.claims[player]
+	delete(srv.claims, player)
+	return claim, ok
+}
+
+// confirmPlayer checks the UUID claimed by a joining player against the
+// one authenticated by the server. A player claiming another UUID is
+// disconnected, otherwise the link waiting for the player is made
+func (srv *McServer) confirmPlayer(player string, uuid string) {
+	claim, ok := srv.takeClaim(player)
+	if !ok {
+		return
+	}
+
+	if !strings.EqualFold(claim.uuid, uuid) {
+		srv.msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Server %s: player %s claimed the UUID %s but was authenticated as %q", srv.Name, player, claim.uuid, uuid)
+		srv.SendInput(fmt.Sprintf("/kick %s %s", player, srv.msm.formatMessage(srv.msm.config.MessageUUIDMismatch, srv, player)))
+		claim.conn.Close()
+		return
+	}
+
+	c, ok := srv.msm.links.takePending(claim.uuid)
+	if !ok {
+		return
+	}
+
+	err := srv.msm.linkAccount(c.username, uuid, player)
+	if err != nil {
+		srv.msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error linking player %s to user %s: %v", player, c.username, err)
+		srv.tellPlayer(player, "Unable to link your account: "+err.Error(), "red")
+		return
+	}
+
+	srv.msm.Logger.Printf(logger.LOG_LEVEL_INFO, "Player %s (%s) linked to user %s", player, uuid, c.username)
+	srv.tellPlayer(player, fmt.Sprintf("Your Minecraft account is now linked to the Nixcraft user %s", c.username), "green")
+}
+
+// tellPlayer sends a private message to a player
+func (srv *McServer) tellPlayer(player string, text string, color string) {
+	component, _ := json.Marshal(chatComponent{Text: text, Color: color})
+	srv.SendInput(fmt.Sprintf("/tellraw %s %s", player, component))
+}
@@ -0,0 +1,67 @@
+package craft
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConfirmPlayer(t *testing.T) {
+	srv, _ := newFakeServer(t, `{"launcher": "fake", "disable_rcon": true}`)
+	msm := srv.msm
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	notch := mcUUID{0x06, 0x9a, 0x79, 0xf4, 0x44, 0xe9, 0x47, 0x26, 0xa5, 0xbe, 0xfc, 0xa9, 0x0e, 0x38, 0xaa, 0xf5}
+	login := loginStart{Name: "Notch", UUID: notch, HasUUID: true}
+	msm.accounts.Add("alice", "password", ROLE_PLAYER)
+
+	// The code shown by the proxy binds nothing until the server confirms
+	code, ok := msm.playerLinkCode(login)
+	if !ok {
+		t.Fatal("no link code for an unknown player")
+	}
+	_, err = msm.redeemPlayerLinkCode("alice", code.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, linked := msm.accounts.ByMinecraftUUID(notch.String()); linked {
+		t.Fatal("linked before the server authenticated the player")
+	}
+	if userName, err := msm.verifyPlayer(login); err != nil || userName != "alice" {
+		t.Fatalf("got user %q, %v", userName, err)
+	}
+
+	// Another player sending the same UUID
+	conn, other := net.Pipe()
+	defer other.Close()
+	srv.expectPlayer("Notch", notch.String(), conn)
+	srv.confirmPlayer("Notch", mcUUID{1}.String())
+
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = other.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("player claiming another UUID not disconnected: %v", err)
+	}
+	if _, linked := msm.accounts.ByMinecraftUUID(notch.String()); linked {
+		t.Fatal("linked to a player claiming another UUID")
+	}
+
+	// The player who was shown the code
+	conn, other = net.Pipe()
+	defer other.Close()
+	srv.expectPlayer("Notch", notch.String(), conn)
+	srv.confirmPlayer("Notch", notch.String())
+
+	account, linked := msm.accounts.ByMinecraftUUID(notch.String())
+	if !linked || account.Username != "alice" {
+		t.Fatalf("got account %+v", account)
+	}
+	if _, ok := srv.takeClaim("Notch"); ok {
+		t.Fatal("claim not removed")
+	}
+}
@@ -0,0 +1,550 @@
+package craft
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+const (
+	log_archive_dir     = "nixcraft-logs"
+	log_archive_current = "console.log"
+	log_archive_prefix  = "console-"
+	log_archive_time    = "2006-01-02T15-04-05.000"
+	log_listener_buffer = 100
+	max_log_line_length = 1024 * 1024
+
+	// console_history_lines are the lines of the previous sessions sent
+	// by the console websocket, unless the client asks for a different number
+	console_history_lines     = 200
+	max_console_history_lines = 5000
+	// log_scan_window are the lines kept in memory while reading
+	// a file backward
+	log_scan_window = 1000
+)
+
+// LogLine is a line of the console of a server, as archived on disk and
+// sent to the web console. The fields are the ones of the logger JSON,
+// plus the session: the start time of the server process
+type LogLine struct {
+	ID      string   `json:"id"`
+	Level   string   `json:"level"`
+	Date    string   `json:"date"`
+	Message string   `json:"message"`
+	Extra   string   `json:"extra"`
+	Tags    []string `json:"tags,omitempty"`
+	Session int64    `json:"session"`
+}
+
+func newLogLine(l logger.Log, session int64) (LogLine, error) {
+	var raw struct {
+		ID      json.RawMessage `json:"id"`
+		Level   string          `json:"level"`
+		Date    string          `json:"date"`
+		Message string          `json:"message"`
+		Extra   string          `json:"extra"`
+		Tags    []string        `json:"tags"`
+	}
+	err := json.Unmarshal(l.JSON(), &raw)
+	if err != nil {
+		return LogLine{}, err
+	}
+
+	// The ids restart with every session, the session makes them unique
+	id := strings.Trim(string(raw.ID), `"`)
+
+	return LogLine{
+		ID:      fmt.Sprintf("%d-%s", session, id),
+		Level:   raw.Level,
+		Date:    raw.Date,
+		Message: raw.Message,
+		Extra:   raw.Extra,
+		Tags:    raw.Tags,
+		Session: session,
+	}, nil
+}
+
+// logArchive writes the console of a server to disk, one JSON line per log.
+// The file is rotated when it reaches the maximum size: the old one is
+// compressed with gzip, and the archives too old or too many are deleted
+type logArchive struct {
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	file *os.File
+	size int64
+	m    sync.Mutex
+	// compressions are the rotated files still being compressed
+	compressions sync.WaitGroup
+	// tail are the last lines written, loaded from the files the first
+	// time they are needed: the console backlog is served from memory
+	tail       ring[LogLine]
+	tailLoaded bool
+	// ranges are the times of the rotated files already searched
+	ranges map[string]logFileRange
+}
+
+func newLogArchive(dir string, cfg Config) *logArchive {
+	return &logArchive{
+		dir:      dir,
+		maxSize:  int64(cfg.LogMaxSizeMB) * 1024 * 1024,
+		maxAge:   time.Duration(cfg.LogMaxAgeDays) * time.Hour * 24,
+		maxFiles: cfg.LogMaxFiles,
+		tail:     ring[LogLine]{size: max_console_history_lines},
+	}
+}
+
+// record writes the logs of a server session until the logger is closed
+func (a *logArchive) record(ch <-chan logger.Log, session int64, errLog *logger.Logger) {
+	for l := range ch {
+		line, err := newLogLine(l, session)
+		if err == nil {
+			err = a.write(line)
+		}
+		if err != nil {
+			errLog.Printf(logger.LOG_LEVEL_ERROR, "Error archiving the console: %v", err)
+		}
+	}
+}
+
+func (a *logArchive) write(line LogLine) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.file == nil {
+		err = a.openNoLock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		err = a.rotateNoLock()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if a.tailLoaded {
+		a.tail.push(line)
+	}
+	return nil
+}
+
+func (a *logArchive) openNoLock() error {
+	err := os.MkdirAll(a.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	a.file, err = os.OpenFile(filepath.Join(a.dir, log_archive_current), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := a.file.Stat()
+	if err != nil {
+		a.file.Close()
+		a.file = nil
+		return err
+	}
+	a.size = info.Size()
+
+	a.cleanupNoLock()
+	return nil
+}
+
+// rotateNoLock renames the current file with the time of the rotation
+// and compresses it in the background
+func (a *logArchive) rotateNoLock() error {
+	a.file.Close()
+	a.file = nil
+
+	// The names must be unique and sort by age, with quick
+	// rotations the time is moved forward to a free name
+	var rotated string
+	for t := time.Now(); ; t = t.Add(time.Millisecond) {
+		rotated = filepath.Join(a.dir, log_archive_prefix+t.Format(log_archive_time)+".log")
+		if !fileExists(rotated) && !fileExists(rotated+".gz") {
+			break
+		}
+	}
+
+	err := os.Rename(filepath.Join(a.dir, log_archive_current), rotated)
+	if err != nil {
+		return err
+	}
+
+	a.compressions.Add(1)
+	go func() {
+		defer a.compressions.Done()
+		if compressLogFile(rotated) == nil {
+			a.m.Lock()
+			a.cleanupNoLock()
+			a.m.Unlock()
+		}
+	}()
+
+	return a.openNoLock()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func compressLogFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(out.Name(), path+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// archivesNoLock returns the rotated files from the oldest, the
+// names start with the time of the rotation so they sort by age
+func (a *logArchive) archivesNoLock() []string {
+	entries, _ := os.ReadDir(a.dir)
+
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, log_archive_prefix) {
+			continue
+		}
+
+		// Just compressed, the uncompressed file is about to be removed
+		compressed := strings.HasSuffix(name, ".log") && names[name+".gz"]
+		if (strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz")) && !compressed {
+			files = append(files, filepath.Join(a.dir, name))
+		}
+	}
+
+	slices.Sort(files)
+	return files
+}
+
+// cleanupNoLock deletes the archives older than the maximum age
+// and the oldest ones above the maximum number of files
+func (a *logArchive) cleanupNoLock() {
+	files := a.archivesNoLock()
+
+	for i, file := range files {
+		tooMany := a.maxFiles > 0 && len(files)-i > a.maxFiles
+		tooOld := false
+		if info, err := os.Stat(file); err == nil && a.maxAge > 0 {
+			tooOld = time.Since(info.ModTime()) > a.maxAge
+		}
+
+		// The uncompressed files are still being compressed
+		if (tooMany || tooOld) && strings.HasSuffix(file, ".gz") {
+			os.Remove(file)
+			delete(a.ranges, logRangeKey(file))
+		}
+	}
+}
+
+// history returns the last n lines written before the given session,
+// n <= 0 returns all of them
+func (a *logArchive) history(beforeSession int64, n int) ([]LogLine, error) {
+	var lines []LogLine
+	a.scanBackward(func(line LogLine) bool {
+		if beforeSession != 0 && line.Session >= beforeSession {
+			return true
+		}
+
+		lines = append(lines, line)
+		return n <= 0 || len(lines) < n
+	})
+
+	slices.Reverse(lines)
+	return lines, nil
+}
+
+// scanBackward calls fn for the archived lines from the newest, until
+// fn returns false. The lines in the tail are read from memory, the older
+// ones from the files without keeping them whole in memory. The files
+// that can't be read are skipped
+func (a *logArchive) scanBackward(fn func(line LogLine) bool) {
+	a.m.Lock()
+	a.loadTailNoLock()
+	tail := a.tail.slice()
+	archives := a.archivesNoLock()
+
+	// The lines written from now on are not read from the current file,
+	// otherwise they would shift the ones already in the tail
+	current, err := os.Open(filepath.Join(a.dir, log_archive_current))
+	size := a.size
+	if err == nil && a.file == nil {
+		if info, err := current.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	a.m.Unlock()
+
+	for i := len(tail) - 1; i >= 0; i-- {
+		if !fn(tail[i]) {
+			if current != nil {
+				current.Close()
+			}
+			return
+		}
+	}
+
+	var sources []logSource
+	for _, file := range archives {
+		sources = append(sources, fileLogSource(file))
+	}
+	if current != nil {
+		defer current.Close()
+		sources = append(sources, func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(current, 0, size)), nil
+		})
+	}
+
+	skip := len(tail)
+	for i := len(sources) - 1; i >= 0; i-- {
+		var ok bool
+		skip, ok, err = scanLinesBackward(sources[i], skip, fn)
+		if err == nil && !ok {
+			return
+		}
+	}
+}
+
+// loadTailNoLock fills the tail with the last lines of the files
+func (a *logArchive) loadTailNoLock() {
+	if a.tailLoaded {
+		return
+	}
+	a.tailLoaded = true
+
+	files := append(a.archivesNoLock(), filepath.Join(a.dir, log_archive_current))
+	var lines []LogLine
+	for i := len(files) - 1; i >= 0 && len(lines) < a.tail.size; i-- {
+		scanLinesBackward(fileLogSource(files[i]), 0, func(line LogLine) bool {
+			lines = append(lines, line)
+			return len(lines) < a.tail.size
+		})
+	}
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		a.tail.push(lines[i])
+	}
+}
+
+// empty tells whether nothing was archived yet
+func (a *logArchive) empty() bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if len(a.archivesNoLock()) != 0 {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(a.dir, log_archive_current))
+	return err != nil || info.Size() == 0
+}
+
+// logSource opens a log file for reading, every call from the start
+type logSource func() (io.ReadCloser, error)
+
+// fileLogSource reads an archive file, compressed or not
+func fileLogSource(path string) logSource {
+	return func() (io.ReadCloser, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(path, ".gz") {
+			return f, nil
+		}
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return gzipFile{gz, f}, nil
+	}
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// scanLogFile calls fn for every line of an archive file, compressed or
+// not, until fn returns false. The truncated or invalid lines are skipped
+func scanLogFile(path string, fn func(line LogLine) bool) error {
+	return scanLogSource(fileLogSource(path), fn)
+}
+
+func scanLogSource(open logSource, fn func(line LogLine) bool) error {
+	rd, err := open()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(nil, max_log_line_length)
+
+	for sc.Scan() {
+		var line LogLine
+		if json.Unmarshal(sc.Bytes(), &line) != nil {
+			continue
+		}
+		if !fn(line) {
+			return nil
+		}
+	}
+
+	return sc.Err()
+}
+
+// scanLinesBackward calls fn for the lines of a source from the last,
+// after skipping the last skip ones, until fn returns false. The lines
+// are counted first, then read forward log_scan_window at a time, each
+// window with a new pass over the source. It returns the lines still
+// to skip and whether fn wants more lines
+func scanLinesBackward(open logSource, skip int, fn func(line LogLine) bool) (int, bool, error) {
+	total := 0
+	err := scanLogSource(open, func(LogLine) bool {
+		total++
+		return true
+	})
+	if err != nil {
+		return skip, true, err
+	}
+	if total <= skip {
+		return skip - total, true, nil
+	}
+
+	window := make([]LogLine, 0, min(total-skip, log_scan_window))
+	for end := total - skip; end > 0; {
+		start := max(end-log_scan_window, 0)
+
+		window = window[:0]
+		i := 0
+		err = scanLogSource(open, func(line LogLine) bool {
+			if i >= start {
+				window = append(window, line)
+			}
+			i++
+			return i < end
+		})
+		if err != nil {
+			return 0, true, err
+		}
+
+		for j := len(window) - 1; j >= 0; j-- {
+			if !fn(window[j]) {
+				return 0, false, nil
+			}
+		}
+		end = start
+	}
+
+	return 0, true, nil
+}
+
+// ring keeps the last size values pushed
+type ring[T any] struct {
+	values []T
+	size   int
+	start  int
+}
+
+// push adds v, dropping the oldest value when full
+func (r *ring[T]) push(v T) {
+	if len(r.values) < r.size {
+		r.values = append(r.values, v)
+		return
+	}
+	if r.size == 0 {
+		return
+	}
+
+	r.values[r.start] = v
+	r.start = (r.start + 1) % r.size
+}
+
+// slice returns a copy of the values, from the oldest
+func (r *ring[T]) slice() []T {
+	return append(slices.Clone(r.values[r.start:]), r.values[:r.start]...)
+}
+
+// Close closes the current file, waiting for the pending compressions
+func (a *logArchive) Close() error {
+	a.m.Lock()
+	var err error
+	if a.file != nil {
+		err = a.file.Close()
+		a.file = nil
+	}
+	a.m.Unlock()
+
+	a.compressions.Wait()
+	return err
+}
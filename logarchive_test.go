@@ -0,0 +1,78 @@
+package craft
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestLogArchiveScanBackward(t *testing.T) {
+	// Not t.TempDir, the rotated files may still be compressing
+	dir, err := os.MkdirTemp("", "nixcraft-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.LogMaxFiles = 0
+	cfg.LogMaxAgeDays = 0
+
+	const n = 2500
+	a := newLogArchive(dir, cfg)
+	a.maxSize = 64 * 1024
+	a.tail.size = 100
+	for i := range n {
+		err = a.write(LogLine{ID: fmt.Sprint(i), Message: "line", Session: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.compressions.Wait()
+
+	check := func(name string, a *logArchive) {
+		want := n - 1
+		a.scanBackward(func(line LogLine) bool {
+			if line.ID != fmt.Sprint(want) {
+				t.Fatalf("%s: got line %s, want %d", name, line.ID, want)
+			}
+			want--
+			return true
+		})
+		if want != -1 {
+			t.Fatalf("%s: stopped at line %d", name, want)
+		}
+	}
+
+	// Loaded from the files
+	check("first scan", a)
+
+	// Filled by the writes
+	for i := n; i < n+10; i++ {
+		a.write(LogLine{ID: fmt.Sprint(i), Message: "line", Session: 1})
+	}
+	a.compressions.Wait()
+	const written = n + 10
+	want := written - 1
+	a.scanBackward(func(line LogLine) bool {
+		if line.ID != fmt.Sprint(want) {
+			t.Fatalf("got line %s, want %d", line.ID, want)
+		}
+		want--
+		return want >= written-150
+	})
+	a.Close()
+
+	// A new archive on the same files
+	b := newLogArchive(dir, cfg)
+	b.tail.size = 100
+	defer b.Close()
+
+	history, err := b.history(0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 || history[0].ID != fmt.Sprint(written-5) || history[4].ID != fmt.Sprint(written-1) {
+		t.Fatalf("got history %+v", history)
+	}
+}
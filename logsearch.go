@@ -0,0 +1,338 @@
+package craft
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	log_search_limit     = 100
+	max_log_search_limit = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// LogQuery filters the archived console of a server, the zero
+// value of every field matches all the lines
+type LogQuery struct {
+	From time.Time
+	To   time.Time
+	// Levels and Tags match the lines with any of them
+	Levels []string
+	Tags   []string
+	// Text is searched in the message and the extra, ignoring the case
+	Text string
+	// Cursor is the Next of the previous page
+	Cursor string
+	Limit  int
+}
+
+// LogPage is a page of the search results from the oldest line.
+// The pages go back in time: Next is the cursor of the page with
+// the previous lines, empty on the last page
+type LogPage struct {
+	Lines []LogLine `json:"lines"`
+	Next  string    `json:"next,omitempty"`
+}
+
+// logPosition is the position of a line in the archive: its time in
+// nanoseconds and the index among the lines with the same time. It
+// doesn't depend on the files, so it doesn't change with the rotation
+// or when the oldest files are deleted
+type logPosition struct {
+	time  int64
+	index int
+}
+
+// next returns the position of the line at time t following p
+func (p logPosition) next(t time.Time) logPosition {
+	if t.UnixNano() == p.time {
+		return logPosition{time: p.time, index: p.index + 1}
+	}
+	return logPosition{time: t.UnixNano()}
+}
+
+func (p logPosition) String() string {
+	return fmt.Sprintf("%d.%d", p.time, p.index)
+}
+
+func (p logPosition) before(other logPosition) bool {
+	if p.time != other.time {
+		return p.time < other.time
+	}
+	return p.index < other.index
+}
+
+func parseLogPosition(cursor string) (logPosition, error) {
+	t, index, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return logPosition{}, errInvalidCursor
+	}
+
+	var p logPosition
+	var err1, err2 error
+	p.time, err1 = strconv.ParseInt(t, 10, 64)
+	p.index, err2 = strconv.Atoi(index)
+	if err1 != nil || err2 != nil || p.index < 0 {
+		return logPosition{}, errInvalidCursor
+	}
+	return p, nil
+}
+
+// parseLogQuery reads the query of the logs API: from, to, level, tag,
+// q, cursor and limit. Level and tag can be repeated or comma separated
+func parseLogQuery(values url.Values) (LogQuery, error) {
+	q := LogQuery{
+		Levels: splitQueryValues(values["level"]),
+		Tags:   splitQueryValues(values["tag"]),
+		Text:   values.Get("q"),
+		Cursor: values.Get("cursor"),
+	}
+
+	var err error
+	if from := values.Get("from"); from != "" {
+		q.From, err = parseLogTime(from)
+		if err != nil {
+			return q, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		q.To, err = parseLogTime(to)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+
+	return q, nil
+}
+
+func splitQueryValues(values []string) []string {
+	var split []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				split = append(split, v)
+			}
+		}
+	}
+	return split
+}
+
+// parseLogTime parses the bounds of a search: a date, a date and time or
+// a duration back from now, also in days (e.g. "7d")
+func parseLogTime(value string) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.DateTime, "2006-01-02T15:04:05", "2006-01-02 15:04", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q: use a date, a date and time or a duration like 24h or 7d", value)
+}
+
+// Time returns the time of the line, or the start of
+// its session if the date can't be parsed
+func (line LogLine) Time() time.Time {
+	t, err := time.Parse(time.RFC3339Nano, line.Date)
+	if err != nil {
+		return time.UnixMilli(line.Session)
+	}
+	return t
+}
+
+func (q LogQuery) match(line LogLine) bool {
+	if !q.From.IsZero() || !q.To.IsZero() {
+		t := line.Time()
+		if !q.From.IsZero() && t.Before(q.From) {
+			return false
+		}
+		if !q.To.IsZero() && t.After(q.To) {
+			return false
+		}
+	}
+
+	if len(q.Levels) != 0 && !slices.ContainsFunc(q.Levels, func(level string) bool {
+		return strings.EqualFold(level, line.Level)
+	}) {
+		return false
+	}
+
+	if len(q.Tags) != 0 && !slices.ContainsFunc(q.Tags, func(tag string) bool {
+		return slices.Contains(line.Tags, tag)
+	}) {
+		return false
+	}
+
+	if q.Text != "" {
+		text := strings.ToLower(q.Text)
+		if !strings.Contains(strings.ToLower(line.Message), text) &&
+			!strings.Contains(strings.ToLower(line.Extra), text) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logFileRange are the times of the oldest and newest line of a file
+type logFileRange struct {
+	first time.Time
+	last  time.Time
+}
+
+// logRangeKey is the key of a rotated file in the ranges, the same
+// before and after the compression
+func logRangeKey(path string) string {
+	return strings.TrimSuffix(path, ".gz")
+}
+
+// skips tells whether the lines of a file with the range r are all
+// outside the query, or not before the cursor
+func (q LogQuery) skips(r logFileRange, cursor *logPosition) bool {
+	if !q.From.IsZero() && r.last.Before(q.From) {
+		return true
+	}
+	if !q.To.IsZero() && r.first.After(q.To) {
+		return true
+	}
+	return cursor != nil && r.first.UnixNano() > cursor.time
+}
+
+// search returns the last lines matching the query, before the cursor
+// if given. The archive is scanned from the oldest file keeping only a
+// page of results, so that it doesn't need to fit in memory. The rotated
+// files don't change: their range is kept after the first scan, so the
+// next searches skip the ones outside the query
+func (a *logArchive) search(q LogQuery) (LogPage, error) {
+	var cursor *logPosition
+	if q.Cursor != "" {
+		p, err := parseLogPosition(q.Cursor)
+		if err != nil {
+			return LogPage{}, err
+		}
+		cursor = &p
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = log_search_limit
+	}
+	limit = min(limit, max_log_search_limit)
+
+	a.m.Lock()
+	archives := a.archivesNoLock()
+	ranges := make(map[string]logFileRange, len(archives))
+	for _, file := range archives {
+		if r, ok := a.ranges[logRangeKey(file)]; ok {
+			ranges[file] = r
+		}
+	}
+	a.m.Unlock()
+	files := append(archives, filepath.Join(a.dir, log_archive_current))
+
+	type result struct {
+		line LogLine
+		pos  logPosition
+	}
+	// One more than the limit tells whether there is a next page
+	results := ring[result]{size: limit + 1}
+	scanned := make(map[string]logFileRange)
+
+	var pos logPosition
+	for i, file := range files {
+		if r, ok := ranges[file]; ok && q.skips(r, cursor) {
+			continue
+		}
+
+		var r logFileRange
+		reached := false
+		err := scanLogFile(file, func(line LogLine) bool {
+			t := line.Time()
+			if r.first.IsZero() || t.Before(r.first) {
+				r.first = t
+			}
+			if t.After(r.last) {
+				r.last = t
+			}
+
+			pos = pos.next(t)
+			if cursor != nil && !pos.before(*cursor) {
+				reached = true
+				return false
+			}
+
+			if q.match(line) {
+				results.push(result{line, pos})
+			}
+			return true
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return LogPage{}, err
+		}
+		if reached {
+			break
+		}
+
+		_, indexed := ranges[file]
+		if i < len(archives) && !indexed {
+			scanned[file] = r
+		}
+	}
+
+	if len(scanned) != 0 {
+		a.m.Lock()
+		if a.ranges == nil {
+			a.ranges = make(map[string]logFileRange)
+		}
+		for file, r := range scanned {
+			// Not deleted in the meantime
+			if fileExists(file) {
+				a.ranges[logRangeKey(file)] = r
+			}
+		}
+		a.m.Unlock()
+	}
+
+	lines := results.slice()
+	var page LogPage
+	if len(lines) > limit {
+		lines = lines[1:]
+		page.Next = lines[0].pos.String()
+	}
+
+	page.Lines = make([]LogLine, 0, len(lines))
+	for _, r := range lines {
+		page.Lines = append(page.Lines, r.line)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,160 @@
+package craft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestArchive writes n lines to a new archive, rotated every few lines.
+// The lines are two per second, so the same time is shared by two lines
+func newTestArchive(t *testing.T, n int) (*logArchive, time.Time) {
+	t.Helper()
+
+	// Not t.TempDir, the rotated files may still be compressing
+	dir, err := os.MkdirTemp("", "nixcraft-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := DefaultConfig()
+	cfg.LogMaxFiles = 0
+	cfg.LogMaxAgeDays = 0
+
+	a := newLogArchive(dir, cfg)
+	a.maxSize = 1024
+	t.Cleanup(func() { a.Close() })
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range n {
+		err = a.write(LogLine{
+			ID:      fmt.Sprint(i),
+			Level:   "info",
+			Date:    start.Add(time.Second * time.Duration(i/2)).Format(time.RFC3339Nano),
+			Message: fmt.Sprintf("line %d", i),
+			Session: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.compressions.Wait()
+
+	return a, start
+}
+
+func checkLogPage(t *testing.T, page LogPage, from, to int) {
+	t.Helper()
+
+	if len(page.Lines) != to-from {
+		t.Fatalf("got %d lines, want %d", len(page.Lines), to-from)
+	}
+	for i, line := range page.Lines {
+		if line.ID != fmt.Sprint(from+i) {
+			t.Fatalf("got line %s, want %d", line.ID, from+i)
+		}
+	}
+}
+
+func TestLogSearchPaging(t *testing.T) {
+	a, _ := newTestArchive(t, 25)
+	if len(a.archivesNoLock()) < 2 {
+		t.Fatal("archive not rotated")
+	}
+
+	pages := []struct{ from, to int }{{15, 25}, {5, 15}, {0, 5}}
+
+	var cursor string
+	for i, want := range pages {
+		page, err := a.search(LogQuery{Cursor: cursor, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLogPage(t, page, want.from, want.to)
+
+		if last := i == len(pages)-1; last != (page.Next == "") {
+			t.Fatalf("page %d: got next %q", i, page.Next)
+		}
+		cursor = page.Next
+	}
+
+	_, err := a.search(LogQuery{Cursor: "invalid"})
+	if err != errInvalidCursor {
+		t.Fatalf("got error %v for an invalid cursor", err)
+	}
+}
+
+func TestLogSearchRetention(t *testing.T) {
+	a, _ := newTestArchive(t, 25)
+
+	page, err := a.search(LogQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest file is deleted before the next page
+	archives := a.archivesNoLock()
+	err = os.Remove(archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, err = a.search(LogQuery{Cursor: page.Next, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Lines) == 0 || page.Lines[len(page.Lines)-1].ID != "14" {
+		t.Fatalf("got page %+v", page.Lines)
+	}
+}
+
+func TestLogSearchTimeRange(t *testing.T) {
+	a, start := newTestArchive(t, 25)
+
+	q := LogQuery{From: start.Add(time.Second * 3), To: start.Add(time.Second * 5)}
+	for range 2 {
+		page, err := a.search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLogPage(t, page, 6, 12)
+	}
+
+	// The ranges of the rotated files are kept
+	a.m.Lock()
+	n := len(a.ranges)
+	a.m.Unlock()
+	if n != len(a.archivesNoLock()) {
+		t.Fatalf("got %d ranges for %d files", n, len(a.archivesNoLock()))
+	}
+
+	// Outside the range, the file is not read
+	for file, r := range a.ranges {
+		if r.last.Before(q.From) {
+			os.WriteFile(file+".gz", []byte("corrupted"), 0o644)
+		}
+	}
+	_, err := a.search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogSearchScanError(t *testing.T) {
+	a, _ := newTestArchive(t, 5)
+
+	f, err := os.OpenFile(filepath.Join(a.dir, log_archive_current), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, max_log_line_length+1))
+	f.Close()
+
+	_, err = a.search(LogQuery{})
+	if err == nil {
+		t.Fatal("line too long not reported")
+	}
+}
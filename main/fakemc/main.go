@@ -0,0 +1,223 @@
+// Command fakemc is a fake Minecraft server for developing and demoing
+// Nixcraft without a JVM. It answers the status and login requests on
+// --port, prints vanilla log lines and accepts the list, say, save-all and
+// stop console commands, plus join, leave, chat and crash to simulate
+// players and failures.
+//
+// Use it as the launcher of a server, in its nixcraft.json:
+//
+//	{ "launcher": "/path/to/fakemc", "args": ["--boot", "5s"] }
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	port       = flag.Int("port", 25565, "port to listen on")
+	bootTime   = flag.Duration("boot", time.Second*3, "time taken to prepare the spawn area")
+	crashAfter = flag.Duration("crash-after", 0, "crash after this time from the start, 0 to never crash")
+	motd       = flag.String("motd", "A fake Minecraft server", "message of the day")
+	maxPlayers = flag.Int("max-players", 20, "maximum number of players")
+)
+
+type fakeServer struct {
+	players  []string
+	entityID int
+	m        sync.Mutex
+
+	ln       net.Listener
+	outM     sync.Mutex
+	stopOnce sync.Once
+}
+
+func main() {
+	parseFlags()
+
+	srv := new(fakeServer)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		srv.stop()
+	}()
+
+	srv.log("Starting minecraft server version " + version_name)
+	srv.log("Loading properties")
+	srv.log("Default game type: SURVIVAL")
+	srv.log(fmt.Sprintf("Starting Minecraft server on *:%d", *port))
+
+	var err error
+	srv.ln, err = net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		srv.logLevel("WARN", "**** FAILED TO BIND TO PORT!")
+		srv.logLevel("WARN", "The exception was: "+err.Error())
+		os.Exit(1)
+	}
+	go srv.serve()
+
+	if *crashAfter > 0 {
+		time.AfterFunc(*crashAfter, func() {
+			srv.crash(1)
+		})
+	}
+
+	srv.log(`Preparing level "world"`)
+	start := time.Now()
+	for progress := 0; progress < 100; progress += 10 {
+		srv.log(fmt.Sprintf("Preparing spawn area: %d%%", progress))
+		time.Sleep(*bootTime / 10)
+	}
+	srv.log(fmt.Sprintf(`Done (%.3fs)! For help, type "help"`, time.Since(start).Seconds()))
+
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		srv.handleCommand(sc.Text())
+	}
+
+	// stdin was closed
+	srv.stop()
+}
+
+// parseFlags parses the flags also after the "nogui" argument,
+// which Nixcraft passes before the arguments of the manifest
+func parseFlags() {
+	flag.Parse()
+	for flag.NArg() > 0 {
+		if flag.Arg(0) != "nogui" {
+			fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flag.Arg(0))
+			os.Exit(2)
+		}
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+}
+
+func (srv *fakeServer) handleCommand(line string) {
+	cmd, args, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "/"), " ")
+
+	switch cmd {
+	case "":
+	case "help":
+		srv.log("/list, /say <message>, /save-all, /stop")
+		srv.log("Simulation: /join <player>, /leave <player>, /chat <player> <message>, /crash [exit code]")
+	case "list":
+		srv.m.Lock()
+		players := slices.Clone(srv.players)
+		srv.m.Unlock()
+
+		srv.log(fmt.Sprintf(
+			"There are %d of a max of %d players online: %s",
+			len(players), *maxPlayers, strings.Join(players, ", "),
+		))
+	case "say":
+		srv.log("[Server] " + args)
+	case "save-all":
+		srv.log("Saving the game (this may take a moment!)")
+		srv.log("Saved the game")
+	case "stop":
+		srv.stop()
+	case "join":
+		srv.join(args, "")
+	case "leave":
+		srv.leave(args, "Disconnected")
+	case "chat":
+		player, message, _ := strings.Cut(args, " ")
+		srv.log(fmt.Sprintf("<%s> %s", player, message))
+	case "crash":
+		code, err := strconv.Atoi(args)
+		if err != nil {
+			code = 1
+		}
+		srv.crash(code)
+	case "title", "tellraw":
+	default:
+		srv.log("Unknown or incomplete command, see below for error")
+		srv.log(line + "<--[HERE]")
+	}
+}
+
+// join prints the lines of a player joining, addr is
+// made up for the players simulated from the console
+func (srv *fakeServer) join(player string, addr string) {
+	srv.m.Lock()
+	srv.players = append(srv.players, player)
+	srv.entityID++
+	entityID := srv.entityID
+	srv.m.Unlock()
+
+	if addr == "" {
+		addr = "127.0.0.1:" + strconv.Itoa(50000+entityID)
+	}
+
+	srv.logThread("User Authenticator #1", "INFO", fmt.Sprintf("UUID of player %s is %s", player, uuidString(offlineUUID(player))))
+	srv.log(fmt.Sprintf("%s[/%s] logged in with entity id %d at (0.5, 64.0, 0.5)", player, addr, entityID))
+	srv.log(player + " joined the game")
+}
+
+func (srv *fakeServer) leave(player string, reason string) {
+	srv.m.Lock()
+	i := slices.Index(srv.players, player)
+	if i != -1 {
+		srv.players = slices.Delete(srv.players, i, i+1)
+	}
+	srv.m.Unlock()
+
+	if i == -1 {
+		return
+	}
+
+	srv.log(fmt.Sprintf("%s lost connection: %s", player, reason))
+	srv.log(player + " left the game")
+}
+
+func (srv *fakeServer) stop() {
+	srv.stopOnce.Do(func() {
+		srv.log("Stopping the server")
+		srv.log("Stopping server")
+		srv.log("Saving players")
+		srv.log("Saving worlds")
+		srv.log("Saving chunks for level 'ServerLevel[world]'/minecraft:overworld")
+		srv.log("ThreadedAnvilChunkStorage (world): All chunks are saved")
+		srv.ln.Close()
+		os.Exit(0)
+	})
+}
+
+func (srv *fakeServer) crash(exitCode int) {
+	srv.logLevel("ERROR", "Encountered an unexpected exception")
+
+	srv.outM.Lock()
+	fmt.Fprintln(os.Stderr, `Exception in thread "Server thread" java.lang.IllegalStateException: Fake crash`)
+	fmt.Fprintln(os.Stderr, "\tat net.minecraft.server.MinecraftServer.runServer(MinecraftServer.java:700)")
+	fmt.Fprintln(os.Stderr, "\tat java.base/java.lang.Thread.run(Thread.java:1583)")
+	srv.outM.Unlock()
+
+	os.Exit(exitCode)
+}
+
+func (srv *fakeServer) log(message string) {
+	srv.logThread("Server thread", "INFO", message)
+}
+
+func (srv *fakeServer) logLevel(level string, message string) {
+	srv.logThread("Server thread", level, message)
+}
+
+func (srv *fakeServer) logThread(thread string, level string, message string) {
+	srv.outM.Lock()
+	defer srv.outM.Unlock()
+
+	fmt.Printf("[%s] [%s/%s]: %s\n", time.Now().Format(time.TimeOnly), thread, level, message)
+}
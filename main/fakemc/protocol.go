@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	version_name     = "1.21"
+	protocol_version = 767
+
+	max_packet_length = 2097151
+	max_string_length = 32767
+
+	handshake_packet_id          = 0x00
+	status_request_packet_id     = 0x00
+	status_response_packet_id    = 0x00
+	ping_request_packet_id       = 0x01
+	pong_response_packet_id      = 0x01
+	login_start_packet_id        = 0x00
+	login_disconnect_packet_id   = 0x00
+	login_success_packet_id      = 0x02
+	login_acknowledged_packet_id = 0x03
+	config_keep_alive_packet_id  = 0x04
+
+	keep_alive_every = time.Second * 10
+)
+
+// serve accepts the client connections until the listener is closed
+func (srv *fakeServer) serve() {
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			err := srv.handleConn(conn)
+			if err != nil && !errors.Is(err, io.EOF) {
+				srv.logLevel("WARN", fmt.Sprintf("Connection from %s: %v", conn.RemoteAddr(), err))
+			}
+		}()
+	}
+}
+
+func (srv *fakeServer) handleConn(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+	rd := bufio.NewReader(conn)
+
+	id, data, err := readPacket(rd)
+	if err != nil {
+		return err
+	}
+	if id != handshake_packet_id {
+		return fmt.Errorf("unexpected packet id 0x%02X for handshake", id)
+	}
+
+	hs := bytes.NewReader(data)
+	protocol, _ := readVarInt(hs)
+	readString(hs)
+	hs.Seek(2, io.SeekCurrent)
+	nextState, err := readVarInt(hs)
+	if err != nil {
+		return fmt.Errorf("invalid handshake: %w", err)
+	}
+
+	switch nextState {
+	case 1:
+		return srv.handleStatus(conn, rd)
+	case 2, 3:
+		return srv.handleLogin(conn, rd, protocol)
+	default:
+		return fmt.Errorf("invalid next state %d", nextState)
+	}
+}
+
+func (srv *fakeServer) handleStatus(conn net.Conn, rd *bufio.Reader) error {
+	id, _, err := readPacket(rd)
+	if err != nil {
+		return err
+	}
+	if id != status_request_packet_id {
+		return fmt.Errorf("unexpected packet id 0x%02X for status request", id)
+	}
+
+	srv.m.Lock()
+	sample := make([]map[string]string, 0, len(srv.players))
+	for _, player := range srv.players {
+		sample = append(sample, map[string]string{"name": player, "id": uuidString(offlineUUID(player))})
+	}
+	srv.m.Unlock()
+
+	status, _ := json.Marshal(map[string]any{
+		"version":     map[string]any{"name": version_name, "protocol": protocol_version},
+		"players":     map[string]any{"max": *maxPlayers, "online": len(sample), "sample": sample},
+		"description": map[string]any{"text": *motd},
+	})
+
+	err = writePacket(conn, status_response_packet_id, appendString(nil, string(status)))
+	if err != nil {
+		return err
+	}
+
+	id, data, err := readPacket(rd)
+	if err != nil || id != ping_request_packet_id {
+		return nil
+	}
+
+	return writePacket(conn, pong_response_packet_id, data)
+}
+
+// handleLogin logs the player in with an offline mode UUID and keeps the
+// connection in the configuration state, as the fake server has no world.
+// Only clients of the same version are accepted, like a real server
+func (srv *fakeServer) handleLogin(conn net.Conn, rd *bufio.Reader, protocol int32) error {
+	id, data, err := readPacket(rd)
+	if err != nil {
+		return err
+	}
+	if id != login_start_packet_id {
+		return fmt.Errorf("unexpected packet id 0x%02X for login start", id)
+	}
+
+	player, err := readString(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid login start: %w", err)
+	}
+
+	if protocol != protocol_version {
+		reason, _ := json.Marshal(map[string]string{"text": "Outdated client! Please use " + version_name})
+		return writePacket(conn, login_disconnect_packet_id, appendString(nil, string(reason)))
+	}
+
+	uuid := offlineUUID(player)
+	success := append(uuid[:], appendString(nil, player)...)
+	success = appendVarInt(success, 0)
+	success = append(success, 0)
+
+	err = writePacket(conn, login_success_packet_id, success)
+	if err != nil {
+		return err
+	}
+
+	id, _, err = readPacket(rd)
+	if err != nil {
+		return err
+	}
+	if id != login_acknowledged_packet_id {
+		return fmt.Errorf("unexpected packet id 0x%02X for login acknowledged", id)
+	}
+
+	srv.join(player, conn.RemoteAddr().String())
+	reason := "Disconnected"
+	defer func() { srv.leave(player, reason) }()
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			_, _, err := readPacket(rd)
+			if err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(keep_alive_every)
+	defer ticker.Stop()
+
+	for {
+		conn.SetDeadline(time.Now().Add(keep_alive_every * 3))
+
+		select {
+		case <-ticker.C:
+			err = writePacket(conn, config_keep_alive_packet_id, binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixMilli())))
+			if err != nil {
+				reason = "Timed out"
+				return nil
+			}
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+// offlineUUID returns the UUID given by offline mode servers to a player
+func offlineUUID(player string) [16]byte {
+	uuid := md5.Sum([]byte("OfflinePlayer:" + player))
+	uuid[6] = uuid[6]&0x0F | 0x30
+	uuid[8] = uuid[8]&0x3F | 0x80
+	return uuid
+}
+
+func uuidString(uuid [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+func readPacket(rd *bufio.Reader) (int32, []byte, error) {
+	length, err := readVarInt(rd)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length <= 0 || length > max_packet_length {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	raw := make([]byte, length)
+	_, err = io.ReadFull(rd, raw)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	body := bytes.NewReader(raw)
+	id, err := readVarInt(body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, raw[len(raw)-body.Len():], nil
+}
+
+func writePacket(w io.Writer, id int32, data []byte) error {
+	body := append(appendVarInt(nil, id), data...)
+	_, err := w.Write(append(appendVarInt(nil, int32(len(body))), body...))
+	return err
+}
+
+func readVarInt(rd io.ByteReader) (int32, error) {
+	var value uint32
+	for i := 0; i < 5; i++ {
+		b, err := rd.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		value |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(value), nil
+		}
+	}
+
+	return 0, errors.New("varint too big")
+}
+
+func appendVarInt(b []byte, value int32) []byte {
+	v := uint32(value)
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func readString(rd *bytes.Reader) (string, error) {
+	length, err := readVarInt(rd)
+	if err != nil {
+		return "", err
+	}
+	if length < 0 || length > max_string_length*4 || int(length) > rd.Len() {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+
+	b := make([]byte, length)
+	rd.Read(b)
+	return string(b), nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendVarInt(b, int32(len(s)))
+	return append(b, s...)
+}
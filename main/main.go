@@ -2,17 +2,25 @@ package main
 
 import (
 	"craft"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 
 	"github.com/nixpare/server/v3"
-	"github.com/nixpare/server/v3/commands"
 )
 
 var requiredCTRLC int
 
 func main() {
+	configPath := flag.String("config", "nixcraft.json", "path to the Nixcraft JSON config file")
+	flag.Parse()
+
+	cfg, err := craft.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	router := server.NewRouter(nil)
 
 	srv, err := router.NewHTTPServer("", 8080)
@@ -26,11 +34,16 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	err = craft.CraftInit(router, []*commands.CommandServer{cmdServer})
+	nc, err := craft.New(
+		craft.ConfigOption(cfg),
+		craft.RouterOption(router),
+		craft.CommandServersOption(cmdServer),
+	)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	srv.Handler = craft.Nixcraft()
+	srv.Handler = nc
+	defer nc.Close()
 
 	router.Start()
 	defer router.Stop()
@@ -0,0 +1,275 @@
+package craft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const server_manifest_name = "nixcraft.json"
+
+// ServerManifest describes how a Minecraft server is launched. It is read
+// from the optional nixcraft.json file inside each server directory, every
+// missing key falls back to the default java command line
+type ServerManifest struct {
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	// Hostnames are the addresses that route players to this server when
+	// the proxy uses hostname routing. A leading "*." matches any subdomain
+	// and a single "*" matches every address not claimed by another server
+	Hostnames []string `json:"hostnames"`
+	// Version and MaxPlayers are shown in the multiplayer list
+	// while the server is offline
+	Version    string `json:"version"`
+	MaxPlayers int    `json:"max_players"`
+	// StartOnJoin allows players to start the server by joining it
+	// through the proxy while it is offline
+	StartOnJoin bool `json:"start_on_join"`
+
+	// RestartPolicy is one of RESTART_NEVER, RESTART_ON_FAILURE and
+	// RESTART_ALWAYS. The server is restarted at most RestartMaxRetries
+	// times in a row, waiting RestartDelay seconds doubled at every attempt
+	RestartPolicy     string `json:"restart_policy"`
+	RestartMaxRetries int    `json:"restart_max_retries"`
+	RestartDelay      int    `json:"restart_delay"`
+
+	// StopCountdown is the number of seconds of countdown shown to online
+	// players before stopping. If the server has not exited StopTimeout
+	// seconds after the stop command it is terminated, and then killed
+	// after KillTimeout more seconds
+	StopCountdown int `json:"stop_countdown"`
+	StopTimeout   int `json:"stop_timeout"`
+	KillTimeout   int `json:"kill_timeout"`
+
+	// Java is the java executable, it can be a full path to a specific JDK
+	Java string `json:"java"`
+	// Jar is the server jar file, relative to the server directory. If empty,
+	// the first server*.jar file found is used
+	Jar string `json:"jar"`
+	// Launcher is a script (e.g. run.sh) to use instead of the java command
+	// line. When set, Java, Jar, MemoryMin, MemoryMax and JVMArgs are ignored
+	Launcher string `json:"launcher"`
+
+	// DisableRcon leaves the server.properties as they are and sends
+	// the commands through the stdin. Otherwise the manager enables the
+	// RCON on a private port, binding the server to localhost if no
+	// server-ip is set, and uses it to get the output of the commands
+	DisableRcon bool `json:"disable_rcon"`
+	// RconPort pins the RCON port, otherwise one is assigned by the
+	// manager. It must not be used by other servers
+	RconPort int `json:"rcon_port"`
+
+	MemoryMin string            `json:"memory_min"`
+	MemoryMax string            `json:"memory_max"`
+	JVMArgs   []string          `json:"jvm_args"`
+	Args      []string          `json:"args"`
+	Env       map[string]string `json:"env"`
+}
+
+// matchHostname reports whether host matches one of the manifest hostnames,
+// with a score used to prefer exact matches over longer wildcards and
+// longer wildcards over the catch-all
+func (m ServerManifest) matchHostname(host string) (score int, ok bool) {
+	for _, pattern := range m.Hostnames {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+
+		switch {
+		case pattern == host:
+			return math.MaxInt, true
+		case pattern == "*":
+			ok = true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			score, ok = max(score, len(pattern)), true
+		}
+	}
+
+	return
+}
+
+func defaultServerManifest() ServerManifest {
+	return ServerManifest{
+		Java:       "java",
+		MemoryMin:  "4G",
+		MemoryMax:  "8G",
+		MaxPlayers: 20,
+
+		RestartPolicy:     RESTART_NEVER,
+		RestartMaxRetries: 5,
+		RestartDelay:      5,
+
+		StopCountdown: 5,
+		StopTimeout:   60,
+		KillTimeout:   30,
+	}
+}
+
+// loadServerManifest reads the manifest in the server directory dir. If there
+// is no manifest, the default one is returned. If no launcher and no jar are
+// configured and no server*.jar is found, found is false
+func loadServerManifest(dir string) (manifest ServerManifest, found bool, err error) {
+	manifest = defaultServerManifest()
+
+	data, err := os.ReadFile(filepath.Join(dir, server_manifest_name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return manifest, false, err
+	}
+
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&manifest); err != nil {
+			return manifest, false, fmt.Errorf("%s: %w", server_manifest_name, err)
+		}
+	}
+
+	if err = manifest.validate(); err != nil {
+		return manifest, false, err
+	}
+
+	if manifest.Launcher != "" || manifest.Jar != "" {
+		return manifest, true, nil
+	}
+
+	childs, _ := os.ReadDir(dir)
+	for _, child := range childs {
+		if child.IsDir() {
+			continue
+		}
+
+		if strings.HasPrefix(child.Name(), "server") && strings.HasSuffix(child.Name(), ".jar") {
+			manifest.Jar = child.Name()
+			return manifest, true, nil
+		}
+	}
+
+	return manifest, false, nil
+}
+
+// validate checks that every value of the manifest is usable,
+// naming the invalid keys
+func (m ServerManifest) validate() error {
+	var errs []error
+
+	switch m.RestartPolicy {
+	case RESTART_NEVER, RESTART_ON_FAILURE, RESTART_ALWAYS:
+	default:
+		errs = append(errs, fmt.Errorf("%s: invalid restart_policy: must be %q, %q or %q, found %q",
+			server_manifest_name, RESTART_NEVER, RESTART_ON_FAILURE, RESTART_ALWAYS, m.RestartPolicy))
+	}
+
+	for _, f := range []struct {
+		key   string
+		value int
+	}{
+		{"max_players", m.MaxPlayers},
+		{"restart_max_retries", m.RestartMaxRetries},
+		{"restart_delay", m.RestartDelay},
+		{"stop_countdown", m.StopCountdown},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: invalid %s: %d is negative", server_manifest_name, f.key, f.value))
+		}
+	}
+
+	// With no timeout the stop would be escalated right away
+	for _, f := range []struct {
+		key   string
+		value int
+	}{
+		{"stop_timeout", m.StopTimeout},
+		{"kill_timeout", m.KillTimeout},
+	} {
+		if f.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s: invalid %s: %d is not positive", server_manifest_name, f.key, f.value))
+		}
+	}
+
+	if m.RconPort < 0 || m.RconPort > math.MaxUint16 {
+		errs = append(errs, fmt.Errorf("%s: invalid rcon_port: %d is not a valid port", server_manifest_name, m.RconPort))
+	}
+
+	memoryMin, minOk := parseMemorySize(m.MemoryMin)
+	memoryMax, maxOk := parseMemorySize(m.MemoryMax)
+	if m.MemoryMin != "" && !minOk {
+		errs = append(errs, fmt.Errorf("%s: invalid memory_min: %q is not a size like 512M or 4G", server_manifest_name, m.MemoryMin))
+	}
+	if m.MemoryMax != "" && !maxOk {
+		errs = append(errs, fmt.Errorf("%s: invalid memory_max: %q is not a size like 512M or 4G", server_manifest_name, m.MemoryMax))
+	}
+	if minOk && maxOk && memoryMin > memoryMax {
+		errs = append(errs, fmt.Errorf("%s: invalid memory_min: %s is above memory_max %s", server_manifest_name, m.MemoryMin, m.MemoryMax))
+	}
+
+	return errors.Join(errs...)
+}
+
+// parseMemorySize parses a JVM memory size, a positive number of bytes
+// with an optional k, m, g or t unit
+func parseMemorySize(s string) (int64, bool) {
+	unit := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			unit = 1 << 10
+		case 'm', 'M':
+			unit = 1 << 20
+		case 'g', 'G':
+			unit = 1 << 30
+		case 't', 'T':
+			unit = 1 << 40
+		}
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/unit || strings.HasPrefix(s, "+") {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// command builds the command line used to start the server in dir
+// listening on port
+func (m ServerManifest) command(dir string, port int) javaExec {
+	var execName string
+	var args []string
+
+	if m.Launcher != "" {
+		execName = m.Launcher
+		if !filepath.IsAbs(execName) {
+			execName = filepath.Join(dir, execName)
+		}
+	} else {
+		execName = m.Java
+		if m.MemoryMin != "" {
+			args = append(args, "-Xms"+m.MemoryMin)
+		}
+		if m.MemoryMax != "" {
+			args = append(args, "-Xmx"+m.MemoryMax)
+		}
+		args = append(args, m.JVMArgs...)
+		args = append(args, "-jar", m.Jar)
+	}
+
+	args = append(args, "--port", fmt.Sprint(port), "nogui")
+	args = append(args, m.Args...)
+
+	env := make([]string, 0, len(m.Env))
+	for key, value := range m.Env {
+		env = append(env, key+"="+value)
+	}
+
+	return javaExec{
+		execName: execName, args: args,
+		env: env, wd: dir, port: port,
+	}
+}
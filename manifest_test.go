@@ -0,0 +1,83 @@
+package craft
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadServerManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  string
+	}{
+		{"no manifest", "", ""},
+		{"valid", `{"memory_min": "512M", "memory_max": "4G", "restart_policy": "on-failure", "stop_timeout": 30}`, ""},
+		{"unknown key", `{"memory_maxx": "4G"}`, "memory_maxx"},
+		{"restart policy", `{"restart_policy": "sometimes"}`, "restart_policy"},
+		{"negative restart delay", `{"restart_delay": -1}`, "restart_delay"},
+		{"negative restart retries", `{"restart_max_retries": -1}`, "restart_max_retries"},
+		{"negative countdown", `{"stop_countdown": -5}`, "stop_countdown"},
+		{"zero stop timeout", `{"stop_timeout": 0}`, "stop_timeout"},
+		{"negative kill timeout", `{"kill_timeout": -1}`, "kill_timeout"},
+		{"negative max players", `{"max_players": -1}`, "max_players"},
+		{"rcon port", `{"rcon_port": 70000}`, "rcon_port"},
+		{"memory unit", `{"memory_max": "4GB"}`, "memory_max"},
+		{"negative memory", `{"memory_min": "-1G"}`, "memory_min"},
+		{"memory min above max", `{"memory_min": "8G", "memory_max": "4096M"}`, "memory_min"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, "server.jar"), nil, 0o644)
+			if tt.manifest != "" {
+				os.WriteFile(filepath.Join(dir, server_manifest_name), []byte(tt.manifest), 0o644)
+			}
+
+			manifest, found, err := loadServerManifest(dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one about %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !found || manifest.Jar != "server.jar" {
+				t.Fatalf("got manifest %+v, found %v", manifest, found)
+			}
+		})
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"1024", 1024, true},
+		{"512k", 512 << 10, true},
+		{"512M", 512 << 20, true},
+		{"4G", 4 << 30, true},
+		{"1t", 1 << 40, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"0G", 0, false},
+		{"+4G", 0, false},
+		{"4.5G", 0, false},
+		{"99999999999T", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseMemorySize(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Fatalf("parseMemorySize(%q) = %d, %v, want %d, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -1,17 +1,22 @@
 package craft
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/nixpare/logger/v3"
 	"github.com/nixpare/server/v3"
 )
 
 func startProxy(router *server.Router, msm *McServerManager) error {
-	tcpSrv, err := router.NewTCPServer("", mc_public_port, false)
+	tcpSrv, err := router.NewTCPServer("", msm.config.PublicPort, false)
 	if err != nil {
 		return err
 	}
@@ -24,53 +29,83 @@ func startProxy(router *server.Router, msm *McServerManager) error {
 
 func (msm *McServerManager) proxyHandler(srv *server.TCPServer, conn net.Conn) {
 	addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	rd := bufio.NewReader(conn)
 
-	buf1 := make([]byte, 1024)
-	n, err := conn.Read(buf1)
+	first, err := rd.Peek(1)
 	if err != nil {
 		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error reading first packet: %v", err)
 		return
 	}
 
-	packetID := buf1[0]
+	if first[0] == legacy_ping_packet_id {
+		mcServer, ok := msm.pingTarget(addr, "")
+		if ok && mcServer.IsReady() {
+			handlePingRequest(srv, conn, mcServer, bufferedBytes(rd))
+		}
+		return
+	}
+
+	hsPacket, err := readPacket(rd)
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error reading handshake packet: %v", err)
+		return
+	}
+
+	hs, err := decodeHandshake(hsPacket)
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error decoding handshake packet: %v", err)
+		return
+	}
 
-	switch packetID {
-	case 0x12 /* vanilla */, 0x18 /* modrinth */, 0x10 /* multimc */ :
-		packetType := buf1[n-1]
-		msm.Logger.Debug(packetType, buf1[:n], string(buf1[:n]))
-		switch packetType {
-		case 0x1: // old ping
-			handlePingRequest(srv, conn, addr, buf1[:n])
+	switch hs.NextState {
+	case handshake_state_status:
+		mcServer, ok := msm.pingTarget(addr, hs.Host())
+		if !ok {
 			return
-		case 0x2: // login start
-		default:
-			srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Unknown packetType: %d", packetType)
+		}
+
+		if mcServer.IsReady() && handlePingRequest(srv, conn, mcServer, append(hsPacket.raw, bufferedBytes(rd)...)) {
 			return
 		}
 
-	case 0xFE: // new ping
-		handlePingRequest(srv, conn, addr, buf1[:n])
+		handleOfflineStatus(srv, conn, rd, mcServer, hs)
 		return
+	case handshake_state_login, handshake_state_transfer:
 	default:
-		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Unknown packetID: %d", packetID)
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Unknown handshake next state: %d", hs.NextState)
 		return
 	}
 
-	buf2 := make([]byte, 1024)
-	n, err = conn.Read(buf2)
+	loginPacket, err := readPacket(rd)
 	if err != nil {
 		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error reading login packet: %v", err)
 		return
 	}
 
-	userName, err := readString(bytes.NewBuffer(buf2[2:n]))
+	login, err := decodeLoginStart(loginPacket, hs.ProtocolVersion)
 	if err != nil {
-		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error decoding username form login packet: %v", err)
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error decoding login packet: %v", err)
 		return
 	}
 
-	user, mcServer, ok := acceptConnection(msm, userName, addr)
-	if !ok {
+	var user *McUser
+	var mcServer *McServer
+
+	switch msm.config.ProxyRouting {
+	case PROXY_ROUTING_IP:
+		user, mcServer, err = acceptConnection(msm, login, addr)
+	default:
+		user, mcServer, err = acceptHostConnection(msm, login, hs.Host())
+	}
+	if errors.Is(err, errServerOffline) && msm.startOnJoin(mcServer, login, addr) {
+		err = errServerStarting
+	}
+	if errors.Is(err, errServerStarting) && msm.config.Limbo {
+		holdInLimbo(srv, conn, rd, hs, login, mcServer)
+		return
+	}
+	if err != nil {
+		msm.rejectLogin(srv, conn, login, addr, mcServer, err)
 		return
 	}
 
@@ -83,88 +118,436 @@ func (msm *McServerManager) proxyHandler(srv *server.TCPServer, conn net.Conn) {
 
 	proxy, err := net.DialTCP("tcp", nil, target)
 	if err != nil {
+		if mcServer.IsRunning() && msm.config.Limbo {
+			holdInLimbo(srv, conn, rd, hs, login, mcServer)
+			return
+		}
+
+		msm.rejectLogin(srv, conn, login, addr, mcServer, fmt.Errorf("%w: %w", errServerStarting, err))
 		return
 	}
 	defer proxy.Close()
 
-	_, err = proxy.Write(buf1)
+	// Players transferred from the limbo reconnect with the transfer intent,
+	// which the server would refuse unless accepts-transfers is enabled
+	if hs.NextState == handshake_state_transfer {
+		hs.NextState = handshake_state_login
+		hsPacket.raw = encodeHandshake(hs)
+	}
+
+	_, err = proxy.Write(hsPacket.raw)
 	if err != nil {
-		srv.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error writing back first packet: %v", err)
+		srv.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error writing back handshake packet: %v", err)
 		return
 	}
-	buf1 = nil
 
-	_, err = proxy.Write(buf2)
+	_, err = proxy.Write(append(loginPacket.raw, bufferedBytes(rd)...))
 	if err != nil {
-		srv.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error writing back second packet: %v", err)
+		srv.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error writing back login packet: %v", err)
 		return
 	}
-	buf2 = nil
 
-	user.conn = conn
+	// The user depends on the UUID sent by the client, which the
+	// server must confirm when it authenticates the player
+	if _, claimed := msm.claimedUser(login); claimed {
+		mcServer.expectPlayer(login.Name, login.UUID.String(), conn)
+		defer mcServer.takeClaim(login.Name)
+	}
+
+	user.conn, user.player = conn, login.Name
 	mcServer.playerConnected(user)
 
 	defer func() {
-		user.conn = nil
 		mcServer.playerDisconnected(user)
+		user.conn, user.player = nil, ""
 	}()
 
 	server.TCPPipe(conn, proxy)
 }
 
-func acceptConnection(msm *McServerManager, userName string, addr string) (*McUser, *McServer, bool) {
+var (
+	errUnknownUser      = errors.New("unknown user")
+	errIPMismatch       = errors.New("ip address does not match the web login")
+	errAlreadyConnected = errors.New("user already connected")
+	errNoServerSelected = errors.New("no server selected")
+	errUnknownHost      = errors.New("no server for the address")
+	errServerOffline    = errors.New("server offline")
+	errServerStarting   = errors.New("server starting")
+)
+
+// rejectLogin logs why the player was not accepted and tells the
+// player with a Login Disconnect. The unknown players get a code
+// to link their Minecraft account in the web interface
+func (msm *McServerManager) rejectLogin(srv *server.TCPServer, conn net.Conn, login loginStart, addr string, mcServer *McServer, reason error) {
+	userName := login.Name
+	srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Rejected player %s (%s): %v", userName, addr, reason)
+
+	var code linkCode
+	canLink := false
+	if errors.Is(reason, errUnknownUser) || errors.Is(reason, errUUIDMismatch) {
+		code, canLink = msm.playerLinkCode(login)
+	}
+
+	message, color := msm.config.MessageServerOffline, "red"
+	switch {
+	case canLink:
+		message, color = msm.config.MessageLinkCode, "yellow"
+	case errors.Is(reason, errUnknownUser):
+		message = msm.config.MessageUnknownUser
+	case errors.Is(reason, errUUIDMismatch):
+		message = msm.config.MessageUUIDMismatch
+	case errors.Is(reason, errIPMismatch):
+		message = msm.config.MessageIPMismatch
+	case errors.Is(reason, errAlreadyConnected):
+		message = msm.config.MessageAlreadyConnected
+	case errors.Is(reason, errNoServerSelected):
+		message = msm.config.MessageNoServerSelected
+	case errors.Is(reason, errUnknownHost):
+		message = msm.config.MessageUnknownHost
+	case errors.Is(reason, errServerStarting):
+		message, color = msm.config.MessageStarting, "yellow"
+	}
+
+	err := disconnectLogin(conn, chatComponent{
+		Text:  strings.ReplaceAll(msm.formatMessage(message, mcServer, userName), "{code}", code.Code),
+		Color: color,
+	})
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error sending disconnect to player %s (%s): %v", userName, addr, err)
+	}
+}
+
+func acceptConnection(msm *McServerManager, login loginStart, addr string) (*McUser, *McServer, error) {
+	userName, err := msm.verifyPlayer(login)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	msm.mutex.RLock()
 	defer msm.mutex.RUnlock()
 
 	user, ok := msm.users[userName]
 	if !ok {
-		return nil, nil, false
+		return nil, nil, errUnknownUser
+	}
+
+	if addr != user.IP {
+		return nil, nil, errIPMismatch
 	}
 
-	if addr != user.IP || user.conn != nil {
-		return nil, nil, false
+	if user.conn != nil {
+		return nil, nil, errAlreadyConnected
 	}
 
 	if user.server == nil {
-		return nil, nil, false
+		return nil, nil, errNoServerSelected
 	}
 
 	if !user.server.IsRunning() {
-		return nil, nil, false
+		return user, user.server, errServerOffline
+	}
+
+	if !user.server.IsReady() {
+		return user, user.server, errServerStarting
 	}
 
-	return user, user.server, true
+	return user, user.server, nil
 }
 
-func handlePingRequest(srv *server.TCPServer, conn net.Conn, addr string, packet []byte) {
-	MC.mutex.RLock()
-	mcServer, ok := MC.pingIPToServer[addr]
-	MC.mutex.RUnlock()
+// acceptHostConnection accepts a player joining with the address of one
+// of the servers, no web login is required as the Minecraft server itself
+// is in charge of authenticating the player. Linked players are still
+// bound to their web user, and the names of the linked users are
+// reserved to their Minecraft account
+func acceptHostConnection(msm *McServerManager, login loginStart, host string) (*McUser, *McServer, error) {
+	userName, err := msm.verifyPlayer(login)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if !ok || !mcServer.IsRunning() {
-		return
+	msm.mutex.Lock()
+	defer msm.mutex.Unlock()
+
+	srv, ok := msm.serverForHostNoLock(host)
+	if !ok {
+		return nil, nil, errUnknownHost
+	}
+
+	if !srv.IsRunning() {
+		return nil, srv, errServerOffline
+	}
+
+	if !srv.IsReady() {
+		return nil, srv, errServerStarting
 	}
 
+	user, ok := msm.users[userName]
+	if !ok {
+		user = newMcUser(msm, userName)
+		msm.users[userName] = user
+	}
+
+	if user.conn != nil {
+		return nil, nil, errAlreadyConnected
+	}
+
+	if user.server != srv {
+		user.server = srv
+		msm.saveUser(user)
+		go user.SignalStateUpdate()
+	}
+
+	return user, srv, nil
+}
+
+// pingTarget returns the server that should answer a status request coming
+// from addr for host. Legacy pings carry no host, so an empty one is passed
+func (msm *McServerManager) pingTarget(addr string, host string) (*McServer, bool) {
+	msm.mutex.RLock()
+	defer msm.mutex.RUnlock()
+
+	if msm.config.ProxyRouting == PROXY_ROUTING_IP {
+		srv, ok := msm.pingIPToServer[addr]
+		return srv, ok
+	}
+
+	return msm.serverForHostNoLock(host)
+}
+
+// serverForHostNoLock returns the server whose manifest hostnames best match
+// host, falling back to the configured default server
+func (msm *McServerManager) serverForHostNoLock(host string) (*McServer, bool) {
+	var best *McServer
+	bestScore := -1
+
+	for _, srv := range msm.Servers {
+		score, ok := srv.manifest.matchHostname(host)
+		if ok && score > bestScore {
+			best, bestScore = srv, score
+		}
+	}
+
+	if best != nil {
+		return best, true
+	}
+
+	srv, ok := msm.Servers[msm.config.DefaultServer]
+	return srv, ok
+}
+
+// handlePingRequest forwards the ping to the running server. It returns
+// false if the server could not be reached, in that case nothing has been
+// written to the client connection
+func handlePingRequest(srv *server.TCPServer, conn net.Conn, mcServer *McServer, packet []byte) bool {
 	serverAddr := fmt.Sprintf("%s:%d", "127.0.0.1", mcServer.port)
 	target, err := net.ResolveTCPAddr("tcp", serverAddr)
 	if err != nil {
 		srv.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error resolving server addr %s", serverAddr)
-		return
+		return false
 	}
 
 	proxy, err := net.DialTCP("tcp", nil, target)
 	if err != nil {
-		return
+		return false
 	}
 	defer proxy.Close()
 
 	_, err = proxy.Write(packet)
 	if err != nil {
 		srv.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error writing back ping packet: %v", err)
-		return
+		return true
 	}
 
 	server.TCPPipe(conn, proxy)
+	return true
+}
+
+//
+// Protocol
+//
+
+const (
+	legacy_ping_packet_id = 0xFE
+
+	// max_packet_length is the biggest length a 3-byte VarInt can encode,
+	// which is the protocol limit for a single packet
+	max_packet_length = 2097151
+	// max_string_length is the protocol limit of 32767 UTF-16 units,
+	// encoded in at most 3 bytes each
+	max_string_length = 32767 * 3
+
+	handshake_packet_id   = 0x00
+	login_start_packet_id = 0x00
+
+	status_request_packet_id  = 0x00
+	status_response_packet_id = 0x00
+	ping_request_packet_id    = 0x01
+	pong_response_packet_id   = 0x01
+
+	login_disconnect_packet_id = 0x00
+
+	handshake_state_status   = 1
+	handshake_state_login    = 2
+	handshake_state_transfer = 3
+)
+
+// packet is a single uncompressed Minecraft packet
+type packet struct {
+	id   int32
+	data []byte
+	// raw is the packet as it was read, length prefix included,
+	// so it can be replayed to the backend server
+	raw []byte
+}
+
+type handshake struct {
+	ProtocolVersion int32
+	ServerAddress   string
+	ServerPort      uint16
+	NextState       int32
+}
+
+// Host returns the server address without the trailing dot and the
+// NUL-separated data appended by some mod loaders (e.g. "\x00FML\x00")
+func (hs handshake) Host() string {
+	host, _, _ := strings.Cut(hs.ServerAddress, "\x00")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+type mcUUID [16]byte
+
+func (uuid mcUUID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+type loginStart struct {
+	Name    string
+	UUID    mcUUID
+	HasUUID bool
+}
+
+// bufferedBytes returns the bytes already read from the connection but not
+// yet consumed, they have to be forwarded along with the decoded packets
+func bufferedBytes(rd *bufio.Reader) []byte {
+	b, _ := rd.Peek(rd.Buffered())
+	return b
+}
+
+func readPacket(rd io.Reader) (packet, error) {
+	var p packet
+
+	length, err := readVarInt(rd)
+	if err != nil {
+		return p, err
+	}
+	if length <= 0 || length > max_packet_length {
+		return p, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	prefix := appendVarInt(nil, length)
+	p.raw = make([]byte, len(prefix)+int(length))
+	copy(p.raw, prefix)
+
+	_, err = io.ReadFull(rd, p.raw[len(prefix):])
+	if err != nil {
+		return p, err
+	}
+
+	body := bytes.NewReader(p.raw[len(prefix):])
+	p.id, err = readVarInt(body)
+	if err != nil {
+		return p, err
+	}
+	p.data = p.raw[len(p.raw)-body.Len():]
+
+	return p, nil
+}
+
+func decodeHandshake(p packet) (handshake, error) {
+	var hs handshake
+	if p.id != handshake_packet_id {
+		return hs, fmt.Errorf("unexpected packet id 0x%02X for handshake", p.id)
+	}
+
+	rd := bytes.NewReader(p.data)
+
+	var err error
+	hs.ProtocolVersion, err = readVarInt(rd)
+	if err != nil {
+		return hs, fmt.Errorf("protocol version: %w", err)
+	}
+
+	hs.ServerAddress, err = readString(rd)
+	if err != nil {
+		return hs, fmt.Errorf("server address: %w", err)
+	}
+
+	err = binary.Read(rd, binary.BigEndian, &hs.ServerPort)
+	if err != nil {
+		return hs, fmt.Errorf("server port: %w", err)
+	}
+
+	hs.NextState, err = readVarInt(rd)
+	if err != nil {
+		return hs, fmt.Errorf("next state: %w", err)
+	}
+
+	return hs, nil
+}
+
+// encodeHandshake returns the handshake packet, length prefix included
+func encodeHandshake(hs handshake) []byte {
+	data := appendVarInt(nil, hs.ProtocolVersion)
+	data = appendString(data, hs.ServerAddress)
+	data = binary.BigEndian.AppendUint16(data, hs.ServerPort)
+	data = appendVarInt(data, hs.NextState)
+
+	var b bytes.Buffer
+	writePacket(&b, handshake_packet_id, data)
+	return b.Bytes()
+}
+
+// decodeLoginStart decodes the Login Start packet. The player UUID is sent
+// always since 1.20.2 (protocol 764) and optionally from 1.19.3 (protocol 761),
+// older clients only send the name (1.19 and 1.19.1 also the signature data,
+// which is ignored)
+func decodeLoginStart(p packet, protocolVersion int32) (loginStart, error) {
+	var login loginStart
+	if p.id != login_start_packet_id {
+		return login, fmt.Errorf("unexpected packet id 0x%02X for login start", p.id)
+	}
+
+	rd := bytes.NewReader(p.data)
+
+	var err error
+	login.Name, err = readString(rd)
+	if err != nil {
+		return login, fmt.Errorf("name: %w", err)
+	}
+	if login.Name == "" || len(login.Name) > 16 {
+		return login, fmt.Errorf("name: invalid player name %q", login.Name)
+	}
+
+	switch {
+	case protocolVersion >= 764:
+		login.HasUUID = true
+	case protocolVersion >= 761:
+		login.HasUUID, err = readBool(rd)
+		if err != nil {
+			return login, fmt.Errorf("has uuid: %w", err)
+		}
+	default:
+		return login, nil
+	}
+
+	if login.HasUUID {
+		_, err = io.ReadFull(rd, login.UUID[:])
+		if err != nil {
+			return login, fmt.Errorf("uuid: %w", err)
+		}
+	}
+
+	return login, nil
 }
 
 func readVarInt(rd io.Reader) (int32, error) {
@@ -173,7 +556,7 @@ func readVarInt(rd io.Reader) (int32, error) {
 
 	byteRead := make([]byte, 1)
 	for {
-		_, err := rd.Read(byteRead)
+		_, err := io.ReadFull(rd, byteRead)
 		if err != nil {
 			return 0, err
 		}
@@ -194,17 +577,75 @@ func readVarInt(rd io.Reader) (int32, error) {
 	return result, nil
 }
 
+func appendVarInt(b []byte, value int32) []byte {
+	v := uint32(value)
+	for {
+		if v&^0x7F == 0 {
+			return append(b, byte(v))
+		}
+
+		b = append(b, byte(v&0x7F)|0x80)
+		v >>= 7
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendVarInt(b, int32(len(s)))
+	return append(b, s...)
+}
+
+// writePacket writes a single uncompressed packet with the given id
+func writePacket(w io.Writer, id int32, data []byte) error {
+	body := appendVarInt(nil, id)
+	body = append(body, data...)
+
+	b := appendVarInt(make([]byte, 0, len(body)+5), int32(len(body)))
+	b = append(b, body...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// disconnectLogin sends the Login Disconnect packet with the given reason,
+// the client shows it instead of a generic connection error
+func disconnectLogin(w io.Writer, reason chatComponent) error {
+	data, err := json.Marshal(reason)
+	if err != nil {
+		return err
+	}
+
+	return writePacket(w, login_disconnect_packet_id, appendString(nil, string(data)))
+}
+
 func readString(rd io.Reader) (string, error) {
 	strLen, err := readVarInt(rd)
 	if err != nil {
 		return "", err
 	}
+	if strLen < 0 || strLen > max_string_length {
+		return "", fmt.Errorf("invalid string length %d", strLen)
+	}
 
-	strBytes := make([]byte, strLen)
-	_, err = rd.Read(strBytes)
+	// The buffer grows with the bytes actually read, a bogus
+	// length doesn't allocate the whole string up front
+	var b bytes.Buffer
+	_, err = io.CopyN(&b, rd, int64(strLen))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return "", err
 	}
 
-	return string(strBytes), nil
+	return b.String(), nil
+}
+
+func readBool(rd io.Reader) (bool, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(rd, b)
+	if err != nil {
+		return false, err
+	}
+
+	return b[0] != 0, nil
 }
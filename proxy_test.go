@@ -0,0 +1,180 @@
+package craft
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"runtime"
+	"testing"
+)
+
+func FuzzReadVarInt(f *testing.F) {
+	for _, v := range []int32{0, 1, 127, 128, 255, 25565, math.MaxInt32, -1, math.MinInt32} {
+		f.Add(appendVarInt(nil, v))
+	}
+	f.Add([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x01})
+	f.Add([]byte{0xFF})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rd := bytes.NewReader(data)
+		v, err := readVarInt(rd)
+		if err != nil {
+			return
+		}
+
+		n := len(data) - rd.Len()
+		if n > 5 {
+			t.Fatalf("read %d bytes for a VarInt", n)
+		}
+
+		// The writer always uses the shortest encoding
+		enc := appendVarInt(nil, v)
+		got, err := readVarInt(bytes.NewReader(enc))
+		if err != nil || got != v {
+			t.Fatalf("round trip of %d: got %d, %v", v, got, err)
+		}
+		if len(enc) > n {
+			t.Fatalf("encoding of %d is %d bytes, read from %d", v, len(enc), n)
+		}
+	})
+}
+
+func FuzzReadString(f *testing.F) {
+	f.Add(appendString(nil, ""))
+	f.Add(appendString(nil, "Notch"))
+	f.Add(appendString(nil, "play.example.com\x00FML\x00"))
+	f.Add(appendVarInt(nil, max_string_length+1))
+	f.Add(appendVarInt(nil, -1))
+	f.Add(appendVarInt(nil, math.MaxInt32))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		declared, lenErr := readVarInt(bytes.NewReader(data))
+
+		s, err := readString(bytes.NewReader(data))
+		if lenErr == nil && (declared < 0 || declared > max_string_length) && err == nil {
+			t.Fatalf("accepted string length %d", declared)
+		}
+		if err != nil {
+			return
+		}
+
+		if len(s) != int(declared) {
+			t.Fatalf("read %d bytes, declared %d", len(s), declared)
+		}
+
+		got, err := readString(bytes.NewReader(appendString(nil, s)))
+		if err != nil || got != s {
+			t.Fatalf("round trip of %q: got %q, %v", s, got, err)
+		}
+	})
+}
+
+func TestReadStringAllocation(t *testing.T) {
+	// The longest valid length, without the string
+	data := appendVarInt(nil, max_string_length)
+
+	const runs = 100
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for range runs {
+		_, err := readString(bytes.NewReader(data))
+		if err == nil {
+			t.Fatal("read a truncated string")
+		}
+	}
+	runtime.ReadMemStats(&after)
+
+	if perRun := (after.TotalAlloc - before.TotalAlloc) / runs; perRun > max_string_length/4 {
+		t.Fatalf("allocated %d bytes per truncated string", perRun)
+	}
+}
+
+func TestDecodeLoginStart(t *testing.T) {
+	uuid := mcUUID{0x06, 0x9a, 0x79, 0xf4, 0x44, 0xe9, 0x47, 0x26, 0xa5, 0xbe, 0xfc, 0xa9, 0x0e, 0x38, 0xaa, 0xf5}
+
+	withUUID := append(appendString(nil, "Notch"), 1)
+	withUUID = append(withUUID, uuid[:]...)
+	withoutUUID := append(appendString(nil, "Notch"), 0)
+	alwaysUUID := append(appendString(nil, "Notch"), uuid[:]...)
+
+	tests := []struct {
+		name     string
+		protocol int32
+		data     []byte
+		hasUUID  bool
+		wantErr  bool
+	}{
+		{"1.19.2 ignores the rest", 760, withUUID, false, false},
+		{"1.19.3 with uuid", 761, withUUID, true, false},
+		{"1.19.3 without uuid", 761, withoutUUID, false, false},
+		{"1.19.3 truncated", 761, appendString(nil, "Notch"), false, true},
+		{"1.20.1 with uuid", 763, withUUID, true, false},
+		{"1.20.2 always uuid", 764, alwaysUUID, true, false},
+		{"1.20.2 truncated uuid", 764, alwaysUUID[:10], true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, err := decodeLoginStart(packet{id: login_start_packet_id, data: tt.data}, tt.protocol)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decoded %+v", login)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if login.Name != "Notch" || login.HasUUID != tt.hasUUID {
+				t.Fatalf("got %+v", login)
+			}
+			if tt.hasUUID && login.UUID != uuid {
+				t.Fatalf("got uuid %s, want %s", login.UUID, uuid)
+			}
+		})
+	}
+}
+
+func TestAcceptHostConnection(t *testing.T) {
+	srv, _ := newFakeServer(t, `{"launcher": "fake", "disable_rcon": true, "hostnames": ["play.example.com"]}`)
+	msm := srv.msm
+
+	err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, srv, SERVER_RUNNING)
+
+	notch := mcUUID{0x06, 0x9a, 0x79, 0xf4, 0x44, 0xe9, 0x47, 0x26, 0xa5, 0xbe, 0xfc, 0xa9, 0x0e, 0x38, 0xaa, 0xf5}
+	msm.accounts.Add("alice", "password", ROLE_PLAYER)
+	msm.accounts.Link("alice", notch.String(), "Notch")
+
+	tests := []struct {
+		name     string
+		login    loginStart
+		wantUser string
+		wantErr  error
+	}{
+		{"linked player", loginStart{Name: "Notch", UUID: notch, HasUUID: true}, "alice", nil},
+		{"linked user name", loginStart{Name: "alice", UUID: mcUUID{1}, HasUUID: true}, "", errUUIDMismatch},
+		{"linked user name without uuid", loginStart{Name: "alice"}, "", errUUIDMismatch},
+		{"unknown player", loginStart{Name: "Steve", UUID: mcUUID{2}, HasUUID: true}, "Steve", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, mcServer, err := acceptHostConnection(msm, tt.login, "play.example.com")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if user.Name != tt.wantUser || mcServer != srv {
+				t.Fatalf("got user %s on %v", user.Name, mcServer)
+			}
+		})
+	}
+}
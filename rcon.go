@@ -0,0 +1,413 @@
+package craft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+const (
+	rcon_packet_response int32 = 0
+	rcon_packet_command  int32 = 2
+	rcon_packet_auth     int32 = 3
+	// rcon_packet_end is not a valid type, the server answers it with an
+	// error after all the fragments of the previous response
+	rcon_packet_end int32 = 100
+
+	// max_rcon_command_length is the longest command accepted by
+	// the server, the longer ones are sent through the stdin
+	max_rcon_command_length = 1446
+	max_rcon_packet_length  = 4096 + 14
+	default_rcon_port       = "25575"
+
+	rcon_timeout         = time.Second * 10
+	rcon_dial_timeout    = time.Second * 2
+	rcon_retry_interval  = time.Second * 5
+	rcon_password_length = 18
+
+	server_properties_name = "server.properties"
+)
+
+var (
+	errRconAuth    = errors.New("rcon: authentication failed")
+	errRconNotSent = errors.New("rcon: command not sent")
+)
+
+// RconClient is a connection to the RCON of a Minecraft server, which
+// runs the commands and returns their output
+type RconClient struct {
+	conn   net.Conn
+	rd     *bufio.Reader
+	nextID int32
+	m      sync.Mutex
+}
+
+// DialRcon connects to the RCON at addr and authenticates with password
+func DialRcon(ctx context.Context, addr string, password string) (*RconClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &RconClient{conn: conn, rd: bufio.NewReader(conn)}
+	err = c.auth(ctx, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *RconClient) auth(ctx context.Context, password string) error {
+	c.setDeadline(ctx)
+
+	id := c.newID()
+	err := c.write(id, rcon_packet_auth, password)
+	if err != nil {
+		return err
+	}
+
+	for {
+		respID, typ, _, err := c.read()
+		if err != nil {
+			return err
+		}
+
+		// Some servers send an empty response before the auth one
+		if typ != rcon_packet_command {
+			continue
+		}
+		if respID == -1 {
+			return errRconAuth
+		}
+		return nil
+	}
+}
+
+// Exec runs a command and returns its response. The errors wrapping
+// errRconNotSent tell that the server did not receive the command
+func (c *RconClient) Exec(ctx context.Context, cmd string) (string, error) {
+	if len(cmd) > max_rcon_command_length {
+		return "", fmt.Errorf("%w: longer than %d bytes", errRconNotSent, max_rcon_command_length)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.setDeadline(ctx)
+
+	id := c.newID()
+	err := c.write(id, rcon_packet_command, cmd)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errRconNotSent, err)
+	}
+
+	// The long responses are split in more packets, with no
+	// way to tell the last one apart other than the next response
+	endID := c.newID()
+	err = c.write(endID, rcon_packet_end, "")
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for {
+		respID, _, body, err := c.read()
+		if err != nil {
+			return sb.String(), err
+		}
+
+		switch respID {
+		case id:
+			sb.WriteString(body)
+		case endID:
+			return sb.String(), nil
+		}
+	}
+}
+
+func (c *RconClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *RconClient) newID() int32 {
+	c.nextID++
+	return c.nextID
+}
+
+func (c *RconClient) setDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(rcon_timeout)
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// write sends a packet: the length, the id, the type and
+// the body, all terminated by two null bytes
+func (c *RconClient) write(id int32, typ int32, body string) error {
+	data := make([]byte, 0, 14+len(body))
+	data = binary.LittleEndian.AppendUint32(data, uint32(10+len(body)))
+	data = binary.LittleEndian.AppendUint32(data, uint32(id))
+	data = binary.LittleEndian.AppendUint32(data, uint32(typ))
+	data = append(data, body...)
+	data = append(data, 0, 0)
+
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *RconClient) read() (id int32, typ int32, body string, err error) {
+	var length int32
+	err = binary.Read(c.rd, binary.LittleEndian, &length)
+	if err != nil {
+		return
+	}
+	if length < 10 || length > max_rcon_packet_length {
+		err = fmt.Errorf("rcon: invalid packet length %d", length)
+		return
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(c.rd, data)
+	if err != nil {
+		return
+	}
+
+	id = int32(binary.LittleEndian.Uint32(data[0:4]))
+	typ = int32(binary.LittleEndian.Uint32(data[4:8]))
+	body = string(bytes.TrimRight(data[8:], "\x00"))
+	return
+}
+
+// configureRcon enables the RCON in the server.properties, with the port
+// assigned by the manager or pinned in the manifest and a generated
+// password. The server is bound to localhost if no address is set,
+// the proxy connects from there
+func (srv *McServer) configureRcon() error {
+	path := filepath.Join(srv.wd, server_properties_name)
+	props, err := readServerProperties(path)
+	if err != nil {
+		return err
+	}
+
+	// The generated properties have the default port, the
+	// same for every server, so it is always replaced
+	changed := props.set("enable-rcon", "true")
+	changed = props.set("rcon.port", fmt.Sprint(srv.rconPort)) || changed
+	if password, _ := props.get("rcon.password"); password == "" {
+		changed = props.set("rcon.password", newRconPassword()) || changed
+	}
+	if ip, _ := props.get("server-ip"); ip == "" {
+		changed = props.set("server-ip", "127.0.0.1") || changed
+	}
+
+	if !changed {
+		return nil
+	}
+	return writeFileAtomic(path, props.bytes())
+}
+
+func newRconPassword() string {
+	b := make([]byte, rcon_password_length)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// rconClient returns the RCON connection to the server, connecting if
+// needed. It is nil if the RCON is disabled or not accepting connections,
+// also when the server was not started by the manager. After a failure
+// it stays nil for rcon_retry_interval, without reading the properties
+// and dialing again
+func (srv *McServer) rconClient(ctx context.Context) *RconClient {
+	if srv.manifest.DisableRcon {
+		return nil
+	}
+
+	srv.rconM.Lock()
+	defer srv.rconM.Unlock()
+
+	if srv.rcon != nil {
+		return srv.rcon
+	}
+	if time.Now().Before(srv.rconRetry) {
+		return nil
+	}
+
+	client := srv.dialRconNoLock(ctx)
+	if client == nil {
+		srv.rconRetry = time.Now().Add(rcon_retry_interval)
+		return nil
+	}
+
+	srv.rcon = client
+	return client
+}
+
+// dialRconNoLock connects to the RCON configured in the server.properties
+func (srv *McServer) dialRconNoLock(ctx context.Context) *RconClient {
+	props, err := readServerProperties(filepath.Join(srv.wd, server_properties_name))
+	if err != nil {
+		return nil
+	}
+	if enabled, _ := props.get("enable-rcon"); enabled != "true" {
+		return nil
+	}
+
+	host, _ := props.get("server-ip")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port, _ := props.get("rcon.port")
+	if port == "" {
+		port = default_rcon_port
+	}
+	password, _ := props.get("rcon.password")
+	if password == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rcon_dial_timeout)
+	defer cancel()
+
+	client, err := DialRcon(ctx, net.JoinHostPort(host, port), password)
+	if err != nil {
+		if errors.Is(err, errRconAuth) {
+			srv.msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Server %s: %v", srv.Name, err)
+		}
+		return nil
+	}
+	return client
+}
+
+// closeRcon closes the connection, the next command connects again
+func (srv *McServer) closeRcon() {
+	srv.rconM.Lock()
+	defer srv.rconM.Unlock()
+
+	if srv.rcon != nil {
+		srv.rcon.Close()
+		srv.rcon = nil
+	}
+	srv.rconRetry = time.Time{}
+}
+
+// rconExec runs the command through the RCON, if available. sent tells
+// whether the server received it, otherwise it must be sent through
+// the stdin. The output is also written to the console
+func (srv *McServer) rconExec(ctx context.Context, cmd string) (output string, sent bool, err error) {
+	cmd = strings.TrimSpace(cmd)
+	if len(cmd) > max_rcon_command_length {
+		return "", false, nil
+	}
+
+	client := srv.rconClient(ctx)
+	if client == nil {
+		return "", false, nil
+	}
+
+	output, err = client.Exec(ctx, cmd)
+	if err != nil {
+		// The connection is in an unknown state
+		srv.closeRcon()
+		if errors.Is(err, errRconNotSent) {
+			return "", false, nil
+		}
+	}
+
+	srv.m.RLock()
+	serverLog := srv.serverLog
+	srv.m.RUnlock()
+	if serverLog != nil && output != "" {
+		serverLog.Printf(logger.LOG_LEVEL_INFO, "RCON <%s>: %s", cmd, output)
+	}
+
+	return output, true, err
+}
+
+// AcceptsCommands tells whether the commands can be sent to the server,
+// through the process started by the manager or through the RCON. When
+// the RCON is not available it is checked again after rcon_retry_interval
+func (srv *McServer) AcceptsCommands() bool {
+	return srv.IsRunning() || srv.rconClient(context.Background()) != nil
+}
+
+// serverProperties is a server.properties file, kept as its lines
+// so that the comments and the order are preserved
+type serverProperties struct {
+	lines []string
+}
+
+func readServerProperties(path string) (*serverProperties, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &serverProperties{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	return &serverProperties{lines: strings.Split(strings.TrimSuffix(text, "\n"), "\n")}, nil
+}
+
+// parseProperty splits a line in key and value, ok is false for
+// the comments and the blank lines
+func parseProperty(line string) (key string, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' {
+		return "", "", false
+	}
+
+	i := strings.IndexAny(line, "=:")
+	if i < 0 {
+		return line, "", true
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
+
+func (p *serverProperties) get(key string) (string, bool) {
+	for _, line := range p.lines {
+		if k, v, ok := parseProperty(line); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// set changes the property or adds it at the end,
+// reporting whether the file changed
+func (p *serverProperties) set(key string, value string) bool {
+	for i, line := range p.lines {
+		if k, v, ok := parseProperty(line); ok && k == key {
+			if v == value {
+				return false
+			}
+			p.lines[i] = key + "=" + value
+			return true
+		}
+	}
+
+	p.lines = append(p.lines, key+"="+value)
+	return true
+}
+
+func (p *serverProperties) bytes() []byte {
+	return []byte(strings.Join(p.lines, "\n") + "\n")
+}
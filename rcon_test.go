@@ -0,0 +1,269 @@
+package craft
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+// fakeRcon is an RCON server accepting password, which answers
+// the commands with their text repeated, in fragments of fragment bytes
+type fakeRcon struct {
+	ln       net.Listener
+	password string
+	fragment int
+	conns    atomic.Int32
+}
+
+func newFakeRcon(t *testing.T, password string) *fakeRcon {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	r := &fakeRcon{ln: ln, password: password, fragment: 16}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.conns.Add(1)
+			go r.serve(conn)
+		}
+	}()
+
+	return r
+}
+
+func (r *fakeRcon) port() string {
+	return fmt.Sprint(r.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (r *fakeRcon) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+
+	for {
+		var length int32
+		if binary.Read(rd, binary.LittleEndian, &length) != nil {
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return
+		}
+		id := int32(binary.LittleEndian.Uint32(data[0:4]))
+		typ := int32(binary.LittleEndian.Uint32(data[4:8]))
+		body := strings.TrimRight(string(data[8:]), "\x00")
+
+		switch typ {
+		case rcon_packet_auth:
+			writeRconPacket(conn, id, rcon_packet_response, "")
+			if body != r.password {
+				id = -1
+			}
+			writeRconPacket(conn, id, rcon_packet_command, "")
+		case rcon_packet_command:
+			output := strings.Repeat(body, 10)
+			for len(output) > r.fragment {
+				writeRconPacket(conn, id, rcon_packet_response, output[:r.fragment])
+				output = output[r.fragment:]
+			}
+			writeRconPacket(conn, id, rcon_packet_response, output)
+		default:
+			writeRconPacket(conn, id, rcon_packet_response, fmt.Sprintf("Unknown request %x", typ))
+		}
+	}
+}
+
+func writeRconPacket(w io.Writer, id int32, typ int32, body string) {
+	data := binary.LittleEndian.AppendUint32(nil, uint32(10+len(body)))
+	data = binary.LittleEndian.AppendUint32(data, uint32(id))
+	data = binary.LittleEndian.AppendUint32(data, uint32(typ))
+	data = append(data, body...)
+	w.Write(append(data, 0, 0))
+}
+
+func TestRconExec(t *testing.T) {
+	r := newFakeRcon(t, "secret")
+	addr := r.ln.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := DialRcon(ctx, addr, "wrong")
+	if !errors.Is(err, errRconAuth) {
+		t.Fatalf("got error %v with a wrong password", err)
+	}
+
+	c, err := DialRcon(ctx, addr, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, cmd := range []string{"list", "say hello"} {
+		output, err := c.Exec(ctx, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Repeat(cmd, 10); output != want {
+			t.Fatalf("got output %q, want %q", output, want)
+		}
+	}
+
+	_, err = c.Exec(ctx, strings.Repeat("x", max_rcon_command_length+1))
+	if !errors.Is(err, errRconNotSent) {
+		t.Fatalf("got error %v for a long command", err)
+	}
+}
+
+func TestConfigureRcon(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties string
+		wantPort   int
+	}{
+		{"new file", "", 30000},
+		{"assigned port", "#Minecraft server properties\r\nmotd=Hello\r\n", 30000},
+		{"default port", "#Minecraft server properties\r\nrcon.port=25575\r\nmotd=Hello\r\n", 30000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, server_properties_name)
+			if tt.properties != "" {
+				os.WriteFile(path, []byte(tt.properties), 0o644)
+			}
+
+			srv := &McServer{javaExec: javaExec{wd: dir}, rconPort: 30000}
+			err := srv.configureRcon()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if srv.rconPort != tt.wantPort {
+				t.Fatalf("got port %d, want %d", srv.rconPort, tt.wantPort)
+			}
+
+			props, err := readServerProperties(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range map[string]string{
+				"enable-rcon": "true",
+				"rcon.port":   fmt.Sprint(tt.wantPort),
+				"server-ip":   "127.0.0.1",
+			} {
+				if got, _ := props.get(key); got != want {
+					t.Fatalf("got %s %q, want %q", key, got, want)
+				}
+			}
+			if password, _ := props.get("rcon.password"); len(password) == 0 {
+				t.Fatal("password not generated")
+			}
+
+			// The other lines are kept
+			for _, line := range []string{"#Minecraft server properties", "motd=Hello"} {
+				if strings.Contains(tt.properties, line) && !strings.Contains(string(props.bytes()), line) {
+					t.Fatalf("line %q removed", line)
+				}
+			}
+		})
+	}
+}
+
+func TestRconClientRetry(t *testing.T) {
+	r := newFakeRcon(t, "secret")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, server_properties_name)
+	os.WriteFile(path, []byte("enable-rcon=false\n"), 0o644)
+
+	srv := &McServer{javaExec: javaExec{wd: dir}}
+	if srv.rconClient(context.Background()) != nil {
+		t.Fatal("connected with the RCON disabled")
+	}
+
+	// Not read again until the retry
+	os.WriteFile(path, []byte("enable-rcon=true\nrcon.port="+r.port()+"\nrcon.password=secret\n"), 0o644)
+	if srv.AcceptsCommands() || r.conns.Load() != 0 {
+		t.Fatal("RCON checked again before the retry")
+	}
+
+	srv.rconM.Lock()
+	srv.rconRetry = time.Now()
+	srv.rconM.Unlock()
+
+	if !srv.AcceptsCommands() {
+		t.Fatal("RCON not available after the retry")
+	}
+	srv.AcceptsCommands()
+	if n := r.conns.Load(); n != 1 {
+		t.Fatalf("connected %d times", n)
+	}
+	srv.closeRcon()
+}
+
+func TestLoadServersRconPorts(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ServersPath = t.TempDir()
+
+	manifests := map[string]string{
+		"a": `{"launcher": "fake", "rcon_port": 25576}`,
+		"b": `{"launcher": "fake", "rcon_port": 25576}`,
+		"c": `{"launcher": "fake"}`,
+		"d": `{"launcher": "fake", "rcon_port": 25567}`,
+	}
+	for name, manifest := range manifests {
+		dir := filepath.Join(cfg.ServersPath, name)
+		os.Mkdir(dir, 0o755)
+		os.WriteFile(filepath.Join(dir, server_manifest_name), []byte(manifest), 0o644)
+	}
+
+	msm := newMcServerManager(cfg, logger.NewLogger(nil))
+	msm.runner = NewFakeRunner()
+	err := msm.loadServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, srv := range msm.Servers {
+			srv.archive.Close()
+		}
+	})
+
+	if _, ok := msm.Servers["b"]; ok {
+		t.Fatal("loaded a server with a duplicate rcon_port")
+	}
+	if srv := msm.Servers["a"]; srv == nil || srv.rconPort != 25576 {
+		t.Fatalf("pinned port not used: %+v", srv)
+	}
+
+	// The assigned ports skip the pinned ones
+	ports := make(map[int]string)
+	for _, srv := range msm.Servers {
+		for _, port := range []int{srv.port, srv.rconPort} {
+			if other, ok := ports[port]; ok {
+				t.Fatalf("port %d used by %s and %s", port, other, srv.Name)
+			}
+			ports[port] = srv.Name
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package craft
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+	"github.com/nixpare/process"
+)
+
+const (
+	RESTART_NEVER      = "never"
+	RESTART_ON_FAILURE = "on-failure"
+	RESTART_ALWAYS     = "always"
+
+	// SERVER_CRASH_LOOP is entered when the server keeps crashing
+	// and the restart policy has given up
+	SERVER_CRASH_LOOP ServerState = "crash_loop"
+
+	max_crash_reports  = 10
+	crash_stderr_lines = 20
+	// exit_stderr_timeout is how long the exit waits for the
+	// last lines of stderr, for the crash report
+	exit_stderr_timeout = time.Second
+	max_restart_delay   = time.Minute * 5
+	// restart_reset_after is how long the server has to run
+	// to reset the restart counter
+	restart_reset_after = time.Minute * 10
+)
+
+// CrashReport describes an unexpected exit of the server process
+type CrashReport struct {
+	Time     time.Time `json:"time"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error"`
+	Stderr   []string  `json:"stderr"`
+}
+
+// recordStderrLine keeps the last stderr lines for the crash reports
+func (srv *McServer) recordStderrLine(line string) {
+	srv.stateM.Lock()
+	defer srv.stateM.Unlock()
+
+	srv.stderrTail = append(srv.stderrTail, line)
+	if len(srv.stderrTail) > crash_stderr_lines {
+		srv.stderrTail = srv.stderrTail[len(srv.stderrTail)-crash_stderr_lines:]
+	}
+}
+
+// Crashes returns the last crash reports, the most recent last
+func (srv *McServer) Crashes() []CrashReport {
+	srv.stateM.RLock()
+	defer srv.stateM.RUnlock()
+
+	return append([]CrashReport(nil), srv.crashes...)
+}
+
+// handleExit is called when the server process exits. Exits not requested
+// with Stop are recorded as crashes if the exit status is an error, then
+// the restart policy is applied
+func (srv *McServer) handleExit(exitStatus process.ExitStatus) {
+	srv.m.Lock()
+	clear(srv.Players)
+	srv.m.Unlock()
+	srv.closeRcon()
+
+	state, _ := srv.State()
+	if state == SERVER_STOPPING {
+		srv.setState(SERVER_STOPPED, 0)
+		srv.msm.Logger.Printf(
+			logger.LOG_LEVEL_INFO,
+			"Minecraft server %s stopped successfully", srv.Name,
+		)
+		return
+	}
+
+	failed := exitStatus.Error() != nil
+	if failed {
+		srv.stateM.Lock()
+		srv.crashes = append(srv.crashes, CrashReport{
+			Time:     time.Now(),
+			ExitCode: exitStatus.ExitCode,
+			Error:    fmt.Sprint(exitStatus.Error()),
+			Stderr:   srv.stderrTail,
+		})
+		if len(srv.crashes) > max_crash_reports {
+			srv.crashes = srv.crashes[len(srv.crashes)-max_crash_reports:]
+		}
+		srv.stderrTail = nil
+		srv.stateM.Unlock()
+
+		srv.setState(SERVER_CRASHED, 0)
+		srv.msm.publish(EVENT_SERVER_CRASHED, srv.Name, "", fmt.Sprint(exitStatus.Error()))
+		srv.msm.Logger.Printf(
+			logger.LOG_LEVEL_ERROR,
+			"Minecraft server %s crashed (code: %d): %v",
+			srv.Name, exitStatus.ExitCode, exitStatus.Error(),
+		)
+	} else {
+		srv.setState(SERVER_STOPPED, 0)
+		srv.msm.Logger.Printf(
+			logger.LOG_LEVEL_INFO,
+			"Minecraft server %s exited on its own", srv.Name,
+		)
+	}
+
+	srv.stateM.Lock()
+	if time.Since(srv.startedAt) > restart_reset_after {
+		srv.restarts = 0
+	}
+	srv.stateM.Unlock()
+
+	srv.scheduleRestart(failed)
+}
+
+// scheduleRestart restarts the server after an exponential backoff,
+// according to the restart policy of the manifest
+func (srv *McServer) scheduleRestart(failed bool) {
+	switch srv.manifest.RestartPolicy {
+	case RESTART_ALWAYS:
+	case RESTART_ON_FAILURE:
+		if !failed {
+			return
+		}
+	default:
+		return
+	}
+
+	srv.stateM.Lock()
+	if srv.restarts >= srv.manifest.RestartMaxRetries {
+		restarts := srv.restarts
+		srv.stateM.Unlock()
+
+		srv.setState(SERVER_CRASH_LOOP, 0)
+		srv.msm.Logger.Printf(
+			logger.LOG_LEVEL_ERROR,
+			"Minecraft server %s is in a crash loop: gave up after %d restarts, manual intervention required",
+			srv.Name, restarts,
+		)
+		return
+	}
+	defer srv.stateM.Unlock()
+
+	delay := restartDelay(srv.manifest.RestartDelay, srv.restarts)
+	srv.restarts++
+
+	srv.msm.Logger.Printf(
+		logger.LOG_LEVEL_WARNING,
+		"Minecraft server %s will be restarted in %v (attempt %d of %d)",
+		srv.Name, delay, srv.restarts, srv.manifest.RestartMaxRetries,
+	)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		// Stopped by cancelRestart after firing
+		srv.stateM.Lock()
+		cancelled := srv.restartTimer != timer
+		if !cancelled {
+			srv.restartTimer = nil
+		}
+		srv.stateM.Unlock()
+		if cancelled {
+			return
+		}
+
+		err := srv.start()
+		if err != nil {
+			srv.msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error restarting server %s: %v", srv.Name, err)
+			// Not started, the process will not exit: next attempt
+			// or crash loop from here
+			if !srv.IsRunning() {
+				srv.scheduleRestart(true)
+			}
+		}
+	})
+	srv.restartTimer = timer
+}
+
+// restartDelay returns the delay before a restart after the given ones:
+// the base delay in seconds doubled at every restart, up to max_restart_delay
+func restartDelay(base int, restarts int) time.Duration {
+	if base >= int(max_restart_delay/time.Second) {
+		return max_restart_delay
+	}
+
+	delay := time.Duration(base) * time.Second
+	for range restarts {
+		if delay >= max_restart_delay {
+			break
+		}
+		delay *= 2
+	}
+	return min(delay, max_restart_delay)
+}
+
+// cancelRestart stops a scheduled restart and resets the restart counter,
+// used when the server is started or stopped by hand
+func (srv *McServer) cancelRestart() {
+	srv.stateM.Lock()
+	defer srv.stateM.Unlock()
+
+	if srv.restartTimer != nil {
+		srv.restartTimer.Stop()
+		srv.restartTimer = nil
+	}
+	srv.restarts = 0
+}
@@ -0,0 +1,143 @@
+package craft
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Role is the level of access of a web user, either global or on a single
+// server. Every role has the permissions of the previous ones
+type Role string
+
+const (
+	// ROLE_VIEWER can see the servers, their console and events
+	ROLE_VIEWER Role = "viewer"
+	// ROLE_PLAYER can also start the servers, connect to them and chat
+	ROLE_PLAYER Role = "player"
+	// ROLE_OPERATOR can also stop and restart the servers, broadcast
+	// messages and send console commands
+	ROLE_OPERATOR Role = "operator"
+	// ROLE_ADMIN can also manage the web users, it is always global
+	ROLE_ADMIN Role = "admin"
+)
+
+// Roles lists the roles from the least to the most powerful
+var Roles = []Role{ROLE_VIEWER, ROLE_PLAYER, ROLE_OPERATOR, ROLE_ADMIN}
+
+// Permission is an action checked against the role of the user
+type Permission string
+
+const (
+	PERM_VIEW         Permission = "view"
+	PERM_CONNECT      Permission = "connect"
+	PERM_START        Permission = "start"
+	PERM_CHAT         Permission = "chat"
+	PERM_STOP         Permission = "stop"
+	PERM_BROADCAST    Permission = "broadcast"
+	PERM_CONSOLE      Permission = "console"
+	PERM_MANAGE_USERS Permission = "manage_users"
+)
+
+// permissions maps each permission to the least role granting it,
+// in the order they are listed to the clients
+var permissions = []struct {
+	perm Permission
+	role Role
+}{
+	{PERM_VIEW, ROLE_VIEWER},
+	{PERM_CONNECT, ROLE_PLAYER},
+	{PERM_START, ROLE_PLAYER},
+	{PERM_CHAT, ROLE_PLAYER},
+	{PERM_STOP, ROLE_OPERATOR},
+	{PERM_BROADCAST, ROLE_OPERATOR},
+	{PERM_CONSOLE, ROLE_OPERATOR},
+	{PERM_MANAGE_USERS, ROLE_ADMIN},
+}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if !slices.Contains(Roles, role) {
+		return "", fmt.Errorf("invalid role %q: use viewer, player, operator or admin", name)
+	}
+	return role, nil
+}
+
+// AtLeast tells whether the role has all the permissions of other
+func (r Role) AtLeast(other Role) bool {
+	return slices.Index(Roles, r) >= slices.Index(Roles, other)
+}
+
+// Can tells whether the role grants the permission
+func (r Role) Can(perm Permission) bool {
+	for _, p := range permissions {
+		if p.perm == perm {
+			return slices.Contains(Roles, r) && r.AtLeast(p.role)
+		}
+	}
+	return false
+}
+
+// Permissions returns all the permissions granted by the role
+func (r Role) Permissions() []Permission {
+	perms := make([]Permission, 0, len(permissions))
+	for _, p := range permissions {
+		if r.Can(p.perm) {
+			perms = append(perms, p.perm)
+		}
+	}
+	return perms
+}
+
+// RoleFor returns the effective role of the account on a server: the
+// role assigned on the server replaces the global one, but a global
+// admin is an admin everywhere
+func (account Account) RoleFor(server string) Role {
+	if account.Role == ROLE_ADMIN {
+		return ROLE_ADMIN
+	}
+	if role, ok := account.ServerRoles[server]; ok {
+		return role
+	}
+	return account.Role
+}
+
+// Can tells whether the account has the permission on the server,
+// an empty server checks the global role
+func (account Account) Can(server string, perm Permission) bool {
+	if server == "" {
+		return account.Role.Can(perm)
+	}
+	return account.RoleFor(server).Can(perm)
+}
+
+// permissionsInfo are the effective permissions of a user, sent
+// to the clients together with the servers state
+type permissionsInfo struct {
+	Role        Role                            `json:"role"`
+	Permissions []Permission                    `json:"permissions"`
+	Servers     map[string]serverPermissionInfo `json:"servers"`
+}
+
+type serverPermissionInfo struct {
+	Role        Role         `json:"role"`
+	Permissions []Permission `json:"permissions"`
+}
+
+func (account Account) permissionsInfo(servers []string) permissionsInfo {
+	info := permissionsInfo{
+		Role:        account.Role,
+		Permissions: account.Role.Permissions(),
+		Servers:     make(map[string]serverPermissionInfo, len(servers)),
+	}
+
+	for _, server := range servers {
+		role := account.RoleFor(server)
+		info.Servers[server] = serverPermissionInfo{
+			Role:        role,
+			Permissions: role.Permissions(),
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,63 @@
+package craft
+
+import (
+	"os"
+
+	"github.com/nixpare/process"
+)
+
+// ProcessRunner creates the processes of the Minecraft servers. The default
+// one runs real processes with github.com/nixpare/process, FakeRunner
+// simulates a Minecraft server
+type ProcessRunner interface {
+	NewProcess(wd string, execName string, env []string, args ...string) (ServerProcess, error)
+}
+
+// ServerProcess is the process of a Minecraft server, as used by McServer
+type ServerProcess interface {
+	Start() error
+	Wait() process.ExitStatus
+	IsRunning() bool
+	SendText(text string) error
+	// Stop asks the process to exit, Kill forces it
+	Stop() error
+	Kill() error
+
+	StdoutListener(bufSize int) <-chan []byte
+	StderrListener(bufSize int) <-chan []byte
+	// ConnectStdout and ConnectStderr return the output printed so far
+	// together with a listener for the new lines
+	ConnectStdout(bufSize int) ([][]byte, <-chan []byte)
+	ConnectStderr(bufSize int) ([][]byte, <-chan []byte)
+}
+
+// outputUnlistener is implemented by the processes able to close
+// the listeners of their output, like FakeProcess
+type outputUnlistener interface {
+	Unlisten(ch <-chan []byte)
+}
+
+// execRunner is the default ProcessRunner
+type execRunner struct{}
+
+type execProcess struct {
+	*process.Process
+}
+
+func (execRunner) NewProcess(wd string, execName string, env []string, args ...string) (ServerProcess, error) {
+	proc, err := process.NewProcess(wd, execName, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	proc.InheritConsole(false)
+	if len(env) != 0 {
+		proc.Env = append(os.Environ(), env...)
+	}
+
+	return execProcess{proc}, nil
+}
+
+func (p execProcess) Start() error {
+	return p.Process.Start(nil, nil, nil)
+}
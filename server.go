@@ -1,26 +1,27 @@
 package craft
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/nixpare/broadcaster"
 	"github.com/nixpare/logger/v3"
-	"github.com/nixpare/process"
 	"github.com/nixpare/server/v3/commands"
 )
 
 type javaExec struct {
 	execName string
 	args     []string
+	env      []string
 	wd       string
 	port     int
 }
@@ -32,24 +33,97 @@ type McServerManager struct {
 	pingIPToServer map[string]*McServer
 	mutex          sync.RWMutex
 
+	// joinStarts are the last servers started on join by IP address,
+	// serverJoinStarts by server name
+	joinStarts       map[string]time.Time
+	serverJoinStarts map[string]time.Time
+	joinStartsMutex  sync.Mutex
+
 	UpdateBroadcaster *broadcaster.Broadcaster[[]byte] `json:"-"`
+	bus               eventBus
+
+	config     Config
+	runner     ProcessRunner
+	portOffset atomic.Int32
+
+	accounts *AccountStore
+	links    linkCodes
+	store    Store
+}
+
+func newMcServerManager(cfg Config, l *logger.Logger) *McServerManager {
+	return &McServerManager{
+		Logger:  l,
+		Servers: make(map[string]*McServer),
+		users:   make(map[string]*McUser),
+
+		pingIPToServer:   make(map[string]*McServer),
+		joinStarts:       make(map[string]time.Time),
+		serverJoinStarts: make(map[string]time.Time),
+
+		UpdateBroadcaster: broadcaster.NewBroadcaster[[]byte](),
+		config:            cfg,
+		runner:            execRunner{},
+		store:             NewFileStore(""),
+	}
 }
 
 type McServer struct {
 	javaExec
-	Name    string             `json:"name"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
 	
 	Players map[string]*McUser `json:"players"`
 	m       sync.RWMutex
 	
-	msm     *McServerManager
-	process *process.Process
+	msm      *McServerManager
+	manifest ServerManifest
+	process  ServerProcess
+	// exited is closed when handleExit is done with the process
+	exited chan struct{}
 
 	log     *logger.Logger
 	serverLog *logger.Logger
 	userLog *logger.Logger
 	chatLog *logger.Logger
-
+	// archive keeps the console of all the sessions on disk,
+	// session is the start time of the current one
+	archive *logArchive
+	session int64
+	// execM serializes the commands run with Exec
+	execM sync.Mutex
+
+	// rcon is connected when a command is sent, on rconPort
+	// if the server was started by the manager. After a failed
+	// connection the next one is not tried before rconRetry
+	rcon      *RconClient
+	rconPort  int
+	rconRetry time.Time
+	rconM     sync.Mutex
+
+	state    ServerState
+	progress int
+	stateM   sync.RWMutex
+
+	stopCancel context.CancelFunc
+
+	crashes      []CrashReport
+	stderrTail   []string
+	restarts     int
+	restartTimer *time.Timer
+
+	// Events broadcasts the game events parsed from the server stdout
+	Events         *broadcaster.Broadcaster[GameEvent] `json:"-"`
+	pendingPlayers map[string]*playerInfo
+	// playerUUIDs are the UUIDs of the online players, used to link them
+	playerUUIDs map[string]string
+	// claims are the UUIDs sent to the proxy by the joining players,
+	// until the server authenticates them
+	claims  map[string]playerClaim
+	eventsM sync.Mutex
+
+	startedAt      time.Time
 	lastDisconnect time.Time
 }
 
@@ -57,24 +131,33 @@ type McUser struct {
 	Name string `json:"name"`
 	IP   string `json:"ip"`
 
+	msm    *McServerManager
 	server *McServer
 	conn   net.Conn
+	// player is the Minecraft name used to join through the proxy,
+	// it differs from Name for the users linked to another player
+	player string
 
 	updateBroadcaster *broadcaster.Broadcaster[[]byte]
 }
 
-func newMcUser(username string) *McUser {
+func newMcUser(msm *McServerManager, username string) *McUser {
 	return &McUser{
 		Name:              username,
+		msm:               msm,
 		updateBroadcaster: broadcaster.NewBroadcaster[[]byte](),
 	}
 }
 
-var mcPrivatePortOffset = new(atomic.Int32)
-
-func mcServerCmd(f string) (string, []string, int) {
-	port := mc_public_port + int(mcPrivatePortOffset.Add(1))
-	return "java", []string{"-Xms4G", "-Xmx8G", "-jar", f, "--port", fmt.Sprint(port), "nogui"}, int(port)
+// nextServerPort returns a new private port for a server, above the public
+// one, skipping the ports pinned in the manifests
+func (msm *McServerManager) nextServerPort(pinned map[int]string) int {
+	for {
+		port := msm.config.PublicPort + int(msm.portOffset.Add(1))
+		if _, ok := pinned[port]; !ok {
+			return port
+		}
+	}
 }
 
 func (msm *McServerManager) loadServers() error {
@@ -85,43 +168,80 @@ func (msm *McServerManager) loadServers() error {
 		err := srv.Stop()
 		if err != nil {
 			msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error stopping server %s: %v", srv.Name, err)
-			srv.process.Kill()
+			srv.Kill()
 		}
+		srv.closeRcon()
+		srv.archive.Close()
 	}
 	clear(msm.Servers)
 
-	entries, err := os.ReadDir(mc_servers_path)
+	entries, err := os.ReadDir(msm.config.ServersPath)
 	if err != nil {
 		return err
 	}
 
-loop:
+	type serverDir struct {
+		name     string
+		dir      string
+		manifest ServerManifest
+	}
+	var dirs []serverDir
+	// pinned are the RCON ports set in the manifests, by server
+	pinned := make(map[int]string)
+
 	for _, e := range entries {
 		if !e.IsDir() {
 			continue
 		}
-		dir := mc_servers_path + "/" + e.Name()
+		dir := msm.config.ServersPath + "/" + e.Name()
 
-		childs, _ := os.ReadDir(dir)
-		for _, child := range childs {
-			if child.IsDir() {
+		manifest, found, err := loadServerManifest(dir)
+		if err != nil {
+			msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error loading server %s: %v", e.Name(), err)
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		if port := manifest.RconPort; port != 0 {
+			if other, ok := pinned[port]; ok {
+				msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error loading server %s: rcon_port %d already used by server %s", e.Name(), port, other)
 				continue
 			}
-
-			if strings.HasPrefix(child.Name(), "server") && strings.HasSuffix(child.Name(), ".jar") {
-				execName, args, port := mcServerCmd(child.Name())
-				msm.Servers[e.Name()] = &McServer{
-					Name: e.Name(),
-					Players: make(map[string]*McUser),
-					javaExec: javaExec{
-						execName: execName, args: args,
-						wd: dir, port: port,
-					},
-					msm: msm,
-				}
-
-				continue loop
+			if port == msm.config.PublicPort {
+				msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error loading server %s: rcon_port %d is the public port", e.Name(), port)
+				continue
 			}
+			pinned[port] = e.Name()
+		}
+
+		dirs = append(dirs, serverDir{e.Name(), dir, manifest})
+	}
+
+	for _, d := range dirs {
+		displayName := d.manifest.DisplayName
+		if displayName == "" {
+			displayName = d.name
+		}
+
+		port := msm.nextServerPort(pinned)
+		rconPort := d.manifest.RconPort
+		if rconPort == 0 {
+			rconPort = msm.nextServerPort(pinned)
+		}
+
+		msm.Servers[d.name] = &McServer{
+			Name:        d.name,
+			DisplayName: displayName,
+			Description: d.manifest.Description,
+			Players:     make(map[string]*McUser),
+			Events:      broadcaster.NewBroadcaster[GameEvent](),
+			javaExec:    d.manifest.command(d.dir, port),
+			msm:         msm,
+			manifest:    d.manifest,
+			archive:     newLogArchive(filepath.Join(d.dir, log_archive_dir), msm.config),
+			rconPort:    rconPort,
 		}
 	}
 
@@ -161,7 +281,22 @@ func (msm *McServerManager) Start(name string) error {
 
 func noTrimFunc(s string) string { return s }
 
+// Start starts the server process, cancelling any scheduled restart
 func (srv *McServer) Start() error {
+	srv.cancelRestart()
+	return srv.start()
+}
+
+func (srv *McServer) start() error {
+	// The exit of the previous process must not be handled
+	// after the new one is started
+	srv.m.RLock()
+	prev, exited := srv.process, srv.exited
+	srv.m.RUnlock()
+	if exited != nil && !prev.IsRunning() {
+		<-exited
+	}
+
 	srv.m.Lock()
 	defer srv.m.Unlock()
 
@@ -169,12 +304,19 @@ func (srv *McServer) Start() error {
 		return fmt.Errorf("server %s already running", srv.Name)
 	}
 
+	srv.closeRcon()
+	if !srv.manifest.DisableRcon {
+		err := srv.configureRcon()
+		if err != nil {
+			srv.msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Server %s: unable to configure the RCON: %v", srv.Name, err)
+		}
+	}
+
 	var err error
-	srv.process, err = process.NewProcess(srv.wd, srv.execName, srv.args...)
+	srv.process, err = srv.msm.runner.NewProcess(srv.wd, srv.execName, srv.env, srv.args...)
 	if err != nil {
 		return err
 	}
-	srv.process.InheritConsole(false)
 
 	if srv.log != nil {
 		srv.log.Close()
@@ -200,6 +342,10 @@ func (srv *McServer) Start() error {
 	srv.chatLog = srv.log.Clone(nil, true, "chat")
 	srv.chatLog.TrimFunc = noTrimFunc
 
+	srv.session = time.Now().UnixMilli()
+	_, archiveCh := srv.log.ListenForLogs(log_listener_buffer)
+	go srv.archive.record(archiveCh.Ch(), srv.session, srv.msm.Logger)
+
 	outLog := srv.log.Clone(nil, true, "stdout")
 	outLog.TrimFunc = noTrimFunc
 	outLogWriter := outLog.FixedLogger(logger.LOG_LEVEL_INFO)
@@ -214,16 +360,31 @@ func (srv *McServer) Start() error {
 	go func() {
 		for line := range stdoutCh {
 			outLogWriter.Write(append(line, '\n'))
+			srv.handleLifecycleLine(string(line))
+			srv.handleGameEventLine(string(line))
 		}
 	}()
+	// stderrDone tells that the last lines of stderr are recorded
+	stderrDone := make(chan struct{})
 	go func() {
+		defer close(stderrDone)
 		for line := range stderrCh {
 			errLogWriter.Write(append(line, '\n'))
+			srv.recordStderrLine(string(line))
 		}
 	}()
 
-	err = srv.process.Start(nil, nil, nil)
+	srv.eventsM.Lock()
+	srv.pendingPlayers = make(map[string]*playerInfo)
+	srv.playerUUIDs = make(map[string]string)
+	srv.claims = make(map[string]playerClaim)
+	srv.eventsM.Unlock()
+
+	srv.setState(SERVER_STARTING, 0)
+
+	err = srv.process.Start()
 	if err != nil {
+		srv.setState(SERVER_STOPPED, 0)
 		srv.msm.Logger.Printf(
 			logger.LOG_LEVEL_ERROR,
 			"Minecraft server %v startup error: %v", srv.javaExec, err,
@@ -235,30 +396,29 @@ func (srv *McServer) Start() error {
 		logger.LOG_LEVEL_INFO,
 		"Minecraft server %s started successfully", srv.Name,
 	)
-	srv.lastDisconnect = time.Now().Add(time.Minute * 10)
+	srv.startedAt = time.Now()
+	srv.lastDisconnect = srv.startedAt.Add(time.Minute * 10)
 
+	proc := srv.process
+	exited = make(chan struct{})
+	srv.exited = exited
 	go func() {
-		exitStatus := srv.process.Wait()
-		if err := exitStatus.Error(); err != nil {
-			srv.msm.Logger.Printf(
-				logger.LOG_LEVEL_ERROR,
-				"Minecraft server %v exit error: %v\n%s",
-				srv.javaExec, err, string(srv.process.Stdout()),
-			)
-			return
-		}
+		defer close(exited)
+		exitStatus := proc.Wait()
 
-		srv.msm.Logger.Printf(
-			logger.LOG_LEVEL_INFO,
-			"Minecraft server %s stopped successfully", srv.Name,
-		)
+		// The crash report needs the stack trace printed right before the exit
+		select {
+		case <-stderrDone:
+		case <-time.After(exit_stderr_timeout):
+		}
+		srv.handleExit(exitStatus)
 	}()
 
 	go srv.msm.SignalStateUpdate()
 	return nil
 }
 
-func (msm *McServerManager) Stop(name string) error {
+func (msm *McServerManager) Stop(name string, reason string) error {
 	msm.mutex.RLock()
 	srv, ok := msm.Servers[name]
 	msm.mutex.RUnlock()
@@ -267,7 +427,7 @@ func (msm *McServerManager) Stop(name string) error {
 		return fmt.Errorf("server %s not found", name)
 	}
 
-	err := srv.Stop()
+	err := srv.StopContext(context.Background(), reason)
 	if err != nil {
 		return err
 	}
@@ -301,43 +461,19 @@ func (msm *McServerManager) StopAll() error {
 	return errors.Join(errs...)
 }
 
-func (srv *McServer) Stop() error {
-	srv.m.RLock()
-	defer srv.m.RUnlock()
-
-	if !srv.IsRunning() {
-		return nil
-	}
-	
-	onlinePlayers := len(srv.Players) > 0
-
-	if onlinePlayers {
-		srv.process.SendText("/title @a times 0.5s 0.3s 0.5s")
-		shutdownInProgressSubtitle := "/title @a subtitle {\"text\": \"Server is going to shut down\"}"
-
-		for i := range 5 {
-			srv.process.SendText(fmt.Sprintf("/title @a title {\"text\": \"%d\"}", 5-i))
-			srv.process.SendText(shutdownInProgressSubtitle)
-			time.Sleep(time.Second)
+// SendInput sends a command through the RCON if available,
+// otherwise through the stdin of the server
+func (srv *McServer) SendInput(payload string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rcon_timeout)
+	_, sent, err := srv.rconExec(ctx, payload)
+	cancel()
+	if sent {
+		if err != nil {
+			srv.msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Server %s: no RCON response to <%s>: %v", srv.Name, payload, err)
 		}
-
-		srv.process.SendText("/title @a times 1s 0s 1s")
-		srv.process.SendText("/title @a title {\"text\": \"Server is shutting down\"}")
-		time.Sleep(time.Second * 2)
-	}
-
-	srv.process.SendText("stop")
-
-	exitStatus := srv.process.Wait()
-	if exitStatus.Error() != nil {
-		return fmt.Errorf("minecraft server %s stop error (code: %d): %w", srv.Name, exitStatus.ExitCode, exitStatus.ExitError)
+		return nil
 	}
 
-	go srv.msm.SignalStateUpdate()
-	return nil
-}
-
-func (srv *McServer) SendInput(payload string) error {
 	if !srv.IsRunning() {
 		return errors.New("minecraft server not running")
 	}
@@ -353,13 +489,19 @@ func (srv *McServer) Connect(sc *commands.ServerConn) error {
 	var exit bool
 	defer func() { exit = true }()
 
+	oldOut, outCh := srv.process.ConnectStdout(20)
+	oldErr, errCh := srv.process.ConnectStderr(20)
+	if u, ok := srv.process.(outputUnlistener); ok {
+		defer u.Unlisten(outCh)
+		defer u.Unlisten(errCh)
+	}
+
 	go func() {
-		old, ch := srv.process.ConnectStdout(20)
-		for _, line := range old {
+		for _, line := range oldOut {
 			sc.WriteOutput(string(line))
 		}
 		for !exit {
-			line, ok := <-ch
+			line, ok := <-outCh
 			if !ok {
 				break
 			}
@@ -367,12 +509,11 @@ func (srv *McServer) Connect(sc *commands.ServerConn) error {
 		}
 	}()
 	go func() {
-		old, ch := srv.process.ConnectStderr(20)
-		for _, line := range old {
+		for _, line := range oldErr {
 			sc.WriteError(string(line))
 		}
 		for !exit {
-			line, ok := <-ch
+			line, ok := <-errCh
 			if !ok {
 				break
 			}
@@ -401,31 +542,42 @@ func (srv *McServer) Connect(sc *commands.ServerConn) error {
 
 func (srv *McServer) playerConnected(user *McUser) {
 	srv.m.Lock()
+	_, found := srv.Players[user.Name]
 	srv.Players[user.Name] = user
 	srv.m.Unlock()
 
+	if !found {
+		srv.msm.openSession(srv, user)
+		srv.msm.publish(EVENT_PLAYER_JOINED, srv.Name, user.Name, "")
+	}
 	srv.msm.SignalStateUpdate()
 }
 
 func (srv *McServer) playerDisconnected(user *McUser) {
 	srv.m.Lock()
+	_, found := srv.Players[user.Name]
 	delete(srv.Players, user.Name)
 	srv.lastDisconnect = time.Now()
+	lastDisconnect := srv.lastDisconnect
 	srv.m.Unlock()
 
+	if found {
+		srv.msm.closeSession(srv, user, lastDisconnect)
+		srv.msm.publish(EVENT_PLAYER_LEFT, srv.Name, user.Name, "")
+	}
 	srv.msm.SignalStateUpdate()
 }
 
 func (user *McUser) ConnectToServer(srvName string) error {
-	MC.mutex.Lock()
-	defer MC.mutex.Unlock()
+	user.msm.mutex.Lock()
+	defer user.msm.mutex.Unlock()
 
-	srv, ok := MC.Servers[srvName]
+	srv, ok := user.msm.Servers[srvName]
 	if !ok {
 		return fmt.Errorf("user %s connect: server %s not found", user.Name, srvName)
 	}
 
-	MC.pingIPToServer[user.IP] = srv
+	user.msm.pingIPToServer[user.IP] = srv
 
 	if srv == user.server {
 		return nil
@@ -436,6 +588,7 @@ func (user *McUser) ConnectToServer(srvName string) error {
 	}
 
 	user.server = srv
+	user.msm.saveUser(user)
 	user.SignalStateUpdate()
 
 	return nil
@@ -456,12 +609,20 @@ func (msm *McServerManager) generateState() []byte {
 func (srv *McServer) MarshalJSON() ([]byte, error) {
 	type alias McServer
 
+	state, progress := srv.State()
+
 	jsonServer := struct {
 		*alias
-		Running bool `json:"running"`
+		Running  bool          `json:"running"`
+		State    ServerState   `json:"state"`
+		Progress int           `json:"progress"`
+		Crashes  []CrashReport `json:"crashes"`
 	}{
-		alias:  (*alias)(srv),
-		Running: srv.IsRunning(),
+		alias:    (*alias)(srv),
+		Running:  srv.IsRunning(),
+		State:    state,
+		Progress: progress,
+		Crashes:  srv.Crashes(),
 	}
 
 	return json.Marshal(jsonServer)
@@ -484,12 +645,16 @@ func (user *McUser) MarshalJSON() ([]byte, error) {
 		serverName = user.server.Name
 	}
 
+	account, _ := user.msm.accounts.Get(user.Name)
+
 	jsonUser := struct {
 		*alias
-		Server string `json:"server"`
+		Server        string `json:"server"`
+		MinecraftName string `json:"minecraft_name"`
 	}{
-		alias:  (*alias)(user),
-		Server: serverName,
+		alias:         (*alias)(user),
+		Server:        serverName,
+		MinecraftName: account.MinecraftName,
 	}
 
 	return json.Marshal(jsonUser)
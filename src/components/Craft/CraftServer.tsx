@@ -2,11 +2,11 @@ import './CraftServer.css'
 
 import ServerLogs, { parseLog } from './ServerLogs';
 import { useEffect, useState } from "react";
-import { Server } from "../../models/Server";
+import { Permission, Server } from "../../models/Server";
 import ServerInfo, { ServerOnlineState } from './ServerInfo';
 import ServerChat, { parseChatMessage } from './ServerChat';
 import { Updater, useImmer } from 'use-immer';
-import { Logs } from '../../models/Logs';
+import { Logs, ServerLog } from '../../models/Logs';
 import { User } from '../../models/User';
 import axios from 'axios';
 
@@ -16,11 +16,12 @@ export type ServerProps = {
     user: User;
     server: Server;
     serverName: string;
+    permissions: Permission[];
     closeServer: () => void;
     showMessage: (message: string) => void;
 }
 
-export default function CraftServer({ user, server, serverName, closeServer, showMessage }: ServerProps) {
+export default function CraftServer({ user, server, serverName, permissions, closeServer, showMessage }: ServerProps) {
     const [section, setSection] = useState('info' as Section)
 
     const [logs, updateLogs] = useImmer<Logs>({
@@ -29,6 +30,7 @@ export default function CraftServer({ user, server, serverName, closeServer, sho
     })
 
     useEffect(() => {
+        lastLogId = ''
         updateLogs(logs => {
             logs.rawLogs.length = 0
             logs.chat.length = 0
@@ -80,17 +82,20 @@ export default function CraftServer({ user, server, serverName, closeServer, sho
             <div className="sections">
                 <ServerInfo
                     user={user} server={server}
+                    permissions={permissions}
                     show={section == 'info'}
                     showMessage={showMessage}
                 />
                 <ServerChat
                     serverName={serverName}
                     chat={logs.chat}
+                    permissions={permissions}
                     show={section == 'chat'}
                     showMessage={showMessage}
                 />
                 <ServerLogs
                     logs={logs.rawLogs}
+                    permissions={permissions}
                     show={section == 'logs'}
                     showMessage={showMessage}
                 />
@@ -99,7 +104,21 @@ export default function CraftServer({ user, server, serverName, closeServer, sho
     )
 }
 
+// consoleProtocol is the console protocol with JSON frames, which
+// resumes from the last log received when reconnecting
+const consoleProtocol = 'nixcraft.console.v2'
+
+type ConsoleFrame = {
+    type: 'subscribed' | 'log' | 'result' | 'error'
+    reset?: boolean
+    log?: ServerLog
+    id?: string
+    error?: string
+}
+
 let ws = false as WebSocket | boolean
+let lastLogId = ''
+let reconnectTimeout: ReturnType<typeof setTimeout> | undefined
 
 async function queryServerLogs(
     serverName: string, user: User,
@@ -117,30 +136,63 @@ async function queryServerLogs(
         return
     }
 
-    ws = new WebSocket(url)
-    ws.onopen = () => {
-        updateLogs((logs) => {
-            // settare length a 0 è più efficiente e non fa arrabbiare il compilatore
-            logs.rawLogs.length = 0
-            logs.chat.length = 0
-        });
+    const conn = new WebSocket(url, consoleProtocol)
+    ws = conn
+    conn.onopen = () => {
+        conn.send(JSON.stringify({ type: 'subscribe', after: lastLogId }))
     }
-    ws.onclose = () => {
+    conn.onclose = (ev) => {
         ws = false
+
+        // The connection dropped, e.g. while the tab was sleeping
+        if (!ev.wasClean) {
+            reconnectTimeout = setTimeout(() => {
+                reconnectTimeout = undefined
+                if (ws)
+                    return
+
+                ws = true
+                queryServerLogs(serverName, user, updateLogs, showMessage)
+            }, 2000)
+        }
     }
-    ws.onmessage = (ev) => {
-        updateLogs(logs => {
-            const log = JSON.parse(ev.data)
-            const parsed = parseLog(log, logs.rawLogs)
-            parseChatMessage(user, parsed, logs.chat)
-        })
+    conn.onmessage = (ev) => {
+        const frame = JSON.parse(ev.data) as ConsoleFrame
+
+        switch (frame.type) {
+            case 'subscribed':
+                if (frame.reset) {
+                    updateLogs((logs) => {
+                        // settare length a 0 è più efficiente e non fa arrabbiare il compilatore
+                        logs.rawLogs.length = 0
+                        logs.chat.length = 0
+                    });
+                }
+                break
+            case 'log': {
+                const log = frame.log!
+                lastLogId = log.id
+                updateLogs(logs => {
+                    const parsed = parseLog(log, logs.rawLogs)
+                    parseChatMessage(user, parsed, logs.chat)
+                })
+                break
+            }
+            case 'result':
+            case 'error':
+                if (frame.error)
+                    showMessage(frame.error)
+                break
+        }
     }
-    ws.onerror = () => {
+    conn.onerror = () => {
         showMessage('Server connection error')
     }
 }
 
 function cleanup() {
+    clearTimeout(reconnectTimeout)
+    reconnectTimeout = undefined
     wsIsActive(ws) && ws.close()
 }
 
@@ -24,7 +24,7 @@ export default function CraftServerList({ servers, aside, setCurrentServer }: Se
               <div>
                 <div>
                   <div className="server-name">
-                    {server.name}
+                    {server.display_name || server.name}
                   </div>
                   <div className="server-type">
                     Vanilla
@@ -0,0 +1,79 @@
+import './LinkAccount.css'
+
+import axios from 'axios';
+import { useState } from 'react';
+import SendCommand from './SendCommand';
+import { User } from '../../models/User';
+import { InRelief } from '../UI/InRelief';
+
+type LinkAccountProps = {
+	user: User;
+	showMessage: (message: string) => void;
+}
+
+type LinkCode = {
+	code: string
+	expires: string
+}
+
+export default function LinkAccount({ user, showMessage }: LinkAccountProps) {
+	const [code, setCode] = useState<LinkCode | null>(null)
+
+	const createCode = async () => {
+		const response = await axios.post('/link/code')
+			.catch(err => {
+				showMessage(err.response.data);
+			});
+
+		if (response == undefined) return;
+		setCode(response.data)
+	}
+
+	const sendCode = async (code: string) => {
+		const response = await axios.post('/link', { code: code.trim() })
+			.catch(err => {
+				showMessage(err.response.data);
+			});
+
+		if (response == undefined) return;
+		showMessage(response.data);
+	}
+
+	const unlink = async () => {
+		const response = await axios.delete('/link')
+			.catch(err => {
+				showMessage(err.response.data);
+			});
+
+		if (response == undefined) return;
+		setCode(null)
+		showMessage('Minecraft account unlinked');
+	}
+
+	if (user.minecraft_name) {
+		return (
+			<div className="link-account">
+				<div>Playing as <span>{user.minecraft_name}</span></div>
+				<InRelief clickable>
+					<button onClick={unlink}>
+						<div>Unlink</div>
+					</button>
+				</InRelief>
+			</div>
+		)
+	}
+
+	return (
+		<div className="link-account">
+			{code == null ? <InRelief clickable>
+				<button onClick={createCode}>
+					<div>Link Minecraft account</div>
+				</button>
+			</InRelief> : <div>
+				Join a server and type <span>{code.code}</span> in the chat
+				before {new Date(code.expires).toLocaleTimeString()}
+			</div>}
+			<SendCommand label="Code shown when joining" sendFunc={sendCode} />
+		</div>
+	)
+}
@@ -7,15 +7,17 @@ import { User } from '../../models/User';
 import axios from 'axios';
 import { getProfileImage, ProfileImageType } from '../../utils/ProfileImageCache';
 import { InRelief } from '../UI/InRelief';
+import { Permission } from '../../models/Server';
 
 type ServerChatProps = {
     serverName: string;
     chat: ChatMessage[];
+    permissions: Permission[];
     show: boolean;
     showMessage: (message: string) => void;
 }
 
-export default function ServerChat({ serverName, chat, show, showMessage }: ServerChatProps) {
+export default function ServerChat({ serverName, chat, permissions, show, showMessage }: ServerChatProps) {
     const serverChatEl = useRef<HTMLDivElement>(null);
     const [scrollAtBottom, setScrollAtBottom] = useState(true)
 
@@ -62,9 +64,9 @@ export default function ServerChat({ serverName, chat, show, showMessage }: Serv
 
     return (
         <div style={!show ? { display: 'none' } : undefined}>
-            <div className="send-broadcast">
+            {permissions.includes('broadcast') && <div className="send-broadcast">
                 <SendCommand label="Broadcast Message" sendFunc={sendBroadcast} />
-            </div>
+            </div>}
             
             <InRelief reversed className="server-chat" onScroll={onChatScroll} innerRef={serverChatEl}>
                 <div className="chat">
@@ -74,9 +76,9 @@ export default function ServerChat({ serverName, chat, show, showMessage }: Serv
                 </div>
             </InRelief>
             
-            <div className="send-message">
+            {permissions.includes('chat') && <div className="send-message">
                 <SendCommand label="Message" sendFunc={sendMessage} />
-            </div>
+            </div>}
         </div>
     );
 }
@@ -1,7 +1,7 @@
 import './ServerInfo.css'
 
 import axios, { AxiosError } from "axios";
-import { Server } from "../../models/Server";
+import { Permission, Server } from "../../models/Server";
 import { User } from "../../models/User";
 import { useEffect, useState } from 'react';
 import { getProfileImage, ProfileImageType } from '../../utils/ProfileImageCache';
@@ -10,11 +10,12 @@ import { InRelief } from '../UI/InRelief';
 type ServerInfoProps = {
 	user: User;
 	server: Server;
+	permissions: Permission[];
 	show: boolean;
 	showMessage: (message: string) => void;
 }
 
-export default function ServerInfo({ user, server, show, showMessage }: ServerInfoProps) {
+export default function ServerInfo({ user, server, permissions, show, showMessage }: ServerInfoProps) {
 	const startServer = async () => {
 		const response = await axios.post(`/${server.name}/start`);
 
@@ -35,6 +36,16 @@ export default function ServerInfo({ user, server, show, showMessage }: ServerIn
 		}
 	}
 
+	const restartServer = async () => {
+		const response = await axios.post(`/${server.name}/restart`);
+
+		if (response.status === 200) {
+			showMessage('Server restarted');
+		} else {
+			showMessage('Server failed to restart');
+		}
+	}
+
 	const connectToServer = async () => {
 		const response = await axios.post(`/${server.name}/connect`)
 			.catch((err: AxiosError) => {
@@ -53,18 +64,25 @@ export default function ServerInfo({ user, server, show, showMessage }: ServerIn
 	return (
 		<div className="server-info" style={!show ? { display: 'none' } : undefined}>
 			<div className="start-stop-buttons">
-				<InRelief clickable reversed={server.running} disabled={server.running}>
+				{permissions.includes('start') && <InRelief clickable reversed={server.running} disabled={server.running}>
 					<button onClick={startServer} disabled={server.running}>
 						<div>Start</div>
 					</button>
-				</InRelief>
-				<InRelief clickable reversed={!server.running} disabled={!server.running}>
-					<button onClick={stopServer} disabled={!server.running}>
-						<div>Stop</div>
-					</button>
-				</InRelief>
+				</InRelief>}
+				{permissions.includes('stop') && <>
+					<InRelief clickable reversed={!server.running} disabled={!server.running}>
+						<button onClick={stopServer} disabled={!server.running}>
+							<div>Stop</div>
+						</button>
+					</InRelief>
+					<InRelief clickable reversed={!server.running} disabled={!server.running}>
+						<button onClick={restartServer} disabled={!server.running}>
+							<div>Restart</div>
+						</button>
+					</InRelief>
+				</>}
 			</div>
-			{<div className="connect">
+			{permissions.includes('connect') && <div className="connect">
 				{user.server != server.name ? <>
 					<InRelief clickable>
 						<button onClick={connectToServer}>
@@ -89,12 +107,22 @@ type ServerOnlineStateProps = {
 	server: Server
 }
 
+const serverStateDescr: Record<Server['state'], string> = {
+	stopped: 'Offline',
+	starting: 'Starting',
+	running: 'Online',
+	stopping: 'Stopping',
+	crashed: 'Crashed',
+	crash_loop: 'Crash loop',
+}
+
 export function ServerOnlineState({ server }: ServerOnlineStateProps) {
 	return (
 		<div className={`server-state ${server.running ? 'online' : ''}`}>
 			<i className="server-state-dot"></i>
 			<div className="server-state-descr">
-				{server.running ? 'Online' : 'Offline'}
+				{serverStateDescr[server.state] ?? 'Offline'}
+				{server.state === 'starting' ? ` ${server.progress}%` : undefined}
 			</div>
 			{server.running ? <div className="online-players">
 				<i className="fa-solid fa-users"></i>
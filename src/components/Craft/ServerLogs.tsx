@@ -4,14 +4,16 @@ import { useEffect, useState, MouseEvent, useRef } from "react";
 import SendCommand from './SendCommand';
 import { ParsedLog, ServerLog } from '../../models/Logs';
 import { getWS } from './CraftServer';
+import { Permission } from '../../models/Server';
 
 type ServerLogsProps = {
     logs: ParsedLog[];
+    permissions: Permission[];
     show: boolean;
     showMessage: (message: string) => void;
 }
 
-export default function ServerLogs({ logs, show, showMessage }: ServerLogsProps) {
+export default function ServerLogs({ logs, permissions, show, showMessage }: ServerLogsProps) {
     const serverLogsEl = useRef<HTMLDivElement>(null);
     const [scrollAtBottom, setScrollAtBottom] = useState(true)
 
@@ -39,7 +41,7 @@ export default function ServerLogs({ logs, show, showMessage }: ServerLogsProps)
             return
         }
 
-        ws.send(cmd)
+        ws.send(JSON.stringify({ type: 'command', command: cmd }))
     }
 
     return (
@@ -61,7 +63,7 @@ export default function ServerLogs({ logs, show, showMessage }: ServerLogsProps)
                     </tbody>
                 </table>
             </div>
-            <SendCommand label="Command" sendFunc={send} prefix="/" />
+            {permissions.includes('console') && <SendCommand label="Command" sendFunc={send} prefix="/" />}
         </div>
     );
 }
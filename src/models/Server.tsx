@@ -2,10 +2,34 @@ import { User } from "./User"
 
 export type Server = {
 	name: string
+	display_name: string
+	description: string
 	running: boolean
+	state: 'stopped' | 'starting' | 'running' | 'stopping' | 'crashed' | 'crash_loop'
+	progress: number
+	crashes: CrashReport[] | null
 	players: Record<string, User> | null
 }
 
+export type CrashReport = {
+	time: string
+	exit_code: number
+	error: string
+	stderr: string[] | null
+}
+
+export type Role = 'viewer' | 'player' | 'operator' | 'admin'
+
+export type Permission = 'view' | 'connect' | 'start' | 'chat' | 'stop' | 'broadcast' | 'console' | 'manage_users'
+
+export type ServerPermissions = {
+	role: Role
+	permissions: Permission[]
+}
+
 export type ServersInfo = {
 	servers: Record<string, Server>
+	permissions: ServerPermissions & {
+		servers: Record<string, ServerPermissions>
+	}
 }
\ No newline at end of file
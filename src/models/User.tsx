@@ -2,4 +2,5 @@ export type User = {
 	name: string
 	ip: string
 	server: string
+	minecraft_name: string
 }
\ No newline at end of file
@@ -3,6 +3,7 @@ import './index.css'
 import { StrictMode, useEffect, useState } from 'react'
 import CraftServerList from '../components/Craft/CraftServerList';
 import CraftServer from '../components/Craft/CraftServer';
+import LinkAccount from '../components/Craft/LinkAccount';
 import Footer from '../components/UI/Footer';
 import { Snackbar } from '@mui/material';
 import Navbar from '../components/UI/Navbar';
@@ -75,6 +76,7 @@ function CraftHome() {
 					<Navbar showLogoutButton onLogout={logout} />
 					<div className="page">
 						{user != undefined && <h2 className="welcome">Welcome, <span>{user.name}</span></h2>}
+						<LinkAccount user={user} showMessage={showMessage} />
 						<div className="servers">
 							<CraftServerList
 								servers={servers}
@@ -86,6 +88,7 @@ function CraftHome() {
 									user={user} server={servers.servers[currentServer]}
 									closeServer={closeServer}
 									serverName={currentServer}
+									permissions={servers.permissions.servers[currentServer]?.permissions ?? []}
 									showMessage={showMessage}
 								/>
 							</> : undefined}
@@ -32,7 +32,7 @@ function CraftLogin() {
   const onSubmit: SubmitHandler<FormValues> = async (data) => {
     const response = await axios.post(location.href, {
       username: data.username,
-      passcode: data.password
+      password: data.password
     }).catch((error: AxiosError) => {
       console.log(error)
       setErrorMessage(`${error.message}`);
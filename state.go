@@ -0,0 +1,200 @@
+package craft
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+const (
+	setting_forward_to_react = "forward_to_react"
+
+	// events_save_every is how often the events of the bus are saved,
+	// together, instead of rewriting the state for each one
+	events_save_every = time.Second * 5
+)
+
+// updateState saves a change of the state, logging the errors:
+// the manager keeps working with the state in memory
+func (msm *McServerManager) updateState(fn func(state *State)) {
+	err := msm.store.Update(func(state *State) error {
+		fn(state)
+		return nil
+	})
+	if err != nil {
+		msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error saving the state: %v", err)
+	}
+}
+
+// restoreState brings back the users, their routing and the servers
+// state saved before the last restart. The sessions still open were
+// interrupted by the restart, so they are closed at the last save
+func (msm *McServerManager) restoreState() (State, error) {
+	state, err := msm.store.Load()
+	if err != nil {
+		return state, err
+	}
+
+	msm.mutex.Lock()
+	for name, stored := range state.Users {
+		user, ok := msm.users[name]
+		if !ok {
+			user = newMcUser(msm, name)
+			msm.users[name] = user
+		}
+
+		user.IP = stored.IP
+		if srv, ok := msm.Servers[stored.Server]; ok {
+			user.server = srv
+		}
+	}
+
+	for ip, srvName := range state.Routing {
+		if srv, ok := msm.Servers[srvName]; ok {
+			msm.pingIPToServer[ip] = srv
+		}
+	}
+
+	for srvName, stored := range state.Servers {
+		if srv, ok := msm.Servers[srvName]; ok {
+			srv.lastDisconnect = stored.LastDisconnect
+		}
+	}
+	msm.mutex.Unlock()
+
+	msm.updateState(func(s *State) {
+		for i := range s.Sessions {
+			if s.Sessions[i].Left.IsZero() {
+				s.Sessions[i].Left = state.Saved
+			}
+		}
+	})
+
+	return state, nil
+}
+
+// recordEvents saves the events of the bus until ctx is done,
+// then the last ones and closes done
+func (msm *McServerManager) recordEvents(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	events := msm.Subscribe(ctx, nil)
+	ticker := time.NewTicker(events_save_every)
+	defer ticker.Stop()
+
+	var pending []Event
+	save := func() {
+		if len(pending) == 0 {
+			return
+		}
+
+		msm.updateState(func(state *State) {
+			state.Events = append(state.Events, pending...)
+			if n := len(state.Events); n > max_stored_events {
+				state.Events = append(state.Events[:0], state.Events[n-max_stored_events:]...)
+			}
+		})
+		pending = nil
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				save()
+				return
+			}
+			pending = append(pending, ev)
+		case <-ticker.C:
+			save()
+		}
+	}
+}
+
+// saveUser saves the IP address and the server selected by the user
+func (msm *McServerManager) saveUser(user *McUser) {
+	stored := StoredUser{Name: user.Name, IP: user.IP}
+	if user.server != nil {
+		stored.Server = user.server.Name
+	}
+
+	msm.updateState(func(state *State) {
+		if state.Users[user.Name] == stored {
+			return
+		}
+
+		state.Users[user.Name] = stored
+		// The players joined by hostname have no address
+		if stored.IP != "" && stored.Server != "" {
+			state.Routing[stored.IP] = stored.Server
+		}
+	})
+}
+
+// forgetUser removes a deleted account from the users and the state.
+// The keys are compared ignoring the case, like the accounts
+func (msm *McServerManager) forgetUser(name string) {
+	msm.mutex.Lock()
+	for key := range msm.users {
+		if strings.EqualFold(key, name) {
+			delete(msm.users, key)
+		}
+	}
+	msm.mutex.Unlock()
+
+	msm.updateState(func(state *State) {
+		for key := range state.Users {
+			if strings.EqualFold(key, name) {
+				delete(state.Users, key)
+			}
+		}
+	})
+}
+
+// openSession saves the join of a player on a server
+func (msm *McServerManager) openSession(srv *McServer, user *McUser) {
+	session := PlayerSession{
+		Player: user.Name,
+		Server: srv.Name,
+		Joined: time.Now(),
+	}
+	if user.player != "" {
+		session.Player = user.player
+	}
+	if _, ok := msm.accounts.Get(user.Name); ok {
+		session.User = user.Name
+	}
+
+	msm.updateState(func(state *State) {
+		state.Sessions = append(state.Sessions, session)
+		if n := len(state.Sessions); n > max_stored_sessions {
+			state.Sessions = append(state.Sessions[:0], state.Sessions[n-max_stored_sessions:]...)
+		}
+	})
+}
+
+// closeSession saves the leave of a player and the
+// time of the last disconnection from the server
+func (msm *McServerManager) closeSession(srv *McServer, user *McUser, lastDisconnect time.Time) {
+	msm.updateState(func(state *State) {
+		for i := len(state.Sessions) - 1; i >= 0; i-- {
+			session := &state.Sessions[i]
+			if session.Server == srv.Name && session.Left.IsZero() &&
+				(session.Player == user.Name || session.Player == user.player || session.User == user.Name) {
+				session.Left = lastDisconnect
+				break
+			}
+		}
+
+		state.Servers[srv.Name] = StoredServer{LastDisconnect: lastDisconnect}
+	})
+}
+
+// setSetting saves a setting changed at runtime
+func (msm *McServerManager) setSetting(key string, value string) {
+	msm.updateState(func(state *State) {
+		state.Settings[key] = value
+	})
+}
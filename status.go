@@ -0,0 +1,139 @@
+package craft
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+	"github.com/nixpare/server/v3"
+)
+
+const (
+	server_icon_name = "server-icon.png"
+	status_timeout   = time.Second * 10
+)
+
+// chatComponent is the JSON text format used by Minecraft for the MOTD,
+// chat messages and disconnect reasons
+type chatComponent struct {
+	Text  string          `json:"text"`
+	Color string          `json:"color,omitempty"`
+	Bold  bool            `json:"bold,omitempty"`
+	Extra []chatComponent `json:"extra,omitempty"`
+}
+
+type statusVersion struct {
+	Name     string `json:"name"`
+	Protocol int32  `json:"protocol"`
+}
+
+type statusPlayers struct {
+	Max    int `json:"max"`
+	Online int `json:"online"`
+}
+
+type statusResponse struct {
+	Version     statusVersion `json:"version"`
+	Players     statusPlayers `json:"players"`
+	Description chatComponent `json:"description"`
+	Favicon     string        `json:"favicon,omitempty"`
+}
+
+// handleOfflineStatus answers the status and ping requests in place of the
+// server, when it is not running or not yet accepting connections
+func handleOfflineStatus(srv *server.TCPServer, conn net.Conn, rd io.Reader, mcServer *McServer, hs handshake) {
+	conn.SetDeadline(time.Now().Add(status_timeout))
+
+	req, err := readPacket(rd)
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error reading status request: %v", err)
+		return
+	}
+	if req.id != status_request_packet_id {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Unexpected packet id 0x%02X for status request", req.id)
+		return
+	}
+
+	data, err := json.Marshal(mcServer.offlineStatus(hs.ProtocolVersion))
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error encoding status response: %v", err)
+		return
+	}
+
+	err = writePacket(conn, status_response_packet_id, appendString(nil, string(data)))
+	if err != nil {
+		srv.Logger.Printf(logger.LOG_LEVEL_WARNING, "Error writing status response: %v", err)
+		return
+	}
+
+	// The client may close the connection without sending the ping
+	ping, err := readPacket(rd)
+	if err != nil || ping.id != ping_request_packet_id {
+		return
+	}
+
+	writePacket(conn, pong_response_packet_id, ping.data)
+}
+
+// offlineStatus builds the status shown in the multiplayer list while the
+// server is offline or starting. The protocol version of the client is
+// echoed back so that the server is not marked as incompatible
+func (srv *McServer) offlineStatus(protocolVersion int32) statusResponse {
+	motd, color := srv.msm.config.MotdOffline, "gray"
+	if srv.IsRunning() {
+		motd, color = srv.msm.config.MotdStarting, "yellow"
+	}
+
+	version := srv.manifest.Version
+	if version == "" {
+		version = "Nixcraft"
+	}
+
+	return statusResponse{
+		Version: statusVersion{Name: version, Protocol: protocolVersion},
+		Players: statusPlayers{Max: srv.manifest.MaxPlayers},
+		Description: chatComponent{
+			Text:  srv.msm.formatMessage(motd, srv, ""),
+			Color: color,
+		},
+		Favicon: srv.favicon(),
+	}
+}
+
+// formatMessage replaces the {server}, {progress}, {player} and {url}
+// placeholders in a configurable message. srv can be nil
+func (msm *McServerManager) formatMessage(message string, srv *McServer, player string) string {
+	serverName, progress := "the server", 0
+	if srv != nil {
+		serverName = srv.DisplayName
+		_, progress = srv.State()
+	}
+
+	url := msm.config.PublicURL
+	if url == "" {
+		url = "the Nixcraft website"
+	}
+
+	return strings.NewReplacer(
+		"{server}", serverName,
+		"{progress}", strconv.Itoa(progress),
+		"{player}", player,
+		"{url}", url,
+	).Replace(message)
+}
+
+func (srv *McServer) favicon() string {
+	data, err := os.ReadFile(filepath.Join(srv.wd, server_icon_name))
+	if err != nil {
+		return ""
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)
+}
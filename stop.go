@@ -0,0 +1,277 @@
+package craft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+	"github.com/nixpare/process"
+)
+
+// idle_shutdown_after is how long a server can run without players
+const idle_shutdown_after = time.Minute * 10
+
+var errStopCancelled = errors.New("stop cancelled")
+
+// Stop gracefully stops the server, see StopContext
+func (srv *McServer) Stop() error {
+	return srv.StopContext(context.Background(), "")
+}
+
+// StopContext saves the world, shows a countdown with the reason to the
+// online players and sends the stop command. If the server does not exit
+// within the manifest stop timeout it is terminated, and then killed after
+// the kill timeout. The stop can be cancelled with ctx or CancelStop until
+// the stop command is sent
+func (srv *McServer) StopContext(ctx context.Context, reason string) error {
+	srv.cancelRestart()
+
+	srv.m.RLock()
+	proc, exited := srv.process, srv.exited
+	onlinePlayers := len(srv.Players) > 0
+	srv.m.RUnlock()
+
+	if proc == nil || !proc.IsRunning() {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	srv.stateM.Lock()
+	if srv.state == SERVER_STOPPING {
+		srv.stateM.Unlock()
+		return fmt.Errorf("server %s is already stopping", srv.Name)
+	}
+	prevState, prevProgress := srv.state, srv.progress
+	srv.state, srv.progress = SERVER_STOPPING, 0
+	srv.stopCancel = cancel
+	srv.stateM.Unlock()
+	go srv.msm.SignalStateUpdate()
+
+	defer func() {
+		srv.stateM.Lock()
+		srv.stopCancel = nil
+		srv.stateM.Unlock()
+	}()
+
+	proc.SendText("save-all flush")
+
+	if onlinePlayers {
+		err := srv.stopCountdown(ctx, proc, reason)
+		if err != nil {
+			srv.setState(prevState, prevProgress)
+			return err
+		}
+	}
+
+	proc.SendText("stop")
+	exitStatus, err := srv.waitExit(proc)
+	if err != nil {
+		// Still running, otherwise the exit is handled as a stop
+		if proc.IsRunning() {
+			srv.setState(prevState, prevProgress)
+		}
+		return err
+	}
+	// The server can be started again only after the exit is handled
+	if exited != nil {
+		<-exited
+	}
+
+	if exitStatus.Error() != nil {
+		return fmt.Errorf("minecraft server %s stop error (code: %d): %w", srv.Name, exitStatus.ExitCode, exitStatus.ExitError)
+	}
+
+	go srv.msm.SignalStateUpdate()
+	return nil
+}
+
+// stopCountdown shows the shutdown countdown to the players, if cancelled
+// it tells them that the server is not going to shut down anymore
+func (srv *McServer) stopCountdown(ctx context.Context, proc ServerProcess, reason string) error {
+	if reason == "" {
+		reason = "Server is going to shut down"
+	}
+
+	proc.SendText("/title @a times 0.5s 0.3s 0.5s")
+	subtitle := "/title @a subtitle " + titleJSON(reason)
+
+	for i := range srv.manifest.StopCountdown {
+		proc.SendText("/title @a title " + titleJSON(fmt.Sprint(srv.manifest.StopCountdown-i)))
+		proc.SendText(subtitle)
+
+		select {
+		case <-ctx.Done():
+			proc.SendText("/title @a title " + titleJSON("Shutdown cancelled"))
+			srv.msm.Logger.Printf(logger.LOG_LEVEL_INFO, "Minecraft server %s stop cancelled", srv.Name)
+			return fmt.Errorf("server %s: %w", srv.Name, errStopCancelled)
+		case <-time.After(time.Second):
+		}
+	}
+
+	proc.SendText("/title @a times 1s 0s 1s")
+	proc.SendText("/title @a title " + titleJSON("Server is shutting down"))
+	time.Sleep(time.Second * 2)
+
+	return nil
+}
+
+// waitExit waits for the process to exit after the stop command,
+// escalating to terminate and then kill on timeout
+func (srv *McServer) waitExit(proc ServerProcess) (process.ExitStatus, error) {
+	exited := make(chan process.ExitStatus, 1)
+	go func() {
+		exited <- proc.Wait()
+	}()
+
+	select {
+	case exitStatus := <-exited:
+		return exitStatus, nil
+	case <-time.After(time.Duration(srv.manifest.StopTimeout) * time.Second):
+	}
+
+	srv.msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Minecraft server %s did not stop in %ds, terminating", srv.Name, srv.manifest.StopTimeout)
+	err := proc.Stop()
+	if err != nil {
+		srv.msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error terminating server %s: %v", srv.Name, err)
+	}
+
+	select {
+	case exitStatus := <-exited:
+		return exitStatus, nil
+	case <-time.After(time.Duration(srv.manifest.KillTimeout) * time.Second):
+	}
+
+	srv.msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Minecraft server %s did not terminate in %ds, killing", srv.Name, srv.manifest.KillTimeout)
+	err = proc.Kill()
+	if err != nil {
+		return process.ExitStatus{}, fmt.Errorf("minecraft server %s kill error: %w", srv.Name, err)
+	}
+
+	return <-exited, nil
+}
+
+// Kill kills the server process right away. It is a requested stop,
+// so the exit is not reported as a crash and the server is not restarted
+func (srv *McServer) Kill() error {
+	srv.cancelRestart()
+
+	srv.m.RLock()
+	proc := srv.process
+	srv.m.RUnlock()
+
+	if proc == nil || !proc.IsRunning() {
+		return fmt.Errorf("server %s is not running", srv.Name)
+	}
+
+	prevState, prevProgress := srv.State()
+	srv.setState(SERVER_STOPPING, 0)
+
+	err := proc.Kill()
+	if err != nil && proc.IsRunning() {
+		srv.setState(prevState, prevProgress)
+		return fmt.Errorf("minecraft server %s kill error: %w", srv.Name, err)
+	}
+	return nil
+}
+
+// stopIdleServers stops the running servers without
+// players for idle_shutdown_after
+func (msm *McServerManager) stopIdleServers(now time.Time, l *logger.Logger) {
+	msm.mutex.RLock()
+	defer msm.mutex.RUnlock()
+
+	for _, srv := range msm.Servers {
+		srv.m.RLock()
+		isRunning := srv.IsRunning()
+		players := len(srv.Players)
+		lastDisconnect := srv.lastDisconnect
+		srv.m.RUnlock()
+
+		if !isRunning || players != 0 {
+			continue
+		}
+
+		if now.After(lastDisconnect.Add(idle_shutdown_after)) {
+			srv.serverLog.Printf(logger.LOG_LEVEL_INFO, "Shutting down server for inactivity")
+
+			err := srv.Stop()
+			if err != nil {
+				l.Printf(logger.LOG_LEVEL_ERROR, "Error shutting down Minecraft Server %s: %v", srv.Name, err)
+			}
+		}
+	}
+}
+
+// CancelStop cancels the stop in progress, if still in the countdown
+func (srv *McServer) CancelStop() error {
+	srv.stateM.RLock()
+	cancel := srv.stopCancel
+	srv.stateM.RUnlock()
+
+	if cancel == nil {
+		return fmt.Errorf("server %s is not stopping", srv.Name)
+	}
+
+	cancel()
+	return nil
+}
+
+// Restart stops the server and starts it again
+func (srv *McServer) Restart(reason string) error {
+	if reason == "" {
+		reason = "Server is restarting"
+	}
+
+	err := srv.StopContext(context.Background(), reason)
+	if err != nil {
+		return err
+	}
+
+	return srv.Start()
+}
+
+func (msm *McServerManager) Restart(name string) error {
+	msm.mutex.RLock()
+	srv, ok := msm.Servers[name]
+	msm.mutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("server %s not found", name)
+	}
+
+	return srv.Restart("")
+}
+
+func (msm *McServerManager) Kill(name string) error {
+	msm.mutex.RLock()
+	srv, ok := msm.Servers[name]
+	msm.mutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("server %s not found", name)
+	}
+
+	return srv.Kill()
+}
+
+func (msm *McServerManager) CancelStop(name string) error {
+	msm.mutex.RLock()
+	srv, ok := msm.Servers[name]
+	msm.mutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("server %s not found", name)
+	}
+
+	return srv.CancelStop()
+}
+
+func titleJSON(text string) string {
+	data, _ := json.Marshal(chatComponent{Text: text})
+	return string(data)
+}
@@ -0,0 +1,281 @@
+package craft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// state_version is the schema version written by this Nixcraft,
+	// there is a migration for each previous version
+	state_version = 2
+
+	max_stored_sessions = 1000
+	max_stored_events   = 1000
+)
+
+// Store persists the state of the manager across restarts. FileStore is
+// the default one, other backends (e.g. a database) only need to load
+// the state and to save every update atomically
+type Store interface {
+	// Load returns the saved state, migrated to the current version
+	Load() (State, error)
+	// Update applies fn to the state and saves the result: if fn or the
+	// save fail, the state is left as it was
+	Update(fn func(state *State) error) error
+	Close() error
+}
+
+// State is everything Nixcraft remembers across restarts
+type State struct {
+	Version int       `json:"version"`
+	Saved   time.Time `json:"saved"`
+
+	Users map[string]StoredUser `json:"users"`
+	// Routing maps the IP addresses to the server selected from
+	// the web interface, as used by the IP proxy routing
+	Routing  map[string]string       `json:"routing"`
+	Servers  map[string]StoredServer `json:"servers"`
+	Sessions []PlayerSession         `json:"sessions"`
+	// Events are the last events of the event bus, as an audit log
+	Events   []Event           `json:"events"`
+	Settings map[string]string `json:"settings"`
+}
+
+type StoredUser struct {
+	Name   string `json:"name"`
+	IP     string `json:"ip"`
+	Server string `json:"server,omitempty"`
+}
+
+type StoredServer struct {
+	LastDisconnect time.Time `json:"last_disconnect"`
+}
+
+// PlayerSession is the time spent by a player on a server,
+// Left is zero while the player is online
+type PlayerSession struct {
+	Player string    `json:"player"`
+	User   string    `json:"user,omitempty"`
+	Server string    `json:"server"`
+	Joined time.Time `json:"joined"`
+	Left   time.Time `json:"left"`
+}
+
+func newState() State {
+	return State{
+		Version:  state_version,
+		Users:    make(map[string]StoredUser),
+		Routing:  make(map[string]string),
+		Servers:  make(map[string]StoredServer),
+		Settings: make(map[string]string),
+	}
+}
+
+// stateMigrations upgrade the raw state from the version of their index to
+// the next one. The state is migrated as generic JSON, so that the old
+// layouts don't need to be kept as Go types
+var stateMigrations = []func(state map[string]any) error{
+	// 0 -> 1: a file without the version, written by hand
+	// or by an external tool, only needs the collections
+	func(state map[string]any) error {
+		for _, key := range []string{"users", "routing", "servers", "settings"} {
+			if _, ok := state[key]; !ok {
+				state[key] = map[string]any{}
+			}
+		}
+		return nil
+	},
+	// 1 -> 2: the players joined by hostname have no IP address,
+	// their server was saved as the route of the empty address
+	func(state map[string]any) error {
+		if routing, ok := state["routing"].(map[string]any); ok {
+			delete(routing, "")
+		}
+		return nil
+	},
+}
+
+// migrateState decodes a saved state of any version, reporting
+// whether it had to be migrated
+func migrateState(data []byte) (State, bool, error) {
+	var raw map[string]any
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return State{}, false, err
+	}
+
+	version := 0
+	if v, ok := raw["version"].(float64); ok {
+		version = int(v)
+	}
+	if version > state_version {
+		return State{}, false, fmt.Errorf("state version %d is newer than the supported %d", version, state_version)
+	}
+	migrated := version != state_version
+
+	for ; version < state_version; version++ {
+		err = stateMigrations[version](raw)
+		if err != nil {
+			return State{}, false, fmt.Errorf("migration from version %d: %w", version, err)
+		}
+	}
+	raw["version"] = state_version
+
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return State{}, false, err
+	}
+
+	state := newState()
+	err = json.Unmarshal(data, &state)
+	return state, migrated, err
+}
+
+// FileStore is a Store saving the state as JSON in a file, every update
+// rewrites it through a temporary file so that a crash can't corrupt it.
+// With an empty path the state is kept only in memory
+type FileStore struct {
+	path  string
+	state State
+	// saved is the last state written, restored when an update fails
+	saved []byte
+	m     sync.Mutex
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path, state: newState()}
+}
+
+func (fs *FileStore) Load() (State, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	if fs.path == "" {
+		return fs.cloneNoLock()
+	}
+
+	data, err := os.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		fs.state = newState()
+		return fs.cloneNoLock()
+	}
+	if err != nil {
+		return State{}, fmt.Errorf("state: %w", err)
+	}
+
+	state, migrated, err := migrateState(data)
+	if err != nil {
+		return State{}, fmt.Errorf("state: %s: %w", fs.path, err)
+	}
+	fs.state = state
+
+	// The migrated state is saved right away, so that the
+	// file always has the version of its layout
+	if migrated {
+		err = fs.saveNoLock()
+		if err != nil {
+			return State{}, err
+		}
+	}
+
+	return fs.cloneNoLock()
+}
+
+func (fs *FileStore) Update(fn func(state *State) error) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	if fs.saved == nil {
+		var err error
+		fs.saved, err = json.MarshalIndent(fs.state, "", "\t")
+		if err != nil {
+			return fmt.Errorf("state: %w", err)
+		}
+	}
+
+	err := fn(&fs.state)
+	if err == nil {
+		err = fs.saveNoLock()
+	}
+	if err != nil {
+		fs.state = newState()
+		json.Unmarshal(fs.saved, &fs.state)
+		return err
+	}
+
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	return nil
+}
+
+// cloneNoLock returns a deep copy of the state, so that
+// it can't be modified outside of Update
+func (fs *FileStore) cloneNoLock() (State, error) {
+	data, err := json.Marshal(fs.state)
+	if err != nil {
+		return State{}, fmt.Errorf("state: %w", err)
+	}
+
+	state := newState()
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (fs *FileStore) saveNoLock() error {
+	// Nothing to write if only the save time would change
+	data, err := json.MarshalIndent(fs.state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	if bytes.Equal(data, fs.saved) {
+		return nil
+	}
+
+	fs.state.Saved = time.Now()
+	data, err = json.MarshalIndent(fs.state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+
+	if fs.path != "" {
+		err = writeFileAtomic(fs.path, data)
+		if err != nil {
+			return fmt.Errorf("state: %w", err)
+		}
+	}
+
+	fs.saved = data
+	return nil
+}
+
+// writeFileAtomic writes the file through a temporary one in the same
+// directory, renamed only when completely written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
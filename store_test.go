@@ -0,0 +1,196 @@
+package craft
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+func TestMigrateState(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		migrated bool
+		routing  map[string]string
+	}{
+		{
+			name:     "no version",
+			data:     `{"users": {"alice": {"name": "alice", "ip": "10.0.0.1", "server": "survival"}}}`,
+			migrated: true,
+			routing:  map[string]string{},
+		},
+		{
+			name:     "version 1 with hostname routes",
+			data:     `{"version": 1, "users": {}, "routing": {"": "creative", "10.0.0.1": "survival"}, "servers": {}, "settings": {}}`,
+			migrated: true,
+			routing:  map[string]string{"10.0.0.1": "survival"},
+		},
+		{
+			name:     "current version",
+			data:     `{"version": 2, "users": {}, "routing": {"10.0.0.1": "survival"}, "servers": {}, "settings": {}}`,
+			migrated: false,
+			routing:  map[string]string{"10.0.0.1": "survival"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, migrated, err := migrateState([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if migrated != tt.migrated || state.Version != state_version {
+				t.Fatalf("got version %d, migrated %v", state.Version, migrated)
+			}
+			if state.Users == nil || state.Servers == nil || state.Settings == nil {
+				t.Fatalf("missing collections: %+v", state)
+			}
+
+			if len(state.Routing) != len(tt.routing) {
+				t.Fatalf("got routing %v, want %v", state.Routing, tt.routing)
+			}
+			for ip, srv := range tt.routing {
+				if state.Routing[ip] != srv {
+					t.Fatalf("got routing %v, want %v", state.Routing, tt.routing)
+				}
+			}
+		})
+	}
+
+	_, _, err := migrateState([]byte(`{"version": 100}`))
+	if err == nil {
+		t.Fatal("loaded a newer version")
+	}
+}
+
+func TestFileStoreMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte(`{"version": 1, "routing": {"": "creative"}}`), 0o644)
+
+	state, err := NewFileStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Routing) != 0 {
+		t.Fatalf("got routing %v", state.Routing)
+	}
+
+	// The migrated state is saved right away
+	data, _ := os.ReadFile(path)
+	state, migrated, err := migrateState(data)
+	if err != nil || migrated {
+		t.Fatalf("saved state not migrated: %v", err)
+	}
+}
+
+func TestFileStoreUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	fs := NewFileStore(path)
+	_, err := fs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Update(func(state *State) error {
+		state.Settings["key"] = "value"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged: the file is not written again
+	os.Remove(path)
+	err = fs.Update(func(state *State) error {
+		state.Settings["key"] = "value"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unchanged state written: %v", err)
+	}
+
+	// Failed: the state is left as it was
+	err = fs.Update(func(state *State) error {
+		state.Settings["key"] = "other"
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("error not returned")
+	}
+	fs.Update(func(state *State) error {
+		if state.Settings["key"] != "value" {
+			t.Errorf("got setting %q after a failed update", state.Settings["key"])
+		}
+		return nil
+	})
+}
+
+func TestSaveUserRouting(t *testing.T) {
+	msm := newMcServerManager(DefaultConfig(), logger.NewLogger(nil))
+	srv := &McServer{Name: "survival"}
+
+	byIP := newMcUser(msm, "alice")
+	byIP.IP, byIP.server = "10.0.0.1", srv
+	msm.saveUser(byIP)
+
+	byHost := newMcUser(msm, "Steve")
+	byHost.server = srv
+	msm.saveUser(byHost)
+
+	state, err := msm.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Users) != 2 {
+		t.Fatalf("got users %v", state.Users)
+	}
+	if len(state.Routing) != 1 || state.Routing["10.0.0.1"] != "survival" {
+		t.Fatalf("got routing %v", state.Routing)
+	}
+}
+
+func TestRecordEvents(t *testing.T) {
+	msm := newMcServerManager(DefaultConfig(), logger.NewLogger(nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go msm.recordEvents(ctx, done)
+
+	// Subscribed by recordEvents
+	for {
+		msm.bus.m.RLock()
+		n := len(msm.bus.subs)
+		msm.bus.m.RUnlock()
+		if n != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	msm.publish(EVENT_SERVER_STARTING, "survival", "alice", "")
+	msm.publish(EVENT_SERVER_READY, "survival", "", "")
+
+	// Saved together when stopped
+	cancel()
+	<-done
+
+	state, err := msm.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Events) != 2 || state.Events[0].Type != EVENT_SERVER_STARTING || state.Events[1].Type != EVENT_SERVER_READY {
+		t.Fatalf("got events %+v", state.Events)
+	}
+}
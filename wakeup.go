@@ -0,0 +1,106 @@
+package craft
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+// startOnJoin starts the server when a player tries to join it while it is
+// offline. It returns true if the server is starting, so the player can be
+// told to rejoin. Every IP address can start at most one server every
+// the StartOnJoinCooldown config seconds, and every server can be started
+// on join at most once every StartOnJoinServerCooldown seconds
+func (msm *McServerManager) startOnJoin(srv *McServer, login loginStart, addr string) bool {
+	if !srv.manifest.StartOnJoin {
+		return false
+	}
+	userName := login.Name
+
+	// With IP routing the user has already been matched with the web login,
+	// otherwise only the players allowed by the server itself are trusted
+	if msm.config.ProxyRouting != PROXY_ROUTING_IP && !srv.isAllowedPlayer(login) {
+		msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Player %s (%s) tried to start server %s but is not whitelisted", userName, addr, srv.Name)
+		return false
+	}
+
+	cooldown := time.Duration(msm.config.StartOnJoinCooldown) * time.Second
+	serverCooldown := time.Duration(msm.config.StartOnJoinServerCooldown) * time.Second
+
+	msm.joinStartsMutex.Lock()
+	now := time.Now()
+	last, ok := msm.joinStarts[addr]
+	limited := ok && now.Before(last.Add(cooldown))
+	lastServer, ok := msm.serverJoinStarts[srv.Name]
+	serverLimited := ok && now.Before(lastServer.Add(serverCooldown))
+	if !limited && !serverLimited {
+		for ip, t := range msm.joinStarts {
+			if now.After(t.Add(cooldown)) {
+				delete(msm.joinStarts, ip)
+			}
+		}
+		msm.joinStarts[addr] = now
+		msm.serverJoinStarts[srv.Name] = now
+	}
+	msm.joinStartsMutex.Unlock()
+
+	if limited {
+		msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Player %s (%s) tried to start server %s too often", userName, addr, srv.Name)
+		return srv.IsRunning()
+	}
+	if serverLimited {
+		msm.Logger.Printf(logger.LOG_LEVEL_WARNING, "Player %s (%s) tried to start server %s, started on join too recently", userName, addr, srv.Name)
+		return srv.IsRunning()
+	}
+
+	msm.Logger.Printf(logger.LOG_LEVEL_INFO, "Player %s (%s) is starting server %s", userName, addr, srv.Name)
+
+	err := msm.Start(srv.Name)
+	if err != nil && !srv.IsRunning() {
+		msm.Logger.Printf(logger.LOG_LEVEL_ERROR, "Error starting server %s on join: %v", srv.Name, err)
+		return false
+	}
+
+	return true
+}
+
+type allowedPlayer struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// isAllowedPlayer reports whether the player is listed in the whitelist.json
+// or ops.json files of the server. The entries with a UUID match the player
+// UUID when the client sends it, the name can be chosen by anyone
+func (srv *McServer) isAllowedPlayer(login loginStart) bool {
+	for _, file := range []string{"whitelist.json", "ops.json"} {
+		data, err := os.ReadFile(filepath.Join(srv.wd, file))
+		if err != nil {
+			continue
+		}
+
+		var players []allowedPlayer
+		if json.Unmarshal(data, &players) != nil {
+			continue
+		}
+
+		for _, p := range players {
+			if login.HasUUID && p.UUID != "" {
+				if strings.EqualFold(p.UUID, login.UUID.String()) {
+					return true
+				}
+				continue
+			}
+
+			if strings.EqualFold(p.Name, login.Name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,39 @@
+package craft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsAllowedPlayer(t *testing.T) {
+	dir := t.TempDir()
+	whitelist := `[{"uuid": "069a79f4-44e9-4726-a5be-fca90e38aaf5", "name": "Notch"}]`
+	ops := `[{"name": "jeb_"}]`
+	os.WriteFile(filepath.Join(dir, "whitelist.json"), []byte(whitelist), 0o644)
+	os.WriteFile(filepath.Join(dir, "ops.json"), []byte(ops), 0o644)
+
+	srv := &McServer{javaExec: javaExec{wd: dir}}
+	notch := mcUUID{0x06, 0x9a, 0x79, 0xf4, 0x44, 0xe9, 0x47, 0x26, 0xa5, 0xbe, 0xfc, 0xa9, 0x0e, 0x38, 0xaa, 0xf5}
+
+	tests := []struct {
+		name  string
+		login loginStart
+		want  bool
+	}{
+		{"uuid", loginStart{Name: "Notch", UUID: notch, HasUUID: true}, true},
+		{"renamed", loginStart{Name: "NotNotch", UUID: notch, HasUUID: true}, true},
+		{"name with another uuid", loginStart{Name: "Notch", UUID: mcUUID{1}, HasUUID: true}, false},
+		{"name without uuid", loginStart{Name: "notch"}, true},
+		{"op without uuid entry", loginStart{Name: "jeb_", UUID: mcUUID{1}, HasUUID: true}, true},
+		{"unknown", loginStart{Name: "Dinnerbone"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := srv.isAllowedPlayer(tt.login); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}